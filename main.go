@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/layout"
@@ -13,6 +15,11 @@ import (
 
 func main() {
 
+	// with a command we run headless, see tools.RunCli
+	if len(os.Args) > 1 {
+		os.Exit(tools.RunCli(os.Args[1:]))
+	}
+
 	var ui = tools.NewTools()
 	ui.Window.Resize(fyne.NewSize(660, 600))
 
@@ -23,7 +30,7 @@ func main() {
 	menuItem3 := fyne.NewMenuItem("Save", nil)
 	// menuItem4 := fyne.NewMenuItem("Exit", nil)
 	newMenu1 := fyne.NewMenu("File",
-		menuItem1, ui.MenuOpen, menuItem3)
+		menuItem1, ui.MenuOpen, menuItem3, ui.MenuImport, ui.MenuRotate)
 	menu := fyne.NewMainMenu(newMenu1)
 	ui.Window.SetMainMenu(menu)
 
@@ -35,13 +42,15 @@ func main() {
 					ui.Password,
 					ui.ConnectBtn,
 				),
-				container.NewMax(
-					ui.HostDescLabel,
-					ui.HostDesc,
+				container.NewBorder(nil, nil, nil, ui.EditHost,
+					container.NewMax(
+						ui.HostDescLabel,
+						ui.HostDesc,
+					),
 				),
 			),
 		),
-		nil,
+		container.NewPadded(ui.ConnState),
 		nil,
 		nil,
 		container.NewAppTabs(
@@ -59,18 +68,24 @@ func main() {
 									),
 									ui.Editor.Menu,
 								),
-								container.NewGridWithColumns(2,
-									layout.NewSpacer(),
+								container.NewGridWithColumns(3,
+									ui.Editor.Keys,
+									ui.Editor.Restore,
 									ui.Editor.Save,
 								),
 								ui.Editor.Desc,
 							),
 						),
-						container.NewGridWrap(
-							fyne.NewSize(660, 33),
-							container.NewMax(
-								ui.Editor.Status,
-								ui.Editor.Progress,
+						container.NewVBox(
+							ui.Editor.Details,
+							container.NewGridWrap(
+								fyne.NewSize(660, 33),
+								container.NewBorder(nil, nil, nil, ui.Editor.Cancel,
+									container.NewMax(
+										ui.Editor.Status,
+										ui.Editor.Progress,
+									),
+								),
 							),
 						),
 						nil,
@@ -100,11 +115,16 @@ func main() {
 								ui.Viewer.Desc,
 							),
 						),
-						container.NewGridWrap(
-							fyne.NewSize(660, 33),
-							container.NewMax(
-								ui.Viewer.Status,
-								ui.Viewer.Progress,
+						container.NewVBox(
+							ui.Viewer.Details,
+							container.NewGridWrap(
+								fyne.NewSize(660, 33),
+								container.NewBorder(nil, nil, nil, ui.Viewer.Cancel,
+									container.NewMax(
+										ui.Viewer.Status,
+										ui.Viewer.Progress,
+									),
+								),
 							),
 						),
 						nil,
@@ -113,6 +133,48 @@ func main() {
 					),
 				),
 			),
+			container.NewTabItem(
+				"Terminal",
+				container.NewPadded(
+					container.NewBorder(
+						container.NewHBox(
+							ui.Terminal.Open,
+							ui.Terminal.Close,
+						),
+						ui.Terminal.Status,
+						nil,
+						nil,
+						ui.Terminal.View,
+					),
+				),
+			),
+			container.NewTabItem(
+				"Fan-out",
+				container.NewPadded(
+					container.NewBorder(
+						container.NewBorder(nil, nil, nil,
+							container.NewHBox(
+								ui.Fanout.Viewer,
+								container.NewGridWrap(
+									fyne.NewSize(60, 36),
+									ui.Fanout.Parallel,
+								),
+								ui.Fanout.Run,
+								ui.Fanout.Cancel,
+								ui.Fanout.Export,
+							),
+							ui.Fanout.Hosts,
+						),
+						ui.Fanout.Status,
+						nil,
+						nil,
+						container.NewVSplit(
+							ui.Fanout.Grid,
+							ui.Fanout.Output,
+						),
+					),
+				),
+			),
 			container.NewTabItem(
 				"help",
 				container.NewPadded(
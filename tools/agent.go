@@ -0,0 +1,102 @@
+package tools
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ssh_agent connects to the agent listening on SSH_AUTH_SOCK.
+func ssh_agent() (agent.ExtendedAgent, error) {
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK not set")
+	}
+
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+
+	return agent.NewClient(c), nil
+}
+
+// signers returns the agent's signers followed by the key file's
+// certificate, the key itself and the other standard identities. They go
+// into a single publickey method since the ssh client will not try a
+// second method of the same kind.
+func (c *conn) signers(sk ssh_key) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		if c.agent != nil {
+			s, err := c.agent.Signers()
+			if err == nil {
+				signers = append(signers, s...)
+			}
+		}
+		if sk.cert_signer != nil {
+			signers = append(signers, sk.cert_signer)
+		}
+		if sk.signer != nil {
+			signers = append(signers, sk.signer)
+		}
+		signers = append(signers, sk.identities...)
+		return signers, nil
+	}
+}
+
+// agent_signer returns the agent's signer for the public key line, nil when
+// the agent does not hold it.
+func (c *conn) agent_signer(public string) ssh.Signer {
+	if c.agent == nil || public == "" {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(public))
+	if err != nil {
+		return nil
+	}
+	signers, err := c.agent.Signers()
+	if err != nil {
+		return nil
+	}
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+			return s
+		}
+	}
+	return nil
+}
+
+// forward_agent lets sessions on the remote reach our agent, the sessions
+// still have to ask for it, see new_session.
+func (c *conn) forward_agent() error {
+	if !c.agent_forwarding || c.agent == nil {
+		return nil
+	}
+	return agent.ForwardToAgent(c.ssh.Client, c.agent)
+}
+
+// new_session opens a session on the connection, requesting agent
+// forwarding when it is enabled for the host.
+func (c *conn) new_session() (*ssh.Session, error) {
+
+	sess, err := c.ssh.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.agent_forwarding && c.agent != nil {
+		err = agent.RequestAgentForwarding(sess)
+		if err != nil {
+			sess.Close()
+			return nil, err
+		}
+	}
+
+	return sess, nil
+}
@@ -0,0 +1,262 @@
+package tools
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/povsister/scp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serve_ssh runs an ssh server with config on one end of a connection
+// and returns the other end. serve is handed the server's connection,
+// without it channels are refused.
+func serve_ssh(t *testing.T, config *ssh.ServerConfig, serve func(sc *ssh.ServerConn, chans <-chan ssh.NewChannel)) net.Conn {
+	t.Helper()
+
+	client, server := socket_pair(t)
+	t.Cleanup(func() { client.Close() })
+	go serve_conn(server, config, serve)
+
+	return client
+}
+
+// serve_conn is the server side of serve_ssh.
+func serve_conn(nc net.Conn, config *ssh.ServerConfig, serve func(sc *ssh.ServerConn, chans <-chan ssh.NewChannel)) {
+
+	sc, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	if serve != nil {
+		serve(sc, chans)
+		return
+	}
+	for ch := range chans {
+		ch.Reject(ssh.Prohibited, "no channels here")
+	}
+}
+
+// socket_pair is a connected pair of loopback sockets. net.Pipe does not
+// buffer and both ends of an ssh handshake write before they read.
+func socket_pair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		nc, _ := l.Accept()
+		accepted <- nc
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("no connection accepted")
+	}
+
+	return client, server
+}
+
+// test_server_config accepts the keys given and the password "pw" when
+// password is set.
+func test_server_config(t *testing.T, password bool, keys ...ssh.PublicKey) *ssh.ServerConfig {
+	t.Helper()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range keys {
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return &ssh.Permissions{}, nil
+				}
+			}
+			return nil, errors.New("key not accepted")
+		},
+	}
+	if password {
+		config.PasswordCallback = func(_ ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if string(p) == "pw" {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, errors.New("wrong password")
+		}
+	}
+	config.AddHostKey(test_signer(t))
+
+	return config
+}
+
+func test_signer(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// test_key writes a new key pair to dir and returns the private key file
+// and its signer.
+func test_key(t *testing.T, dir, name string) (string, ssh.Signer) {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	err := generate_key(file, keyED25519, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, err := get_keys(file)
+	if err != nil || sk.signer == nil {
+		t.Fatal("reading back", file, err)
+	}
+	return file, sk.signer
+}
+
+func accept_any_host_key(string, net.Addr, ssh.PublicKey) error {
+	return nil
+}
+
+func TestAgentAuth(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	keyFile, keySigner := test_key(t, home, "id_test")
+
+	// the agent holds a key of its own
+	_, agentPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentSigner, err := ssh.NewSignerFromKey(agentPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: agentPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		agent    bool
+		keyOnly  bool
+		password string
+		server   *ssh.ServerConfig
+		ok       bool
+	}{
+		{"agent key", true, false, "", test_server_config(t, false, agentSigner.PublicKey()), true},
+		{"key file after the agent", true, false, "", test_server_config(t, false, keySigner.PublicKey()), true},
+		{"key file without an agent", false, false, "", test_server_config(t, false, keySigner.PublicKey()), true},
+		{"agent key without the agent", false, false, "", test_server_config(t, false, agentSigner.PublicKey()), false},
+		{"password after the keys", true, false, "pw", test_server_config(t, true), true},
+		{"wrong password", true, false, "nope", test_server_config(t, true), false},
+		{"key only skips the agent's keys", true, true, "", test_server_config(t, false, agentSigner.PublicKey()), false},
+		{"key only skips the password", true, true, "pw", test_server_config(t, true), false},
+		{"key only with the key file", true, true, "", test_server_config(t, false, keySigner.PublicKey()), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			c := conn{key: keyFile, password: tt.password, key_only: tt.keyOnly}
+			if tt.agent {
+				c.agent = keyring.(agent.ExtendedAgent)
+			}
+
+			spec := parse_host_spec("u@test:22")
+			config, _, err := c.client_config(spec, accept_any_host_key, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, err := handshake(serve_ssh(t, tt.server, nil), spec.addr, config, 5*time.Second)
+			if err == nil {
+				client.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("login: %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAgentForwardingRequest(t *testing.T) {
+
+	for _, forward := range []bool{false, true} {
+
+		asked := make(chan bool, 1)
+		serve := func(sc *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+			for nc := range chans {
+				ch, reqs, err := nc.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer ch.Close()
+					for req := range reqs {
+						if req.Type == "auth-agent-req@openssh.com" {
+							asked <- true
+						}
+						req.Reply(true, nil)
+					}
+				}()
+			}
+		}
+
+		signer := test_signer(t)
+		server := serve_ssh(t, test_server_config(t, false, signer.PublicKey()), serve)
+		client, err := handshake(server, "test:22", &ssh.ClientConfig{
+			User:            "u",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: accept_any_host_key,
+		}, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := conn{agent: agent.NewKeyring().(agent.ExtendedAgent), agent_forwarding: forward}
+		c.ssh, err = scp.NewClientFromExistingSSH(client, &scp.ClientOption{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sess, err := c.new_session()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.Close()
+		c.close()
+
+		select {
+		case <-asked:
+			if !forward {
+				t.Fatal("forwarding asked for without ForwardAgent")
+			}
+		default:
+			if forward {
+				t.Fatal("forwarding not asked for with ForwardAgent")
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey is one line of an authorized_keys file. Blank lines and
+// comments have no key and no error and are kept as they are.
+type authorizedKey struct {
+	line      string
+	options   []string
+	key       ssh.PublicKey
+	comment   string
+	err       error // the line does not parse
+	duplicate int   // index of an earlier line with the same key, or -1
+}
+
+// is_authorized_keys reports whether a job's file is an authorized_keys
+// file, which the editor offers the key manager for.
+func is_authorized_keys(file string) bool {
+	name := path.Base(file)
+	return name == "authorized_keys" || name == "authorized_keys2"
+}
+
+// parse_authorized_keys splits the text of an authorized_keys file into
+// its lines and flags duplicate keys.
+func parse_authorized_keys(text string) []authorizedKey {
+
+	var keys []authorizedKey
+	for _, l := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		keys = append(keys, parse_authorized_key_line(l))
+	}
+	if text == "" {
+		keys = nil
+	}
+
+	mark_duplicates(keys)
+
+	return keys
+}
+
+func parse_authorized_key_line(line string) authorizedKey {
+
+	k := authorizedKey{line: line, duplicate: -1}
+
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return k
+	}
+
+	key, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err == nil && len(rest) > 0 {
+		err = errors.New("more than one key on the line")
+	}
+	if err != nil {
+		k.err = err
+		return k
+	}
+
+	k.key = key
+	k.comment = comment
+	k.options = options
+
+	return k
+}
+
+// new_authorized_key builds a line from its parts, key being the key type
+// and base64 blob as in a .pub file, and checks it parses. A comment
+// already on key is used when comment is empty.
+func new_authorized_key(options, key, comment string) (authorizedKey, error) {
+
+	options = strings.TrimSpace(options)
+	key = strings.TrimSpace(key)
+	comment = strings.TrimSpace(comment)
+
+	if key == "" {
+		return authorizedKey{}, errors.New("no key")
+	}
+
+	fields := strings.Fields(key)
+	if comment != "" && len(fields) >= 2 {
+		key = fields[0] + " " + fields[1]
+	}
+
+	line := key
+	if options != "" {
+		line = options + " " + line
+	}
+	if comment != "" {
+		line += " " + comment
+	}
+
+	k := parse_authorized_key_line(line)
+	if k.err != nil {
+		return k, k.err
+	}
+	if k.key == nil {
+		return k, errors.New("no key")
+	}
+
+	return k, nil
+}
+
+func mark_duplicates(keys []authorizedKey) {
+	seen := map[string]int{}
+	for i := range keys {
+		keys[i].duplicate = -1
+		if keys[i].key == nil {
+			continue
+		}
+		blob := string(keys[i].key.Marshal())
+		if j, ok := seen[blob]; ok {
+			keys[i].duplicate = j
+			continue
+		}
+		seen[blob] = i
+	}
+}
+
+// authorized_keys_text joins the lines back into the file's text.
+func authorized_keys_text(keys []authorizedKey) string {
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k.line + "\n")
+	}
+	return sb.String()
+}
+
+func (k authorizedKey) fingerprint() string {
+	if k.key == nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(k.key)
+}
+
+// key_text is the key type and blob as in a .pub file.
+func (k authorizedKey) key_text() string {
+	if k.key == nil {
+		return ""
+	}
+	return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(k.key)), "\n")
+}
+
+// describe is the line as shown in the manager, with problems first.
+func (k authorizedKey) describe() string {
+	switch {
+	case k.err != nil:
+		return fmt.Sprintf("does not parse: %s: %s", k.err, k.line)
+	case k.key == nil:
+		return k.line
+	}
+	s := k.key.Type() + "  " + k.fingerprint()
+	if k.comment != "" {
+		s += "  " + k.comment
+	}
+	if len(k.options) > 0 {
+		s += "  [" + strings.Join(k.options, ",") + "]"
+	}
+	if k.duplicate >= 0 {
+		s = fmt.Sprintf("duplicate of line %d: %s", k.duplicate+1, s)
+	}
+	return s
+}
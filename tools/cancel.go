@@ -0,0 +1,67 @@
+package tools
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Commands and transfers taking a context are stopped when it is done: the
+// remote command is sent SIGTERM and its session closed, which ends the
+// wait on it even when the host ignores the signal, as dropbear does.
+
+// cancel_on_done stops sess when ctx is done, until the returned func is
+// called.
+func cancel_on_done(ctx context.Context, sess *ssh.Session) (stop func()) {
+
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.Signal(ssh.SIGTERM)
+			sess.Close()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// cancelled returns ctx's error in place of err when ctx is done, closing
+// the session shows up as an unhelpful EOF or exit without status.
+func cancelled(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// connect_ctx connects c, giving up when ctx is done. The login itself
+// can't be stopped, so c is closed once it is over instead.
+func connect_ctx(ctx context.Context, c *conn) error {
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Connect()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		go func() {
+			<-done
+			c.close()
+		}()
+		return ctx.Err()
+	}
+}
+
+func is_cancelled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,258 @@
+package tools
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// OpenSSH certificates: a user certificate signed by a CA is read from
+// "<key>-cert.pub" next to the private key, as ssh-keygen -s writes it, and
+// offered before the key itself. Host certificates are checked against the
+// @cert-authority lines of the known_hosts files.
+
+// load_cert reads the certificate for the private key file and returns it
+// along with a signer presenting it, both nil when there is no usable one.
+func load_cert(file string, signer ssh.Signer) (*ssh.Certificate, ssh.Signer) {
+
+	certFile := file + "-cert.pub"
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		log.Println("error parsing certificate " + certFile + ": " + err.Error())
+		return nil, nil
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		log.Println("not a user certificate " + certFile)
+		return nil, nil
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		log.Println("certificate " + certFile + " is not for " + file)
+		return nil, nil
+	}
+	if cert_expired(cert, time.Now()) {
+		log.Println("certificate " + certFile + " has expired")
+		return nil, nil
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		log.Println("error using certificate " + certFile + ": " + err.Error())
+		return nil, nil
+	}
+
+	return cert, certSigner
+}
+
+// cert_status describes the certificate the host took, if any, for the
+// connection status.
+func (c *conn) cert_status() string {
+	if c.cert == nil {
+		return ""
+	}
+	return " with " + cert_summary(c.cert)
+}
+
+func cert_expired(cert *ssh.Certificate, now time.Time) bool {
+	return cert.ValidBefore != ssh.CertTimeInfinity && uint64(now.Unix()) >= cert.ValidBefore
+}
+
+// cert_summary describes a user certificate by its principals and expiry.
+func cert_summary(cert *ssh.Certificate) string {
+
+	principals := "any user"
+	if len(cert.ValidPrincipals) > 0 {
+		principals = strings.Join(cert.ValidPrincipals, ", ")
+	}
+
+	expiry := "never expires"
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		expiry = "expires " + time.Unix(int64(cert.ValidBefore), 0).Format("2006-01-02 15:04")
+	}
+
+	name := "certificate"
+	if cert.KeyId != "" {
+		name += " " + cert.KeyId
+	}
+
+	return fmt.Sprintf("%s for %s, %s", name, principals, expiry)
+}
+
+// certSigner notes when the server took the certificate it presents, the
+// client only signs with a key the server said it accepts.
+type certSigner struct {
+	ssh.AlgorithmSigner
+	used func()
+}
+
+func (s certSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s.used()
+	return s.AlgorithmSigner.Sign(rand, data)
+}
+
+func (s certSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.used()
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// record_cert wraps the certificate signers of signers to set c.cert to
+// the certificate we logged in with.
+func (c *conn) record_cert(signers func() ([]ssh.Signer, error)) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		s, err := signers()
+		s = append([]ssh.Signer(nil), s...)
+		for i := range s {
+			cert, ok := s[i].PublicKey().(*ssh.Certificate)
+			as, ok2 := s[i].(ssh.AlgorithmSigner)
+			if ok && ok2 {
+				s[i] = certSigner{as, func() { c.cert = cert }}
+			}
+		}
+		return s, err
+	}
+}
+
+// plain_host_key_algos are the host key algorithms without certificates.
+// Asking for certificates from a host no CA is trusted for would fail its
+// known_hosts key, so they are only asked for where a CA applies. The
+// algorithms of the key types already recorded for the host, known, come
+// first so the host presents the key we have rather than another type.
+func plain_host_key_algos(known []string) []string {
+
+	algos := []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+	}
+
+	var first, rest []string
+	for _, a := range algos {
+		if contains_string(known, key_type_of_algo(a)) {
+			first = append(first, a)
+		} else {
+			rest = append(rest, a)
+		}
+	}
+
+	return append(first, rest...)
+}
+
+// key_type_of_algo is the key type a host key algorithm signs with.
+func key_type_of_algo(algo string) string {
+	switch algo {
+	case ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256:
+		return ssh.KeyAlgoRSA
+	}
+	return algo
+}
+
+func contains_string(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// has_host_ca reports whether the known_hosts files have an
+// @cert-authority line for addr, a host:port.
+func has_host_ca(files []string, addr string) bool {
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "22"
+	}
+
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		for len(b) > 0 {
+			marker, hosts, _, _, rest, err := ssh.ParseKnownHosts(b)
+			if err != nil {
+				break
+			}
+			if marker == "cert-authority" && match_known_host(hosts, host, port) {
+				return true
+			}
+			b = rest
+		}
+	}
+
+	return false
+}
+
+// match_known_host matches host and port against the host patterns of a
+// known_hosts line, "[host]:port" for ports other than 22, or hashed.
+func match_known_host(patterns []string, host, port string) bool {
+	matched := false
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if !match_host_pattern(p, host, port) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+func match_host_pattern(p, host, port string) bool {
+
+	// hashed as with HashKnownHosts, |1|salt|hash of the host as it is
+	// written unhashed
+	if strings.HasPrefix(p, "|") {
+		return match_hashed_host(p, knownhosts.Normalize(net.JoinHostPort(host, port)))
+	}
+
+	pport := "22"
+	if i := strings.LastIndex(p, "]:"); strings.HasPrefix(p, "[") && i > 0 {
+		p, pport = p[1:i], p[i+2:]
+	}
+	ok, _ := path.Match(p, host)
+	return ok && pport == port
+}
+
+// match_hashed_host checks host against a hashed known_hosts pattern, an
+// HMAC-SHA1 of the host keyed with the salt.
+func match_hashed_host(p, host string) bool {
+
+	parts := strings.Split(p, "|")
+	if len(parts) != 4 || parts[1] != "1" {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), want)
+}
@@ -0,0 +1,222 @@
+package tools
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sign_cert has ca sign a certificate of type typ for key, valid from an
+// hour ago until until, or forever when until is zero.
+func sign_cert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, typ uint32, principals []string, until time.Time) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key: key, CertType: typ, KeyId: "ops", ValidPrincipals: principals,
+		ValidAfter: uint64(time.Now().Add(-time.Hour).Unix()), ValidBefore: ssh.CertTimeInfinity,
+	}
+	if !until.IsZero() {
+		cert.ValidBefore = uint64(until.Unix())
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestLoadCert(t *testing.T) {
+
+	dir := t.TempDir()
+	key, signer := test_key(t, dir, "id_test")
+	ca := test_signer(t)
+	hour := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name string
+		cert string // of the -cert.pub file, none when empty
+		ok   bool
+	}{
+		{"no certificate", "", false},
+		{"not a key", "nonsense\n", false},
+		{"a plain key", string(ssh.MarshalAuthorizedKey(signer.PublicKey())), false},
+		{"host certificate", string(ssh.MarshalAuthorizedKey(sign_cert(t, ca, signer.PublicKey(), ssh.HostCert, nil, hour))), false},
+		{"for another key", string(ssh.MarshalAuthorizedKey(sign_cert(t, ca, test_signer(t).PublicKey(), ssh.UserCert, nil, hour))), false},
+		{"expired", string(ssh.MarshalAuthorizedKey(sign_cert(t, ca, signer.PublicKey(), ssh.UserCert, nil, time.Now().Add(-time.Minute)))), false},
+		{"valid", string(ssh.MarshalAuthorizedKey(sign_cert(t, ca, signer.PublicKey(), ssh.UserCert, []string{"u"}, hour))), true},
+		{"never expires", string(ssh.MarshalAuthorizedKey(sign_cert(t, ca, signer.PublicKey(), ssh.UserCert, nil, time.Time{}))), true},
+	}
+
+	for _, tt := range tests {
+		os.Remove(key + "-cert.pub")
+		if tt.cert != "" {
+			os.WriteFile(key+"-cert.pub", []byte(tt.cert), 0644)
+		}
+		cert, certSigner := load_cert(key, signer)
+		if (cert != nil) != tt.ok || (certSigner != nil) != tt.ok {
+			t.Errorf("%s: %v %v", tt.name, cert, certSigner)
+			continue
+		}
+		if tt.ok && string(certSigner.PublicKey().Marshal()) != string(cert.Marshal()) {
+			t.Errorf("%s: signer presents %s", tt.name, certSigner.PublicKey().Type())
+		}
+	}
+
+	// get_keys picks it up
+	sk, err := get_keys(key)
+	if err != nil || sk.cert == nil || sk.cert_signer == nil {
+		t.Error(sk.cert, err)
+	}
+}
+
+func TestCertSummary(t *testing.T) {
+
+	until := time.Date(2030, 1, 2, 15, 4, 0, 0, time.Local)
+	now := until.Add(-time.Second)
+
+	tests := []struct {
+		cert    ssh.Certificate
+		want    string
+		expired bool
+	}{
+		{ssh.Certificate{KeyId: "ops", ValidPrincipals: []string{"root", "admin"}, ValidBefore: uint64(until.Unix())},
+			"certificate ops for root, admin, expires 2030-01-02 15:04", false},
+		{ssh.Certificate{ValidBefore: ssh.CertTimeInfinity},
+			"certificate for any user, never expires", false},
+		{ssh.Certificate{KeyId: "old", ValidPrincipals: []string{"u"}, ValidBefore: uint64(now.Unix())},
+			"certificate old for u, expires 2030-01-02 15:03", true},
+	}
+
+	for _, tt := range tests {
+		if got := cert_summary(&tt.cert); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+		if expired := cert_expired(&tt.cert, now); expired != tt.expired {
+			t.Errorf("%s: expired %v", tt.want, expired)
+		}
+	}
+}
+
+func TestPlainHostKeyAlgos(t *testing.T) {
+
+	tests := []struct {
+		known []string
+		first []string
+	}{
+		{nil, []string{ssh.KeyAlgoED25519}},
+		{[]string{ssh.KeyAlgoECDSA256}, []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519}},
+		{[]string{ssh.KeyAlgoRSA, ssh.KeyAlgoED25519}, []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256}},
+	}
+
+	for _, tt := range tests {
+		algos := plain_host_key_algos(tt.known)
+		if len(algos) != 7 || strings.Join(algos[:len(tt.first)], ",") != strings.Join(tt.first, ",") {
+			t.Errorf("%q: %q", tt.known, algos)
+		}
+		for _, a := range algos {
+			if strings.Contains(a, "-cert-") {
+				t.Errorf("%q: asks for %s", tt.known, a)
+			}
+		}
+	}
+}
+
+func TestCertLogin(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	ca := test_signer(t)
+	key, signer := test_key(t, t.TempDir(), "id_test")
+	os.WriteFile(key+"-cert.pub", ssh.MarshalAuthorizedKey(sign_cert(t, ca, signer.PublicKey(), ssh.UserCert, []string{"u"}, time.Now().Add(time.Hour))), 0644)
+
+	// the host takes certificates of the CA only, and has a certificate of
+	// its own signed by it besides its plain key
+	checker := &ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+		return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+	}}
+	config := &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate}
+	hostKey := test_signer(t)
+	hostCert, _ := ssh.NewCertSigner(sign_cert(t, ca, hostKey.PublicKey(), ssh.HostCert, []string{"127.0.0.1"}, time.Time{}), hostKey)
+	config.AddHostKey(hostKey)
+	config.AddHostKey(hostCert)
+	addr := listen_ssh(t, config, nil)
+	_, port, _ := net.SplitHostPort(addr)
+
+	kh := filepath.Join(t.TempDir(), "known_hosts")
+	connect := func(file string) (*conn, error) {
+		c := &conn{host: "u@" + addr, key: file, key_only: true, known_hosts: []string{kh}}
+		err := c.Connect()
+		if err == nil {
+			c.close()
+		}
+		return c, err
+	}
+
+	// without a CA for the host its certificate is not asked for, and its
+	// plain key is not known
+	_, err := connect(key)
+	var unknown *unknownHostKeyError
+	if !errors.As(err, &unknown) || unknown.key.Type() != ssh.KeyAlgoED25519 {
+		t.Fatal(err)
+	}
+
+	caLine := func(ca ssh.Signer) []byte {
+		return []byte("@cert-authority [127.0.0.*]:" + port + " " + string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+	}
+	os.WriteFile(kh, caLine(ca), 0644)
+	c, err := connect(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(c.cert_status(), " with certificate ops for u, expires ") {
+		t.Errorf("status %q", c.cert_status())
+	}
+
+	// the key alone is not taken
+	os.Rename(key+"-cert.pub", key+"-cert.old")
+	if _, err := connect(key); err == nil {
+		t.Error("logged in without the certificate")
+	}
+	os.Rename(key+"-cert.old", key+"-cert.pub")
+
+	// a host certificate of another CA is not trusted
+	os.WriteFile(kh, caLine(test_signer(t)), 0644)
+	if _, err := connect(key); err == nil {
+		t.Error("trusted a host certificate of another CA")
+	}
+}
+
+// a host taking the plain key turns down the certificate offered first,
+// and the connection is not said to be using it
+func TestCertNotTaken(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	key, signer := test_key(t, t.TempDir(), "id_test")
+	os.WriteFile(key+"-cert.pub", ssh.MarshalAuthorizedKey(sign_cert(t, test_signer(t), signer.PublicKey(), ssh.UserCert, nil, time.Time{})), 0644)
+
+	config := test_server_config(t, false, signer.PublicKey())
+	hostKey := test_signer(t)
+	config.AddHostKey(hostKey)
+	addr := listen_ssh(t, config, nil)
+	kh := filepath.Join(t.TempDir(), "known_hosts")
+	trust_host_key(kh, addr, hostKey.PublicKey())
+
+	c := &conn{host: "u@" + addr, key: key, key_only: true, known_hosts: []string{kh}}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	c.close()
+	if c.cert != nil || c.cert_status() != "" {
+		t.Errorf("status %q", c.cert_status())
+	}
+}
@@ -0,0 +1,749 @@
+package tools
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The command line runs the jobs of a config without opening a window, so
+// cron jobs and scripts can use the same job definitions as the ui.
+
+const cliUsage = `usage: ssh-tools [-config file] [-key file] [-type type] [-bits n] [-parallel n] <command> [arguments]
+
+commands:
+  run <host> [viewer]    run a viewer and print its output, without a
+                         viewer the host's viewers are listed, ctrl-c
+                         stops a follow viewer
+  fanout <hosts> <viewer>
+                         run a viewer on several hosts at once and print
+                         each host's output, hosts being names and tags
+                         separated by commas, -parallel at a time
+  edit <host> [editor]   edit an editor's file in $EDITOR, then save it
+                         and run its command as the Save button does
+  hosts list             list the configured hosts
+  config validate        check the config file for mistakes
+  keysetup <host>        install our public key on the host, generating
+                         a key pair when there is none, like ssh-copy-id
+  keys list              list the keys we installed on hosts
+  keys uninstall <host>  remove the keys we installed from the host
+  keys rotate            replace our key with a new one on every host
+
+without a command the window is opened.
+
+keysetup and keys rotate generate keys of -type ed25519, ecdsa, rsa,
+ed25519-sk or ecdsa-sk and -bits size, ed25519 by default. without -key
+the standard identity files in ~/.ssh are used.
+
+the password for hosts without a key is read from $SSH_TOOLS_PASSWORD,
+or asked for on the terminal. other login prompts, like one time codes,
+are read from stdin.
+`
+
+type cli struct {
+	config *Config
+	conn   conn
+	key    string
+	stdin  *bufio.Reader
+
+	// hosts a fan-out runs on at once, 0 for the config's
+	parallel int
+
+	// type and size of keys generated
+	keyType string
+	keyBits int
+}
+
+// RunCli runs the command given by args, the arguments after the program
+// name, and returns the exit status.
+func RunCli(args []string) int {
+
+	fs := flag.NewFlagSet("ssh-tools", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	configFile := fs.String("config", "config.json", "config file")
+	key := fs.String("key", "", "private key file")
+	keyType := fs.String("type", "", "type of key to generate")
+	keyBits := fs.Int("bits", 0, "size of key to generate")
+	parallel := fs.Int("parallel", 0, "hosts to run on at once")
+
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+	args = fs.Args()
+
+	if len(args) == 0 || args[0] == "help" {
+		fs.Usage()
+		return 2
+	}
+
+	cl := &cli{key: *key, stdin: bufio.NewReader(os.Stdin), parallel: *parallel}
+
+	// keys can be set up on any host, configured or not
+	config, err := LoadConfigFrom(*configFile)
+	keys := args[0] == "keysetup" || args[0] == "keys"
+	if err != nil && !(keys && errors.Is(err, os.ErrNotExist)) {
+		fmt.Fprintln(os.Stderr, "ssh-tools:", err)
+		return 1
+	}
+	config.File = *configFile
+	cl.config = &config
+
+	cl.keyType, cl.keyBits = config.KeyType, config.KeyBits
+	if *keyType != "" || *keyBits != 0 {
+		cl.keyType, cl.keyBits = *keyType, *keyBits
+	}
+	if _, err := key_bits(cl.keyType, cl.keyBits); err != nil {
+		fmt.Fprintln(os.Stderr, "ssh-tools:", err)
+		return 2
+	}
+
+	switch {
+	case args[0] == "run" && (len(args) == 2 || len(args) == 3):
+		return cl.run(args[1:])
+	case args[0] == "fanout" && len(args) == 3:
+		return cl.fanout(args[1], args[2])
+	case args[0] == "edit" && (len(args) == 2 || len(args) == 3):
+		return cl.edit(args[1:])
+	case args[0] == "hosts" && len(args) == 2 && args[1] == "list":
+		return cl.listHosts()
+	case args[0] == "config" && len(args) == 2 && args[1] == "validate":
+		return cl.validateConfig()
+	case args[0] == "keysetup" && len(args) == 2:
+		return cl.keysetup(args[1])
+	case args[0] == "keys" && len(args) == 2 && args[1] == "list":
+		return cl.listKeys()
+	case args[0] == "keys" && len(args) == 3 && args[1] == "uninstall":
+		return cl.uninstallKeys(args[2])
+	case args[0] == "keys" && len(args) == 2 && args[1] == "rotate":
+		return cl.rotateKey()
+	}
+
+	fs.Usage()
+	return 2
+}
+
+func (cl *cli) fail(err error) int {
+	fmt.Fprintln(os.Stderr, "ssh-tools:", err)
+	return 1
+}
+
+func (cl *cli) run(args []string) int {
+
+	host := args[0]
+	h, ok := cl.config.Hosts[host]
+	if !ok {
+		return cl.fail(no_such_host(host))
+	}
+
+	if len(args) == 1 {
+		cl.listJobs(h.Viewers)
+		return 0
+	}
+
+	job, ok := h.Viewers[args[1]]
+	if !ok {
+		return cl.fail(fmt.Errorf("host %q has no viewer %q", host, args[1]))
+	}
+
+	err := cl.connect(host)
+	if err != nil {
+		return cl.fail(err)
+	}
+	defer cl.conn.close()
+	cl.installKey(host)
+
+	if job["file"] != "" {
+		text, err := cl.conn.get_content(job["file"])
+		if err != nil {
+			return cl.fail(fmt.Errorf("%s %s: %w", cl.conn.transport_name(), job["file"], err))
+		}
+		fmt.Print(text)
+		return 0
+	}
+
+	// the output goes straight to our stdout and stderr, a failing command
+	// passes on its exit status and ctrl-c stops the remote command too
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = cl.conn.run_ctx(ctx, job["cmd"])
+	if is_cancelled(err) && job_follow(job) {
+		// following is ended by ctrl-c
+		return 0
+	}
+	if is_cancelled(err) {
+		return 130
+	}
+	var exit *ssh.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitStatus()
+	}
+	if err != nil {
+		return cl.fail(fmt.Errorf("running \"%s\": %w", job["cmd"], err))
+	}
+
+	return 0
+}
+
+// fanout runs a viewer on the hosts picked, printing each host's line as it
+// finishes and then their output. The key's passphrase is asked for once up
+// front, hosts are not asked about, an unknown host key or a missing
+// password fails that host alone.
+func (cl *cli) fanout(picks, viewer string) int {
+
+	hosts, err := select_hosts(cl.config, picks)
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	parallel := cl.parallel
+	if parallel <= 0 {
+		parallel = cl.config.Parallel
+	}
+
+	err = unlock_key(cl.key, cl.askUnlock)
+	if err != nil {
+		return cl.fail(err)
+	}
+	setup := func(c *conn) {
+		c.password = os.Getenv("SSH_TOOLS_PASSWORD")
+		c.key = cl.key
+	}
+	var mu sync.Mutex
+	update := func(i int, r fanResult) {
+		if r.state != fanDone && r.state != fanFailed && r.state != fanCancelled {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(os.Stderr, "%-30s %-9s %s\n", r.host, r.state, r.summary())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	results := fan_out(ctx, cl.config, hosts, viewer, parallel, setup, update)
+
+	fmt.Fprintln(os.Stderr)
+	fmt.Print(fan_report(viewer, results))
+
+	done, failed, stopped := fan_counts(results)
+	fmt.Fprintf(os.Stderr, "%s on %d hosts: %d done, %d failed, %d cancelled\n",
+		viewer, len(results), done, failed, stopped)
+	if failed > 0 {
+		return 1
+	}
+	if stopped > 0 && ctx.Err() != nil {
+		return 130
+	}
+
+	return 0
+}
+
+func (cl *cli) edit(args []string) int {
+
+	host := args[0]
+	h, ok := cl.config.Hosts[host]
+	if !ok {
+		return cl.fail(no_such_host(host))
+	}
+
+	if len(args) == 1 {
+		cl.listJobs(h.Editors)
+		return 0
+	}
+
+	job, ok := h.Editors[args[1]]
+	if !ok {
+		return cl.fail(fmt.Errorf("host %q has no editor %q", host, args[1]))
+	}
+	file := job["file"]
+	if file == "" {
+		return cl.fail(fmt.Errorf("editor %q has no file", args[1]))
+	}
+
+	err := cl.connect(host)
+	if err != nil {
+		return cl.fail(err)
+	}
+	defer cl.conn.close()
+	cl.installKey(host)
+
+	text, err := cl.conn.get_content(file)
+	if err != nil {
+		return cl.fail(fmt.Errorf("%s %s: %w", cl.conn.transport_name(), file, err))
+	}
+
+	tmp, err := os.CreateTemp("", "ssh-tools-*-"+path.Base(file))
+	if err != nil {
+		return cl.fail(err)
+	}
+	// the file goes unless it holds edits that did not make it to the remote
+	keep := false
+	defer func() {
+		if !keep {
+			os.Remove(tmp.Name())
+		}
+	}()
+	_, err = tmp.WriteString(text)
+	tmp.Close()
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	err = run_editor(tmp.Name())
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	b, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return cl.fail(err)
+	}
+	edited := string(b)
+
+	if edited == text {
+		fmt.Fprintf(os.Stderr, "no changes to \"%s\"\n", file)
+		return 0
+	}
+
+	// someone else may have saved the file while we were editing
+	remote, err := cl.conn.get_content(file)
+	if err != nil {
+		keep = true
+		return cl.fail(fmt.Errorf(
+			"checking for remote changes: %w, your edits are kept in %s", err, tmp.Name()))
+	}
+	if remote != text {
+		merged, ok := merge3(text, edited, remote)
+		if !ok {
+			keep = true
+			_ = os.WriteFile(tmp.Name(), []byte(merged), 0600)
+			return cl.fail(fmt.Errorf(
+				"\"%s\" was changed on the remote and the changes conflict, "+
+					"the merge is kept in %s", file, tmp.Name()))
+		}
+		fmt.Fprintf(os.Stderr, "merged changes made to \"%s\" on the remote\n", file)
+		edited = merged
+	}
+
+	res, err := cl.conn.save_job(job, edited, remote)
+	if res != nil {
+		fmt.Print(res.Stdout)
+		if res.Stderr != "" {
+			fmt.Fprintln(os.Stderr, res.Stderr)
+		}
+	}
+
+	// the edits are on the remote unless saving failed or was rolled back
+	var failed *commandError
+	saved := err == nil || (errors.As(err, &failed) && !failed.rolledBack)
+	if err != nil {
+		if !saved {
+			keep = true
+			err = fmt.Errorf("%w, your edits are kept in %s", err, tmp.Name())
+		}
+		return cl.fail(err)
+	}
+
+	if job["cmd"] != "" {
+		fmt.Fprintf(os.Stderr, "success: saved \"%s\" and ran \"%s\", %s\n", file, job["cmd"], res.summary())
+	} else {
+		fmt.Fprintf(os.Stderr, "success: saved \"%s\"\n", file)
+	}
+
+	return 0
+}
+
+func (cl *cli) keysetup(host string) int {
+
+	key, generated, err := ensure_key(cl.key, cl.keyType, cl.keyBits, cl.askNewPassphrase)
+	if err != nil {
+		return cl.fail(err)
+	}
+	if generated {
+		fmt.Fprintf(os.Stderr, "generated %s\n", key)
+	}
+	cl.key = key
+
+	err = cl.connect(host)
+	if err != nil {
+		return cl.fail(err)
+	}
+	defer cl.conn.close()
+
+	installs, err := cl.conn.install_key(
+		key, cl.config.Hosts[host].AuthorizedKeys, cl.config.KeyRecordFile())
+	cl.printInstalls(key, installs)
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	err = verify_key(cl.config, host, key)
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "success: key login to %s works with %s\n", cl.conn.host, key)
+	return 0
+}
+
+func (cl *cli) printInstalls(key string, installs []keyInstall) {
+	for _, k := range installs {
+		if k.status == "installed" {
+			fmt.Fprintf(os.Stderr, "installed %s.pub in %s\n", key, k.file)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s.pub is already in %s\n", key, k.file)
+		}
+	}
+}
+
+// installKey puts our key on the connected host when its InstallKey policy
+// says so, asking on the terminal for "ask". Failing to is not fatal.
+func (cl *cli) installKey(host string) {
+
+	h := cl.config.Hosts[host]
+	if h.InstallKey != installAsk && h.InstallKey != installAlways {
+		return
+	}
+
+	key := cl.conn.key_file
+	missing, err := cl.conn.missing_key(key, h.AuthorizedKeys)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ssh-tools: checking for our key:", err)
+		return
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	if h.InstallKey == installAsk {
+		if !is_terminal(os.Stdin) {
+			return
+		}
+		answer, err := cl.ask(fmt.Sprintf("Add %s.pub to %s on %s (yes/no)? ",
+			key, strings.Join(missing, ", "), cl.conn.host))
+		if err != nil || !strings.EqualFold(strings.TrimSpace(answer), "yes") {
+			return
+		}
+	}
+
+	installs, err := cl.conn.install_key(key, h.AuthorizedKeys, cl.config.KeyRecordFile())
+	cl.printInstalls(key, installs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ssh-tools:", err)
+	}
+}
+
+func (cl *cli) listKeys() int {
+
+	records, err := load_key_records(cl.config.KeyRecordFile())
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			r.Host, r.File, r.Key, r.Time.Format("2006-01-02 15:04"))
+	}
+	w.Flush()
+
+	return 0
+}
+
+func (cl *cli) uninstallKeys(host string) int {
+
+	err := cl.connect(host)
+	if err != nil {
+		return cl.fail(err)
+	}
+	defer cl.conn.close()
+
+	removed, err := cl.conn.uninstall_keys(cl.config.KeyRecordFile())
+	for _, r := range removed {
+		fmt.Fprintf(os.Stderr, "removed %s.pub from %s\n", r.Key, r.File)
+	}
+	if err != nil {
+		return cl.fail(err)
+	}
+	if len(removed) == 0 {
+		fmt.Fprintf(os.Stderr, "no keys of ours recorded on %s\n", cl.conn.host)
+	}
+
+	return 0
+}
+
+func (cl *cli) rotateKey() int {
+
+	key := cl.key
+	if key == "" {
+		key = find_identity()
+	}
+	if key == "" {
+		key = default_key_file()
+	}
+	if !path_exists(key) {
+		return cl.fail(errors.New("no key to rotate at " + key))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	results, archive, err := rotate_key(ctx, cl.config, key, cl.keyType, cl.keyBits,
+		os.Getenv("SSH_TOOLS_PASSWORD"), cl.askNewPassphrase)
+	fmt.Print(rotate_report(key, results, archive))
+	if err != nil {
+		return cl.fail(err)
+	}
+	for _, r := range results {
+		if r.err != nil {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func (cl *cli) listHosts() int {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range cl.config.HostNames() {
+		fmt.Fprintf(w, "%q\t%s\n", name, cl.config.Hosts[name].Desc)
+	}
+	w.Flush()
+	return 0
+}
+
+func (cl *cli) listJobs(jobs Jobs) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range sorted_jobs(jobs) {
+		fmt.Fprintf(w, "%s\t%s\n", name, jobs[name]["desc"])
+	}
+	w.Flush()
+}
+
+func (cl *cli) validateConfig() int {
+
+	errs := cl.config.Validate()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cl.config.File, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+
+	fmt.Printf("%s: ok\n", cl.config.File)
+	return 0
+}
+
+// connect connects to a configured host, asking on the terminal about
+// unknown host keys and for key passphrases the way the ui does. Without
+// a terminal those fail the connection.
+func (cl *cli) connect(host string) error {
+
+	cl.conn.configure(cl.config, host)
+	cl.conn.password = os.Getenv("SSH_TOOLS_PASSWORD")
+	cl.conn.key = cl.key
+	if is_terminal(os.Stdin) {
+		cl.conn.ask_password = func() (string, error) {
+			return cl.askSecret(cl.conn.host + "'s password: ")
+		}
+	}
+	// one time codes may come from a pipe as well
+	cl.conn.ask_challenge = cl.askChallenge
+	cl.conn.ask_new_passphrase = cl.askNewPassphrase
+
+	for {
+
+		err := cl.conn.Connect()
+		if err == nil {
+			return nil
+		}
+		if !is_terminal(os.Stdin) {
+			return err
+		}
+
+		var unknown *unknownHostKeyError
+		var needPassphrase *passphraseNeededError
+
+		switch {
+		case errors.As(err, &unknown):
+			fmt.Fprintf(os.Stderr,
+				"The authenticity of host %s can't be established.\n"+
+					"%s key fingerprint is %s.\n",
+				unknown.host, unknown.key.Type(), unknown.fingerprint())
+			answer, aerr := cl.ask("Trust this key and connect (yes/no)? ")
+			if aerr != nil || !strings.EqualFold(strings.TrimSpace(answer), "yes") {
+				return err
+			}
+			err = trust_host_key(cl.config.KnownHostsFile(), unknown.host, unknown.key)
+			if err != nil {
+				return fmt.Errorf("saving host key: %w", err)
+			}
+
+		case errors.As(err, &needPassphrase):
+			passphrase, aerr := cl.askUnlock(needPassphrase)
+			if aerr != nil || passphrase == nil {
+				return err
+			}
+			cache_passphrase(needPassphrase.file, passphrase)
+
+		default:
+			return err
+		}
+	}
+}
+
+// askChallenge asks the prompts of a keyboard-interactive login on stdin,
+// without echo where the server says so.
+func (cl *cli) askChallenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+
+	if name != "" {
+		fmt.Fprintln(os.Stderr, name)
+	}
+	if instruction != "" {
+		fmt.Fprintln(os.Stderr, instruction)
+	}
+
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		var err error
+		if echos[i] {
+			answers[i], err = cl.ask(q)
+		} else {
+			answers[i], err = cl.askSecret(q)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return answers, nil
+}
+
+// askNewPassphrase asks twice for the passphrase of a key about to be
+// generated at file. Without a terminal, or at the end of input, the key
+// gets none.
+func (cl *cli) askNewPassphrase(file string) ([]byte, error) {
+
+	if !is_terminal(os.Stdin) {
+		return nil, nil
+	}
+
+	passphrase, err := cl.askSecret("Passphrase for the new key " + file + " (empty for none): ")
+	if err == io.EOF {
+		fmt.Fprintln(os.Stderr)
+		return nil, nil
+	}
+	if err != nil || passphrase == "" {
+		return nil, err
+	}
+	again, err := cl.askSecret("Same passphrase again: ")
+	if err != nil {
+		return nil, err
+	}
+	if again != passphrase {
+		return nil, errors.New("the passphrases do not match")
+	}
+
+	return []byte(passphrase), nil
+}
+
+// askUnlock asks for the passphrase of an encrypted private key on the
+// terminal, without one the key stays locked.
+func (cl *cli) askUnlock(need *passphraseNeededError) ([]byte, error) {
+
+	if !is_terminal(os.Stdin) {
+		return nil, nil
+	}
+
+	msg := "Passphrase for " + need.file + ": "
+	if need.incorrect {
+		msg = "Incorrect passphrase, try again: "
+	}
+	passphrase, err := cl.askSecret(msg)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(passphrase), nil
+}
+
+func (cl *cli) ask(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := cl.stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// askSecret asks without echoing the answer where stty is available.
+func (cl *cli) askSecret(prompt string) (string, error) {
+	if stty("-echo") == nil {
+		defer fmt.Fprintln(os.Stderr)
+		defer stty("echo")
+	}
+	return cl.ask(prompt)
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+func is_terminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// run_editor opens file in $VISUAL or $EDITOR and waits for it to exit.
+func run_editor(file string) error {
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+
+	// the editor may come with arguments, eg "code --wait"
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], file)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("running %s: %w", editor, err)
+	}
+
+	return nil
+}
+
+func no_such_host(host string) error {
+	return fmt.Errorf("no host %q in the config, see \"ssh-tools hosts list\"", host)
+}
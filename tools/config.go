@@ -3,8 +3,12 @@ package tools
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -13,17 +17,50 @@ type Job map[string]string
 type Jobs map[string]map[string]string
 
 type Host struct {
-	Desc    string `json:"Desc"`
-	Editors Jobs   `json:"Editors"`
-	Viewers Jobs   `json:"Viewers"`
+	Desc         string `json:"Desc"`
+	Editors      Jobs   `json:"Editors"`
+	Viewers      Jobs   `json:"Viewers"`
+	ForwardAgent bool   `json:"ForwardAgent,omitempty"` // forward our ssh-agent to the host
+	Jump         string `json:"Jump,omitempty"`         // jump hosts, eg "user@bastion:22,user@inner:2222"
+	Transport    string `json:"Transport,omitempty"`    // sftp, scp or cat, empty to negotiate
+	InstallKey   string `json:"InstallKey,omitempty"`   // put our key on the host on connect: never, ask or always
+	// authorized_keys files for our key, empty for the one the server reads for the user
+	AuthorizedKeys []string `json:"AuthorizedKeys,omitempty"`
+	ConnectTimeout int      `json:"ConnectTimeout,omitempty"` // seconds to wait for the host to answer, 0 for 15
+	KeepAlive      int      `json:"KeepAlive,omitempty"`      // seconds between keepalives, 0 for 30, negative for none
+	Tags           []string `json:"Tags,omitempty"`           // names to pick the host by with others, eg "openwrt"
 }
 
 type Hosts map[string]Host
 
 type Config struct {
-	Hosts Hosts  `json:"Hosts"` // map of hosts
-	Host  string `json:"Host"`  // last selected host
-	File  string // config file path
+	Hosts      Hosts  `json:"Hosts"`                // map of hosts
+	Host       string `json:"Host"`                 // last selected host
+	KnownHosts string `json:"KnownHosts,omitempty"` // known_hosts store for this config
+	KeyType    string `json:"KeyType,omitempty"`    // type of key we generate: ed25519, ecdsa, rsa, ed25519-sk or ecdsa-sk
+	KeyBits    int    `json:"KeyBits,omitempty"`    // size of key we generate, 0 for the default
+	Parallel   int    `json:"Parallel,omitempty"`   // hosts a fan-out runs on at once, 0 for 4
+	File       string // config file path
+}
+
+// KnownHostsFile is where host keys accepted through this config are
+// recorded, by default a known_hosts file next to the config file.
+func (c *Config) KnownHostsFile() string {
+	if c.KnownHosts != "" {
+		return c.KnownHosts
+	}
+	return filepath.Join(filepath.Dir(c.File), "known_hosts")
+}
+
+// KeyRecordFile is where the public key lines we add to hosts'
+// authorized_keys files are recorded, so they can be removed again.
+func (c *Config) KeyRecordFile() string {
+	return filepath.Join(filepath.Dir(c.File), "installed_keys.json")
+}
+
+// KnownHostsFiles are all the files host keys are checked against.
+func (c *Config) KnownHostsFiles() []string {
+	return []string{user_known_hosts_file(), c.KnownHostsFile()}
 }
 
 func (c *Config) DefaultHost() string {
@@ -38,6 +75,184 @@ func (c *Config) DefaultHost() string {
 	return ""
 }
 
+// HostNames returns the configured hosts in sorted order.
+func (c *Config) HostNames() []string {
+	names := make([]string, 0, len(c.Hosts))
+	for k := range c.Hosts {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TagNames returns the tags of all hosts, sorted.
+func (c *Config) TagNames() []string {
+	var tags []string
+	for _, h := range c.Hosts {
+		tags = append(tags, h.Tags...)
+	}
+	tags = unique_strings(tags)
+	sort.Strings(tags)
+	return tags
+}
+
+// ViewerNames returns the names of the viewers hosts have between them,
+// sorted.
+func (c *Config) ViewerNames(hosts []string) []string {
+	var names []string
+	for _, host := range hosts {
+		names = append(names, sorted_jobs(c.Hosts[host].Viewers)...)
+	}
+	names = unique_strings(names)
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks the hosts and jobs for settings that would only fail once
+// connected or saving, returning one error per problem found.
+func (c *Config) Validate() []error {
+
+	var errs []error
+	bad := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if len(c.Hosts) == 0 {
+		bad("no hosts configured")
+	}
+
+	_, err := key_bits(c.KeyType, c.KeyBits)
+	if err != nil {
+		bad("%s", err)
+	}
+
+	if c.Parallel < 0 {
+		bad("Parallel must not be negative")
+	}
+
+	for _, name := range c.HostNames() {
+
+		h := c.Hosts[name]
+
+		// the empty host is the template for new hosts
+		if name != "" {
+			err := check_host_spec(name)
+			if err != nil {
+				bad("host %q: %s", name, err)
+			}
+		}
+
+		if _, ok := transports[h.Transport]; h.Transport != "" && !ok {
+			bad("host %q: unknown transport %q, use one of %s",
+				name, h.Transport, strings.Join(transportOrder, ", "))
+		}
+
+		if h.ConnectTimeout < 0 {
+			bad("host %q: ConnectTimeout must not be negative", name)
+		}
+
+		switch h.InstallKey {
+		case "", installNever, installAsk, installAlways:
+		default:
+			bad("host %q: unknown InstallKey %q, use one of %s",
+				name, h.InstallKey, strings.Join(install_policies(), ", "))
+		}
+
+		for _, tag := range h.Tags {
+			if tag == "" || strings.ContainsAny(tag, ", ") {
+				bad("host %q: tag %q is empty or has a comma or space", name, tag)
+			} else if _, ok := c.Hosts[tag]; ok {
+				bad("host %q: tag %q is also the name of a host", name, tag)
+			}
+		}
+
+		for _, hop := range strings.Split(h.Jump, ",") {
+			hop = strings.TrimSpace(hop)
+			if hop == "" {
+				continue
+			}
+			err := check_host_spec(hop)
+			if err != nil {
+				bad("host %q: jump host %q: %s", name, hop, err)
+			}
+		}
+
+		for _, k := range sorted_jobs(h.Editors) {
+			job := h.Editors[k]
+			if job["file"] == "" {
+				bad("host %q: editor %q has no file", name, k)
+			}
+			if v, ok := job["backups"]; ok && v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					bad("host %q: editor %q: backups %q is not a number of backups", name, k, v)
+				}
+			}
+			if v, ok := job["rollback"]; ok && v != "" {
+				_, err := strconv.ParseBool(v)
+				if err != nil {
+					bad("host %q: editor %q: rollback %q is not true or false", name, k, v)
+				}
+			}
+		}
+
+		for _, k := range sorted_jobs(h.Viewers) {
+			job := h.Viewers[k]
+			if job["file"] == "" && job["cmd"] == "" {
+				bad("host %q: viewer %q has neither a file nor a cmd", name, k)
+			}
+			if v, ok := job["lines"]; ok && v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n <= 0 {
+					bad("host %q: viewer %q: lines %q is not a number of lines", name, k, v)
+				}
+			}
+			if v, ok := job["follow"]; ok && v != "" {
+				_, err := strconv.ParseBool(v)
+				if err != nil {
+					bad("host %q: viewer %q: follow %q is not true or false", name, k, v)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// check_host_spec reports host specs parse_host_spec would quietly fix up,
+// such as a missing host name or an invalid port.
+func check_host_spec(s string) error {
+
+	host := s
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		host = s[i+1:]
+	}
+
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		port := host[i+1:]
+		host = host[:i]
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	if host == "" {
+		return errors.New("no host name")
+	}
+
+	return nil
+}
+
+func sorted_jobs(jobs Jobs) []string {
+	names := make([]string, 0, len(jobs))
+	for k := range jobs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (c *Config) Json() (string, error) {
 
 	b, err := json.MarshalIndent(c, "", "\t")
@@ -111,7 +326,10 @@ func LoadConfigFrom(file string) (Config, error) {
 		return config1, err
 	}
 
-	json.Unmarshal(bytes1, &config1)
+	err = json.Unmarshal(bytes1, &config1)
+	if err != nil {
+		return Config{}, fmt.Errorf("bad config: %s: %w", file, err)
+	}
 
 	if reflect.DeepEqual(config1, Config{}) {
 		return Config{}, errors.New("bad config: " + file)
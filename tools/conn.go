@@ -1,22 +1,23 @@
 package tools
 
 import (
-	"crypto/ed25519"
-	"crypto/rand"
-	"encoding/pem"
-	"fmt"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"os"
-	"os/exec"
 	"os/user"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/povsister/scp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 var UseSytemDefaultUsername = false
@@ -65,6 +66,11 @@ func wordWrap(text string, lineWidth int) string {
 	return string(wrap)
 }
 
+// shell_quote quotes s for use as a single word in a posix shell command.
+func shell_quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 func path_exists(path string) bool {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -76,7 +82,21 @@ func path_exists(path string) bool {
 	return false
 }
 
+// hostSpec is a user@host:port spec resolved through ~/.ssh/config.
+type hostSpec struct {
+	user      string
+	addr      string   // host:port to dial
+	alias     string   // set when ~/.ssh/config gave the name a HostName
+	identity  []string // IdentityFile entries
+	proxyJump string
+}
+
 func ParseHostSpecToUserHost(s string) (string, string) {
+	h := parse_host_spec(s)
+	return h.user, h.addr
+}
+
+func parse_host_spec(s string) hostSpec {
 
 	var user string
 	var host string
@@ -86,12 +106,11 @@ func ParseHostSpecToUserHost(s string) (string, string) {
 	var r []string
 
 	if s == "" {
-		return GetDefaultUsername, "localhost:22"
+		return hostSpec{user: GetDefaultUsername, addr: "localhost:22"}
 	}
 
 	q = strings.Split(s, "@")
 	if len(q) == 1 {
-		user = GetDefaultUsername
 		host = s
 	} else {
 		user = q[0]
@@ -99,139 +118,170 @@ func ParseHostSpecToUserHost(s string) (string, string) {
 	}
 
 	r = strings.Split(host, ":")
-	if len(r) == 1 {
-		port = "22"
-	} else if len(r) > 0 {
+	if len(r) > 1 {
 		host = strings.Join(r[:len(r)-1], "")
 		port = r[len(r)-1]
 	}
 
-	p, err := strconv.Atoi(port)
+	// anything not on the spec comes from ~/.ssh/config
+	h := hostSpec{}
+	sc, err := load_ssh_config()
 	if err != nil {
-		p = 22
-	}
-	if p < 1 || p > 65535 {
-		p = 22
-	}
-
-	return user, host + ":" + strconv.Itoa(p)
-
-}
-
-func generate_ssh_keys() (string, error) {
-
-	// home directory
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return "", err
-	}
-
-	private := filepath.Join(home, ".ssh", "id_ed25519")
-	if path_exists(private) {
-		return private, nil
+		log.Println("error reading ssh config: " + err.Error())
+	} else {
+		hc := sc.lookup(host, user)
+		if hc.HostName != "" && hc.HostName != host {
+			h.alias = host
+			host = hc.HostName
+		}
+		if user == "" {
+			user = hc.User
+		}
+		if port == "" {
+			port = hc.Port
+		}
+		h.identity = hc.IdentityFiles
+		if !strings.EqualFold(hc.ProxyJump, "none") {
+			h.proxyJump = hc.ProxyJump
+		}
 	}
-	// fmt.Println(private)
 
-	public := private + ".pub"
-	user, _ := user.Current()
-	host, _ := os.Hostname()
-
-	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return "", err
+	if user == "" {
+		user = GetDefaultUsername
 	}
 
-	publicKey, err := ssh.NewPublicKey(pubKey)
+	p, err = strconv.Atoi(port)
 	if err != nil {
-		return "", err
-	}
-
-	pemKey := &pem.Block{
-		Type:  "OPENSSH PRIVATE KEY",
-		Bytes: MarshalED25519PrivateKey(privKey), // <- marshals ed25519 correctly
+		p = 22
 	}
-
-	privateKey := pem.EncodeToMemory(pemKey)
-
-	authorizedKey := []byte(
-		fmt.Sprintf("%s %s@%s",
-			strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(publicKey)), "\n"),
-			user.Username,
-			host,
-		),
-	)
-
-	err = os.WriteFile(private, privateKey, 0600)
-	if err != nil {
-		return "", err
+	if p < 1 || p > 65535 {
+		p = 22
 	}
 
-	err = os.WriteFile(public, authorizedKey, 0644)
-	if err != nil {
-		return "", err
-	}
+	h.user = user
+	h.addr = host + ":" + strconv.Itoa(p)
 
-	return private, nil
+	return h
 
 }
 
 type conn struct {
-	ssh      *scp.Client
-	host     string
-	password string
-	key      string
-	os       string
+	ssh         *scp.Client
+	host        string
+	password    string
+	key         string
+	os          string
+	known_hosts []string
+
+	// agent is tried before the key file, when nil Connect looks for
+	// one on SSH_AUTH_SOCK
+	agent            agent.ExtendedAgent
+	agent_forwarding bool
+
+	// transport pinned for the host, else the one that worked, see transfer
+	transport      string
+	transport_used string
+
+	// jump hosts to go through, see jump_hosts
+	jump string
+	hops []*ssh.Client
+
+	host_key_err error
+
+	// private key file the host was offered
+	key_file string
+
+	// asked for the password when none is set
+	ask_password func() (string, error)
+	// asked the prompts of a keyboard-interactive login, see keyboard_interactive
+	ask_challenge ssh.KeyboardInteractiveChallenge
+	// asked for a passphrase for a key generated on connect, see new_passphrase
+	ask_new_passphrase func(file string) ([]byte, error)
+	// log in with the key alone, without the agent or a password
+	key_only bool
+
+	// type and size of key generated when there is none, see generate_key
+	key_type string
+	key_bits int
+
+	// certificate the host took, see record_cert
+	cert *ssh.Certificate
+
+	// seconds to wait for the host to answer and between keepalives, 0
+	// for the defaults and a negative keep_alive for none, see watch
+	timeout    int
+	keep_alive int
+	state      *connState
+	// told when the connection is up or lost
+	on_state func(state string, err error)
+}
+
+// configure points the connection at host with the settings the config
+// has for it.
+func (c *conn) configure(config *Config, host string) {
+
+	// aliases from ~/.ssh/config are kept as typed, Connect resolves them
+	spec := parse_host_spec(host)
+	c.host = spec.user + "@" + spec.addr
+	if spec.alias != "" {
+		c.host = host
+	}
+
+	c.known_hosts = config.KnownHostsFiles()
+	c.agent_forwarding = config.Hosts[host].ForwardAgent
+	c.jump = config.Hosts[host].Jump
+	c.transport = config.Hosts[host].Transport
+	c.key_type = config.KeyType
+	c.key_bits = config.KeyBits
+	c.timeout = config.Hosts[host].ConnectTimeout
+	c.keep_alive = config.Hosts[host].KeepAlive
 }
 
 func (c *conn) Connect() error {
 
 	var err error
-	user, host := ParseHostSpecToUserHost(c.host)
+	spec := parse_host_spec(c.host)
 
 	// fmt.Printf("%s: %s\n", user, host)
 	// fmt.Println(GetDefaultUsername)
 
-	sk, _ := get_keys(c.key)
+	c.close()
+	c.host_key_err = nil
+	c.cert = nil
+	c.transport_used = ""
 
-	sshClientConfig := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(c.password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	if c.agent == nil {
+		c.agent, _ = ssh_agent()
 	}
 
-	sshClientConfig.Auth = []ssh.AuthMethod{
-		ssh.PublicKeys(sk.signer),
-		ssh.Password(c.password),
+	checkHostKey, err := host_key_callback(c.known_hosts)
+	if err != nil {
+		return err
 	}
 
 	// Connect to the remote server and perform the SSH handshake.
-	//client, err := scp.NewClient(host, sshClientConfig, &scp.ClientOption{})
-	c.ssh, err = scp.NewClient(host, sshClientConfig, &scp.ClientOption{})
+	client, sk, err := c.dial(spec, checkHostKey)
+	if err != nil {
+		return err
+	}
 
+	c.ssh, err = scp.NewClientFromExistingSSH(client, &scp.ClientOption{})
 	if err != nil {
+		client.Close()
+		c.close()
 		return err
 	}
 
-	/* Write the public key associated with the private key that made
-	this successful connection to the authorized_keys file of the remote
-	server.
-	Will do both ~/.ssh/authorized_keys and /etc/dropbear/authorized_keys
-	*/
+	err = c.forward_agent()
+	if err != nil {
+		return err
+	}
 
-	var sb strings.Builder
-	sb.WriteString("k='" + sk.public_key + "'; ")
-	sb.WriteString("for d in \"/etc/dropbear\" \"~/.ssh\"; do ")
-	sb.WriteString("f=\"$d/authorized_keys\"; ")
-	sb.WriteString("if [ -d \"$d\" ]; then ")
-	sb.WriteString("[ -f \"$f\" ] || echo \"$k\" >> \"$f\"; ")
-	sb.WriteString("grep -q \"$k\" \"$f\" || echo \"$k\" >> \"$f\"; ")
-	sb.WriteString("fi; done;")
+	// the key is installed on the host by the caller, as the host's
+	// InstallKey policy says, see install_key
+	c.key_file = sk.private_key_file
 
-	if sk.public_key != "" {
-		_ = c.run(sb.String())
-	}
+	c.watch()
 
 	os, _ := c.output("cmd /c ver || uname -a")
 
@@ -245,14 +295,180 @@ func (c *conn) Connect() error {
 	// fmt.Println(c.os)
 	// fmt.Println(c.os)
 
+	if c.on_state != nil {
+		c.on_state(stateConnected, nil)
+	}
+
 	return nil
 }
 
+// client_config sets up authentication for one host of the chain, target
+// is set for the host we are connecting to as opposed to a jump host. The
+// key and password given for the connection are meant for the target, jump
+// hosts use their own IdentityFile and only fall back on the key.
+func (c *conn) client_config(spec hostSpec, checkHostKey ssh.HostKeyCallback, target bool) (*ssh.ClientConfig, ssh_key, error) {
+
+	key := ""
+	if target {
+		key = c.key
+	}
+	if key == "" {
+		for _, f := range spec.identity {
+			if path_exists(f) {
+				key = f
+				break
+			}
+		}
+	}
+	if key == "" {
+		key = c.key
+	}
+
+	// without a key all the standard identities are offered like ssh does,
+	// a key of the configured type is generated when there are none
+	discover := key == ""
+	if discover && find_identity() == "" {
+		passphrase, err := new_passphrase(c.ask_new_passphrase, identity_file(c.key_type), c.key_type)
+		if err != nil {
+			return nil, ssh_key{}, err
+		}
+		_, err = generate_ssh_keys(c.key_type, c.key_bits, passphrase)
+		if err != nil {
+			return nil, ssh_key{}, err
+		}
+	}
+
+	sk, err := get_keys(key)
+	var needPassphrase *passphraseNeededError
+	if errors.As(err, &needPassphrase) {
+		return nil, sk, err
+	}
+	if discover {
+		sk.identities = identity_signers(sk.private_key_file)
+	}
+
+	signers := c.signers(sk)
+	if target {
+		signers = c.record_cert(signers)
+	}
+	auth := []ssh.AuthMethod{
+		ssh.PublicKeysCallback(signers),
+	}
+	if target && c.key_only {
+		// security keys sign through the agent
+		signer := sk.signer
+		if signer == nil {
+			signer = c.agent_signer(sk.public_key)
+		}
+		if signer == nil {
+			return nil, sk, errors.New("no private key in " + sk.private_key_file)
+		}
+		keys := []ssh.Signer{signer}
+		if sk.cert_signer != nil {
+			keys = []ssh.Signer{sk.cert_signer, signer}
+		}
+		auth = []ssh.AuthMethod{ssh.PublicKeysCallback(c.record_cert(
+			func() ([]ssh.Signer, error) { return keys, nil }))}
+	} else if target {
+		auth = append(auth, ssh.PasswordCallback(func() (string, error) {
+			if c.password == "" && c.ask_password != nil {
+				return c.ask_password()
+			}
+			return c.password, nil
+		}))
+		auth = append(auth, ssh.KeyboardInteractive(c.keyboard_interactive()))
+	}
+
+	config := &ssh.ClientConfig{
+		User: spec.user,
+		Auth: auth,
+		// the handshake error only carries the text of what the callback
+		// returned, keep the error itself so the caller can act on it
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			c.host_key_err = checkHostKey(hostname, remote, key)
+			return c.host_key_err
+		},
+	}
+	if !has_host_ca(c.known_hosts, spec.addr) {
+		config.HostKeyAlgorithms = plain_host_key_algos(known_host_key_types(c.known_hosts, spec.addr))
+	}
+
+	return config, sk, nil
+}
+
+// keyboard_interactive answers the prompts of a keyboard-interactive login,
+// like pam asking for a password and then a one time code. A password
+// prompt is answered once with the password when there is one, the rest
+// is asked through ask_challenge.
+func (c *conn) keyboard_interactive() ssh.KeyboardInteractiveChallenge {
+
+	// pam asks again when the password was wrong, that one is for the user
+	passwordGiven := false
+
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+
+		answers := make([]string, len(questions))
+		var ask []int
+		for i, q := range questions {
+			if !echos[i] && !passwordGiven && c.password != "" &&
+				strings.Contains(strings.ToLower(q), "password") {
+				answers[i] = c.password
+				passwordGiven = true
+				continue
+			}
+			ask = append(ask, i)
+		}
+		if len(ask) == 0 {
+			return answers, nil
+		}
+
+		if c.ask_challenge == nil {
+			return nil, errors.New("keyboard-interactive login has no one to answer " +
+				strings.TrimSpace(questions[ask[0]]))
+		}
+
+		var qs []string
+		var es []bool
+		for _, i := range ask {
+			qs = append(qs, questions[i])
+			es = append(es, echos[i])
+		}
+		as, err := c.ask_challenge(name, instruction, qs, es)
+		if err != nil {
+			return nil, err
+		}
+		if len(as) != len(qs) {
+			return nil, errors.New("keyboard-interactive login got the wrong number of answers")
+		}
+		for j, i := range ask {
+			answers[i] = as[j]
+		}
+
+		return answers, nil
+	}
+}
+
+// close drops the connection and any jump host connections under it.
+func (c *conn) close() {
+	if c.state != nil {
+		c.state.stop_watching()
+		c.state = nil
+	}
+	if c.ssh != nil {
+		c.ssh.Close()
+		c.ssh = nil
+	}
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		c.hops[i].Close()
+	}
+	c.hops = nil
+}
+
 func (c *conn) isConnected() bool {
-	return c.ssh != nil
+	return c.ssh != nil && c.state.up()
 }
 
-func (c *conn) get_content_scp(remotePath string) (string, error) {
+func (c *conn) get_content_scp(ctx context.Context, remotePath string) (string, error) {
 
 	// takes a remote file path
 	// returns the contents as a string
@@ -267,15 +483,15 @@ func (c *conn) get_content_scp(remotePath string) (string, error) {
 
 	sb := new(strings.Builder)
 
-	err := c.ssh.CopyFromRemote(remotePath, sb, &scp.FileTransferOption{})
+	err := c.ssh.CopyFromRemote(remotePath, sb, &scp.FileTransferOption{Context: ctx})
 	if err != nil {
-		return "", err
+		return "", cancelled(ctx, err)
 	}
 
 	return sb.String(), nil
 }
 
-func (c *conn) get_content_ssh(remotePath string) (string, error) {
+func (c *conn) get_content_ssh(ctx context.Context, remotePath string) (string, error) {
 
 	// takes a remote file path
 	// returns the contents as a string
@@ -289,33 +505,26 @@ func (c *conn) get_content_ssh(remotePath string) (string, error) {
 	}
 
 	// open a client conn
-	sess, err := c.ssh.NewSession()
+	sess, err := c.new_session()
 	if err != nil {
 		return "", err
 	}
 
 	defer sess.Close()
+	defer cancel_on_done(ctx, sess)()
 
 	// run cat command
 	// cat filename
 	// where filename
-	result, err := sess.Output(fmt.Sprintf("cat \"%s\"", remotePath))
+	result, err := sess.Output("cat " + shell_quote(remotePath))
 	if err != nil {
-		return "", err
+		return "", cancelled(ctx, err)
 	}
 
 	return string(result), nil
 }
 
-func (c *conn) get_content(remotePath string) (string, error) {
-	result, err := c.get_content_scp(remotePath)
-	if err != nil {
-		return "", err
-	}
-	return result, nil
-}
-
-func (c *conn) set_content_scp(text, remotePath string) error {
+func (c *conn) set_content_scp(ctx context.Context, text, remotePath string) error {
 
 	// takes some text and saves it to a remote file
 	// replacing the existing content
@@ -330,15 +539,15 @@ func (c *conn) set_content_scp(text, remotePath string) error {
 
 	reader := strings.NewReader(text)
 
-	err := c.ssh.CopyToRemote(reader, remotePath, &scp.FileTransferOption{})
+	err := c.ssh.CopyToRemote(reader, remotePath, &scp.FileTransferOption{Context: ctx})
 	if err != nil {
-		return err
+		return cancelled(ctx, err)
 	}
 
 	return nil
 }
 
-func (c *conn) set_content_ssh(text, remotePath string) error {
+func (c *conn) set_content_ssh(ctx context.Context, text, remotePath string) error {
 
 	// takes some text and saves it to a remote file
 	// replacing the existing content
@@ -353,12 +562,13 @@ func (c *conn) set_content_ssh(text, remotePath string) error {
 	}
 
 	// open a client conn
-	sess, err := c.ssh.NewSession()
+	sess, err := c.new_session()
 	if err != nil {
 		return err
 	}
 
 	defer sess.Close()
+	defer cancel_on_done(ctx, sess)()
 
 	// stdin pipe
 	w, err := sess.StdinPipe()
@@ -366,37 +576,27 @@ func (c *conn) set_content_ssh(text, remotePath string) error {
 		return err
 	}
 
-	defer w.Close()
-
 	// echo to remote file
 	// os specific command here
 	// not very portable
-	err = sess.Start(fmt.Sprintf("cat > \"%s\"", remotePath))
+	err = sess.Start("cat > " + shell_quote(remotePath))
 	if err != nil {
 		return err
 	}
 
-	// write the text to the pipe
-	i, err := fmt.Fprintf(w, text)
+	// write the text to the pipe, closing it ends cat's input
+	_, err = io.WriteString(w, text)
+	w.Close()
 	if err != nil {
-		return err
+		return cancelled(ctx, err)
 	}
 
-	// what do I do with this ?
-	fmt.Println(i)
-	return nil
+	return cancelled(ctx, sess.Wait())
 }
 
-func (c *conn) set_content(text, remotePath string) error {
-	err := c.set_content_scp(text, remotePath)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (c *conn) run(text string) error {
+// run_ctx runs the command with its output going to ours, stopping it
+// when ctx is done.
+func (c *conn) run_ctx(ctx context.Context, text string) error {
 
 	var sess *ssh.Session
 	var err error
@@ -408,12 +608,13 @@ func (c *conn) run(text string) error {
 		}
 	}
 
-	sess, err = c.ssh.NewSession()
+	sess, err = c.new_session()
 	if err != nil {
 		return err
 	}
 
 	defer sess.Close()
+	defer cancel_on_done(ctx, sess)()
 
 	sess.Stdout = os.Stdout
 	sess.Stderr = os.Stderr
@@ -421,13 +622,18 @@ func (c *conn) run(text string) error {
 	// run command specified by text
 	err = sess.Run(text)
 	if err != nil {
-		return err
+		return cancelled(ctx, err)
 	}
 
 	return nil
 }
 
 func (c *conn) output(text string) (string, error) {
+	return c.output_ctx(context.Background(), text)
+}
+
+// output_ctx runs the command like output, stopping it when ctx is done.
+func (c *conn) output_ctx(ctx context.Context, text string) (string, error) {
 
 	var sess *ssh.Session
 	var err error
@@ -439,17 +645,18 @@ func (c *conn) output(text string) (string, error) {
 		}
 	}
 
-	sess, err = c.ssh.NewSession()
+	sess, err = c.new_session()
 	if err != nil {
 		return "", err
 	}
 
 	defer sess.Close()
+	defer cancel_on_done(ctx, sess)()
 
 	// run command specified by text
 	result, err := sess.Output(text)
 	if err != nil {
-		return "", err
+		return "", cancelled(ctx, err)
 	}
 
 	return string(result), nil
@@ -461,14 +668,77 @@ type ssh_key struct {
 	public_key_file  string
 	public_key       string
 	signer           ssh.Signer
+	identities       []ssh.Signer // the other standard identities, see identity_signers
+
+	// certificate for the key and a signer presenting it, see load_cert
+	cert        *ssh.Certificate
+	cert_signer ssh.Signer
+}
+
+// passphrases entered for encrypted private keys, kept for the session
+var passphrases = struct {
+	sync.Mutex
+	m map[string][]byte
+}{m: map[string][]byte{}}
+
+func cache_passphrase(file string, passphrase []byte) {
+	passphrases.Lock()
+	defer passphrases.Unlock()
+	passphrases.m[file] = passphrase
+}
+
+func cached_passphrase(file string) []byte {
+	passphrases.Lock()
+	defer passphrases.Unlock()
+	return passphrases.m[file]
+}
+
+func forget_passphrase(file string) {
+	passphrases.Lock()
+	defer passphrases.Unlock()
+	delete(passphrases.m, file)
+}
+
+// passphraseNeededError is returned by get_keys for an encrypted private key
+// with no cached passphrase, or when the cached one is wrong. The caller
+// should ask for it, cache_passphrase it and try again.
+type passphraseNeededError struct {
+	file      string
+	incorrect bool
+}
+
+func (e *passphraseNeededError) Error() string {
+	if e.incorrect {
+		return "incorrect passphrase for " + e.file
+	}
+	return "passphrase needed for " + e.file
+}
+
+func parse_protected_key(file string, pemBytes []byte) (ssh.Signer, error) {
+
+	passphrase := cached_passphrase(file)
+	if passphrase == nil {
+		return nil, &passphraseNeededError{file: file}
+	}
+
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(pemBytes, passphrase)
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		forget_passphrase(file)
+		return nil, &passphraseNeededError{file: file, incorrect: true}
+	}
+
+	return signer, err
 }
 
 func get_keys(s string) (ssh_key, error) {
 
 	o := ssh_key{}
 
+	if s == "" {
+		s = find_identity()
+	}
 	if s == "" || !path_exists(s) {
-		new_private, err := generate_ssh_keys()
+		new_private, err := generate_ssh_keys(keyED25519, 0, nil)
 		if err != nil {
 			return o, err
 		}
@@ -478,18 +748,36 @@ func get_keys(s string) (ssh_key, error) {
 	}
 	o.public_key_file = o.private_key_file + ".pub"
 
-	if !path_exists(o.public_key_file) {
+	if path_exists(o.private_key_file) {
 
-		ssh_keygen, err := exec.LookPath("ssh-keygen")
+		f, err := os.ReadFile(o.private_key_file)
 		if err != nil {
-			log.Println("Could not find ssh-keygen")
+			log.Println("error reading private key file" + o.private_key_file)
+		} else {
+			// Create the Signer for this private key.
+			signer, err := ssh.ParsePrivateKey(f)
+			var missing *ssh.PassphraseMissingError
+			if errors.As(err, &missing) {
+				signer, err = parse_protected_key(o.private_key_file, f)
+				if err != nil {
+					return o, err
+				}
+			}
+			if err != nil {
+				log.Println("error parsing private key file" + o.private_key_file)
+			} else {
+				o.signer = signer
+				o.cert, o.cert_signer = load_cert(o.private_key_file, signer)
+			}
 		}
+	}
 
-		cmd := exec.Command(
-			ssh_keygen, "-f", o.private_key_file, "-y", ">", o.public_key_file)
-
-		if err := cmd.Run(); err != nil {
-			log.Println("error running ssh-keygen")
+	// derive a missing public key file from the private key
+	if !path_exists(o.public_key_file) && o.signer != nil {
+		err := os.WriteFile(o.public_key_file,
+			[]byte(authorized_key_line(o.signer.PublicKey())+"\n"), 0644)
+		if err != nil {
+			log.Println("error writing public key file" + o.public_key_file)
 		}
 	}
 
@@ -503,21 +791,5 @@ func get_keys(s string) (ssh_key, error) {
 		}
 	}
 
-	if path_exists(o.private_key_file) {
-
-		f, err := os.ReadFile(o.private_key_file)
-		if err != nil {
-			log.Println("error reading private key file" + o.private_key_file)
-		} else {
-			// Create the Signer for this private key.
-			signer, err := ssh.ParsePrivateKey(f)
-			if err != nil {
-				log.Println("error parsing private key file" + o.private_key_file)
-			} else {
-				o.signer = signer
-			}
-		}
-	}
-
 	return o, nil
 }
@@ -0,0 +1,321 @@
+package tools
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Line based diffing for comparing remote file versions, using Myers'
+// O(ND) algorithm.
+
+type diffOp byte
+
+const (
+	diffEqual  diffOp = ' '
+	diffDelete diffOp = '-'
+	diffInsert diffOp = '+'
+)
+
+type diffLine struct {
+	op   diffOp
+	text string
+}
+
+// split_lines splits text into lines keeping their line endings, so that
+// joining them gives back text.
+func split_lines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diff_lines returns the edit script turning a into b, with the lines
+// deleted from each run of changes before those inserted.
+func diff_lines(a, b []string) []diffLine {
+	var d differ
+	d.diff(a, b)
+	return d.edits
+}
+
+// differ uses the linear space variant of the algorithm: the middle snake
+// of a shortest edit script is found from both ends and the texts either
+// side of it are diffed in turn. Memory stays O(N+M) however different
+// the texts are.
+type differ struct {
+	edits []diffLine
+}
+
+func (d *differ) diff(a, b []string) {
+
+	// lines the same at the start and the end are kept as they are
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	d.keep(a[:pre])
+	end := a[len(a)-suf:]
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	x, y, ok := 0, 0, false
+	if len(a) > 0 && len(b) > 0 && share_line(a, b) {
+		x, y, ok = middle_snake(a, b)
+	}
+	if ok {
+		d.diff(a[:x], b[:y])
+		d.diff(a[x:], b[y:])
+	} else {
+		d.change(a, b)
+	}
+
+	d.keep(end)
+}
+
+func (d *differ) keep(lines []string) {
+	for _, l := range lines {
+		d.edits = append(d.edits, diffLine{diffEqual, l})
+	}
+}
+
+// change replaces a with b, the deletions going before any insertions
+// already made next to them.
+func (d *differ) change(a, b []string) {
+	i := len(d.edits)
+	for i > 0 && d.edits[i-1].op == diffInsert {
+		i--
+	}
+	inserted := append([]diffLine(nil), d.edits[i:]...)
+	d.edits = d.edits[:i]
+	for _, l := range a {
+		d.edits = append(d.edits, diffLine{diffDelete, l})
+	}
+	d.edits = append(d.edits, inserted...)
+	for _, l := range b {
+		d.edits = append(d.edits, diffLine{diffInsert, l})
+	}
+}
+
+// share_line reports whether a and b have any line in common, without one
+// there is nothing to look for. Texts rewritten wholesale come this way.
+func share_line(a, b []string) bool {
+	seen := make(map[string]bool, len(a))
+	for _, l := range a {
+		seen[l] = true
+	}
+	for _, l := range b {
+		if seen[l] {
+			return true
+		}
+	}
+	return false
+}
+
+// middle_snake finds where a shortest path from the start of a and b to
+// their ends crosses the middle, searching forward from the start and
+// backward from the end until the searches meet. a and b must differ in
+// their first and last lines. It returns a point on the path with lines
+// of a and b before it, ok being false when the searches never met.
+func middle_snake(a, b []string) (x, y int, ok bool) {
+
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+
+	// vf[k] is the furthest x reached forward on diagonal k, vb[k] the
+	// furthest backward counting from the ends, -1 for not reached
+	vf := make([]int, 2*maxD+2)
+	vb := make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[offset+1], vb[offset+1] = 0, 0
+
+	delta := n - m
+	// with an odd delta the forward search meets the backward one,
+	// otherwise the other way round
+	front := delta%2 != 0
+
+	// diagonals that ran off the edges are not searched again
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+
+	for d := 0; d < maxD; d++ {
+
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			i := offset + k
+			var x1 int
+			if k == -d || (k != d && vf[i-1] < vf[i+1]) {
+				x1 = vf[i+1]
+			} else {
+				x1 = vf[i-1] + 1
+			}
+			y1 := x1 - k
+			for x1 < n && y1 < m && a[x1] == b[y1] {
+				x1++
+				y1++
+			}
+			vf[i] = x1
+			switch {
+			case x1 > n:
+				fEnd += 2
+			case y1 > m:
+				fStart += 2
+			case front:
+				j := offset + delta - k
+				if j >= 0 && j < len(vb) && vb[j] != -1 && x1 >= n-vb[j] {
+					return x1, y1, true
+				}
+			}
+		}
+
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			i := offset + k
+			var x2 int
+			if k == -d || (k != d && vb[i-1] < vb[i+1]) {
+				x2 = vb[i+1]
+			} else {
+				x2 = vb[i-1] + 1
+			}
+			y2 := x2 - k
+			for x2 < n && y2 < m && a[n-x2-1] == b[m-y2-1] {
+				x2++
+				y2++
+			}
+			vb[i] = x2
+			switch {
+			case x2 > n:
+				bEnd += 2
+			case y2 > m:
+				bStart += 2
+			case !front:
+				j := offset + delta - k
+				if j >= 0 && j < len(vf) && vf[j] != -1 {
+					x1 := vf[j]
+					if x1 >= n-x2 {
+						return x1, x1 - (j - offset), true
+					}
+				}
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// match_lines maps each line of a to the line of b it is kept as, or -1
+// for lines that are deleted.
+func match_lines(a, b []string) []int {
+	m := make([]int, len(a))
+	i, j := 0, 0
+	for _, e := range diff_lines(a, b) {
+		switch e.op {
+		case diffEqual:
+			m[i] = j
+			i++
+			j++
+		case diffDelete:
+			m[i] = -1
+			i++
+		case diffInsert:
+			j++
+		}
+	}
+	return m
+}
+
+// unified_diff formats the changes from a to b as a unified diff with the
+// given lines of context, without the file header. No changes give no lines.
+func unified_diff(a, b string, context int) []string {
+
+	edits := diff_lines(split_lines(a), split_lines(b))
+
+	var out []string
+
+	// i walks the edits, ai and bi count lines of a and b
+	i, ai, bi := 0, 0, 0
+	for i < len(edits) {
+
+		// skip to the next change
+		if edits[i].op == diffEqual {
+			i++
+			ai++
+			bi++
+			continue
+		}
+
+		// the hunk starts context lines before the change and runs until
+		// more than twice the context of unchanged lines follow
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(edits) {
+			if edits[end].op != diffEqual {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].op == diffEqual {
+				run++
+			}
+			if run == len(edits) || run-end > 2*context {
+				end += context
+				if end > run {
+					end = run
+				}
+				break
+			}
+			end = run
+		}
+
+		astart, bstart := ai-(i-start), bi-(i-start)
+		var alen, blen int
+		var lines []string
+		for _, e := range edits[start:end] {
+			if e.op != diffInsert {
+				alen++
+			}
+			if e.op != diffDelete {
+				blen++
+			}
+			text := strings.TrimSuffix(e.text, "\n")
+			lines = append(lines, string(e.op)+text)
+			if !strings.HasSuffix(e.text, "\n") {
+				lines = append(lines, "\\ No newline at end of file")
+			}
+		}
+
+		out = append(out, "@@ -"+hunk_range(astart, alen)+" +"+hunk_range(bstart, blen)+" @@")
+		out = append(out, lines...)
+
+		for _, e := range edits[i:end] {
+			if e.op != diffInsert {
+				ai++
+			}
+			if e.op != diffDelete {
+				bi++
+			}
+		}
+		i = end
+	}
+
+	return out
+}
+
+func hunk_range(start, length int) string {
+	if length == 0 {
+		return strconv.Itoa(start) + ",0"
+	}
+	if length == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return strconv.Itoa(start+1) + "," + strconv.Itoa(length)
+}
@@ -0,0 +1,239 @@
+package tools
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// random_lines is a short text drawn from a few lines, so that texts share
+// lines and diffs have something to match.
+func random_lines(r *rand.Rand) string {
+	var sb strings.Builder
+	for i := r.Intn(12); i > 0; i-- {
+		sb.WriteString(string(rune('a'+r.Intn(4))) + "\n")
+	}
+	if r.Intn(4) == 0 {
+		sb.WriteString("end")
+	}
+	return sb.String()
+}
+
+// lcs_length is the length of the longest common subsequence of a and b.
+func lcs_length(a, b []string) int {
+	dp := make([][]int, len(a)+1)
+	for i := range dp {
+		dp[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				dp[i][j] = dp[i+1][j+1] + 1
+			case dp[i+1][j] > dp[i][j+1]:
+				dp[i][j] = dp[i+1][j]
+			default:
+				dp[i][j] = dp[i][j+1]
+			}
+		}
+	}
+	return dp[0][0]
+}
+
+func TestDiffLines(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 500; i++ {
+		a, b := split_lines(random_lines(r)), split_lines(random_lines(r))
+		edits := diff_lines(a, b)
+
+		// the script must give back both sides
+		var gotA, gotB []string
+		equal := 0
+		for _, e := range edits {
+			if e.op != diffInsert {
+				gotA = append(gotA, e.text)
+			}
+			if e.op != diffDelete {
+				gotB = append(gotB, e.text)
+			}
+			if e.op == diffEqual {
+				equal++
+			}
+		}
+		if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+			t.Fatalf("%q -> %q: script %v does not give the texts back", a, b, edits)
+		}
+
+		// and keep as many lines as can be kept
+		if want := lcs_length(a, b); equal != want {
+			t.Fatalf("%q -> %q: %d lines kept, %d could be", a, b, equal, want)
+		}
+	}
+}
+
+// texts rewritten wholesale are diffed in memory linear in their size
+func TestDiffLinesLarge(t *testing.T) {
+
+	tests := []struct {
+		name string
+		a, b func(i int) string
+		n    int
+	}{
+		{"nothing shared", func(i int) string { return fmt.Sprintf("a%d\n", i) }, func(i int) string { return fmt.Sprintf("b%d\n", i) }, 50000},
+		{"only blank lines shared", func(i int) string {
+			if i%10 == 0 {
+				return "\n"
+			}
+			return fmt.Sprintf("a%d\n", i)
+		}, func(i int) string {
+			if i%7 == 0 {
+				return "\n"
+			}
+			return fmt.Sprintf("b%d\n", i)
+		}, 2000},
+	}
+
+	for _, tt := range tests {
+		a, b := make([]string, tt.n), make([]string, tt.n)
+		for i := range a {
+			a[i], b[i] = tt.a(i), tt.b(i)
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		edits := diff_lines(a, b)
+		runtime.ReadMemStats(&after)
+
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+			t.Errorf("%s: %d MB allocated", tt.name, allocated>>20)
+		}
+		kept := 0
+		for _, e := range edits {
+			if e.op == diffEqual {
+				kept++
+			}
+		}
+		// small enough to check the script is still a shortest one
+		if tt.n <= 2000 {
+			if want := lcs_length(a, b); kept != want {
+				t.Errorf("%s: %d lines kept, %d could be", tt.name, kept, want)
+			}
+		}
+		if len(edits) != 2*tt.n-kept {
+			t.Errorf("%s: %d edits", tt.name, len(edits))
+		}
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a\n"}},
+		{"a\r\nb", []string{"a\r\n", "b"}},
+		{"\n\n", []string{"\n", "\n"}},
+	}
+	for _, tt := range tests {
+		got := split_lines(tt.text)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%q: got %q", tt.text, got)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    []string
+	}{
+		{"same", "a\nb\n", "a\nb\n", 3, nil},
+		{"one line", "a\nb\nc\n", "a\nB\nc\n", 1, []string{"@@ -1,3 +1,3 @@", " a", "-b", "+B", " c"}},
+		{"no context", "a\nb\nc\n", "a\nB\nc\n", 0, []string{"@@ -2 +2 @@", "-b", "+B"}},
+		{"to empty", "a\n", "", 3, []string{"@@ -1 +0,0 @@", "-a"}},
+		{"from empty", "", "a\n", 3, []string{"@@ -0,0 +1 @@", "+a"}},
+		{"newline added", "a", "a\n", 3, []string{"@@ -1 +1 @@", "-a", "\\ No newline at end of file", "+a"}},
+		{"two hunks", "1\n2\n3\n4\n5\n6\n7\n8\n", "0\n2\n3\n4\n5\n6\n7\n9\n", 1,
+			[]string{"@@ -1,2 +1,2 @@", "-1", "+0", " 2", "@@ -7,2 +7,2 @@", " 7", "-8", "+9"}},
+		{"hunks joined", "1\n2\n3\n4\n", "0\n2\n3\n5\n", 1,
+			[]string{"@@ -1,4 +1,4 @@", "-1", "+0", " 2", " 3", "-4", "+5"}},
+	}
+
+	for _, tt := range tests {
+		got := unified_diff(tt.a, tt.b, tt.context)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// apply_unified applies a diff made by unified_diff to a.
+func apply_unified(t *testing.T, a string, diff []string) string {
+	t.Helper()
+
+	old := split_lines(a)
+	var out []string
+	at := 0 // next line of a not yet copied
+
+	for i := 0; i < len(diff); i++ {
+		l := diff[i]
+		switch {
+		case strings.HasPrefix(l, "@@ "):
+			spec := strings.Fields(l)[1][1:]
+			start, err := strconv.Atoi(strings.Split(spec, ",")[0])
+			if err != nil {
+				t.Fatalf("bad hunk %q", l)
+			}
+			if strings.HasSuffix(spec, ",0") {
+				start++ // an empty range names the line before it
+			}
+			for at < start-1 {
+				out = append(out, old[at])
+				at++
+			}
+		case strings.HasPrefix(l, "\\"):
+			// the line before had no newline
+			if len(out) > 0 && diff[i-1][0] != '-' {
+				out[len(out)-1] = strings.TrimSuffix(out[len(out)-1], "\n")
+			}
+		case l[0] == ' ':
+			out = append(out, old[at])
+			at++
+		case l[0] == '-':
+			at++
+		case l[0] == '+':
+			out = append(out, l[1:]+"\n")
+		default:
+			t.Fatalf("bad diff line %q", l)
+		}
+	}
+
+	return strings.Join(append(out, old[at:]...), "")
+}
+
+func TestUnifiedDiffApplies(t *testing.T) {
+
+	r := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 500; i++ {
+		a, b := random_lines(r), random_lines(r)
+		context := r.Intn(4)
+		diff := unified_diff(a, b, context)
+		if (len(diff) == 0) != (a == b) {
+			t.Fatalf("%q -> %q: diff %q", a, b, diff)
+		}
+		if got := apply_unified(t, a, diff); got != b {
+			t.Fatalf("%q -> %q with %d context:\n%s\ngives %q", a, b, context, strings.Join(diff, "\n"), got)
+		}
+	}
+}
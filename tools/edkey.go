@@ -1,12 +1,27 @@
 package tools
 
 import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"math/big"
 	"math/rand"
 
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 )
 
+// kdf parameters ssh-keygen uses by default for new keys
+const (
+	bcryptSaltLen = 16
+	bcryptRounds  = 16
+)
+
 /*
 	Writes ed25519 private keys into the new OpenSSH private key format.
 
@@ -14,6 +29,21 @@ I have no idea why this isn't implemented anywhere yet, you can do seemingly
 everything except write it to disk in the OpenSSH private key format.
 */
 func MarshalED25519PrivateKey(key ed25519.PrivateKey) []byte {
+	b, _ := MarshalED25519PrivateKeyWithPassphrase(key, nil)
+	return b
+}
+
+// MarshalED25519PrivateKeyWithPassphrase is MarshalED25519PrivateKey with the
+// private block encrypted as ssh-keygen does it: aes256-ctr under a key derived
+// from passphrase by bcrypt_pbkdf. An empty passphrase writes an unencrypted key.
+func MarshalED25519PrivateKeyWithPassphrase(key ed25519.PrivateKey, passphrase []byte) ([]byte, error) {
+	return MarshalPrivateKeyWithPassphrase(key, passphrase)
+}
+
+// MarshalPrivateKeyWithPassphrase writes an ed25519, rsa or ecdsa private key
+// in the OpenSSH private key format, encrypted as in
+// MarshalED25519PrivateKeyWithPassphrase.
+func MarshalPrivateKeyWithPassphrase(key crypto.PrivateKey, passphrase []byte) ([]byte, error) {
 	// Add our key header (followed by a null byte)
 	magic := append([]byte("openssh-key-v1"), 0)
 
@@ -26,66 +56,137 @@ func MarshalED25519PrivateKey(key ed25519.PrivateKey) []byte {
 		PrivKeyBlock []byte
 	}
 
-	// Fill out the private key fields
-	pk1 := struct {
-		Check1  uint32
-		Check2  uint32
-		Keytype string
-		Pub     []byte
-		Priv    []byte
-		Comment string
-		Pad     []byte `ssh:"rest"`
-	}{}
+	// The private key fields differ by key type, they go between the key
+	// type and the comment, see PROTOCOL.key in openssh
+	var pub ssh.PublicKey
+	var fields []byte
+	var err error
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		pub, err = ssh.NewPublicKey(k.Public())
+		fields = ssh.Marshal(struct {
+			Pub  []byte
+			Priv []byte
+		}{[]byte(k.Public().(ed25519.PublicKey)), []byte(k)})
+	case *rsa.PrivateKey:
+		pub, err = ssh.NewPublicKey(&k.PublicKey)
+		k.Precompute()
+		fields = ssh.Marshal(struct {
+			N    *big.Int
+			E    *big.Int
+			D    *big.Int
+			Iqmp *big.Int
+			P    *big.Int
+			Q    *big.Int
+		}{k.N, big.NewInt(int64(k.E)), k.D, k.Precomputed.Qinv, k.Primes[0], k.Primes[1]})
+	case *ecdsa.PrivateKey:
+		var curve string
+		curve, err = ecdsa_curve_name(k.Curve)
+		if err == nil {
+			pub, err = ssh.NewPublicKey(&k.PublicKey)
+		}
+		fields = ssh.Marshal(struct {
+			Curve string
+			Q     []byte
+			D     *big.Int
+		}{curve, elliptic.Marshal(k.Curve, k.X, k.Y), k.D})
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	// Set our check ints
 	ci := rand.Uint32()
-	pk1.Check1 = ci
-	pk1.Check2 = ci
-
-	// Set our key type
-	pk1.Keytype = ssh.KeyAlgoED25519
-
-	// Add the pubkey to the optionally-encrypted block
-	pk, ok := key.Public().(ed25519.PublicKey)
-	if !ok {
-		//fmt.Fprintln(os.Stderr, "ed25519.PublicKey type assertion failed on an ed25519 public key. This should never ever happen.")
-		return nil
-	}
-	pubKey := []byte(pk)
-	pk1.Pub = pubKey
-
-	// Add our private key
-	pk1.Priv = []byte(key)
+	head := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+	}{ci, ci, pub.Type()})
 
 	// Might be useful to put something in here at some point
-	pk1.Comment = ""
+	tail := ssh.Marshal(struct{ Comment string }{""})
+
+	block := append(append(head, fields...), tail...)
 
 	// Add some padding to match the encryption block size within PrivKeyBlock (without Pad field)
 	// 8 doesn't match the documentation, but that's what ssh-keygen uses for unencrypted keys. *shrug*
 	bs := 8
-	blockLen := len(ssh.Marshal(pk1))
-	padLen := (bs - (blockLen % bs)) % bs
-	pk1.Pad = make([]byte, padLen)
+	if len(passphrase) > 0 {
+		bs = aes.BlockSize
+	}
+	padLen := (bs - (len(block) % bs)) % bs
 
 	// Padding is a sequence of bytes like: 1, 2, 3...
 	for i := 0; i < padLen; i++ {
-		pk1.Pad[i] = byte(i + 1)
+		block = append(block, byte(i+1))
 	}
 
-	// Generate the pubkey prefix "\0\0\0\nssh-ed25519\0\0\0 "
-	prefix := []byte{0x0, 0x0, 0x0, 0x0b}
-	prefix = append(prefix, []byte(ssh.KeyAlgoED25519)...)
-	prefix = append(prefix, []byte{0x0, 0x0, 0x0, 0x20}...)
-
-	// Only going to support unencrypted keys for now
 	w.CipherName = "none"
 	w.KdfName = "none"
 	w.KdfOpts = ""
 	w.NumKeys = 1
-	w.PubKey = append(prefix, pubKey...)
-	w.PrivKeyBlock = ssh.Marshal(pk1)
+	w.PubKey = pub.Marshal()
+	w.PrivKeyBlock = block
+
+	if len(passphrase) > 0 {
+		w.CipherName = "aes256-ctr"
+		w.KdfName = "bcrypt"
+		w.KdfOpts, w.PrivKeyBlock, err = encryptPrivKeyBlock(w.PrivKeyBlock, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	magic = append(magic, ssh.Marshal(w)...)
 
-	return magic
+	return magic, nil
+}
+
+// ecdsa_curve_name is the openssh name of the curves it supports.
+func ecdsa_curve_name(curve elliptic.Curve) (string, error) {
+	switch curve {
+	case elliptic.P256():
+		return "nistp256", nil
+	case elliptic.P384():
+		return "nistp384", nil
+	case elliptic.P521():
+		return "nistp521", nil
+	}
+	return "", fmt.Errorf("unsupported ecdsa curve %s", curve.Params().Name)
+}
+
+// encryptPrivKeyBlock encrypts block in place with aes256-ctr, returning the
+// kdf options needed to derive the key again along with the block.
+func encryptPrivKeyBlock(block, passphrase []byte) (string, []byte, error) {
+
+	kdf := struct {
+		Salt   []byte
+		Rounds uint32
+	}{
+		Salt:   make([]byte, bcryptSaltLen),
+		Rounds: bcryptRounds,
+	}
+
+	_, err := crand.Read(kdf.Salt)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 32 bytes of aes256 key followed by the 16 byte iv
+	k, err := bcrypt_pbkdf(passphrase, kdf.Salt, int(kdf.Rounds), 32+aes.BlockSize)
+	if err != nil {
+		return "", nil, err
+	}
+
+	c, err := aes.NewCipher(k[:32])
+	if err != nil {
+		return "", nil, err
+	}
+
+	cipher.NewCTR(c, k[32:]).XORKeyStream(block, block)
+
+	return string(ssh.Marshal(kdf)), block, nil
 }
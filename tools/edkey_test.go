@@ -0,0 +1,141 @@
+package tools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// the keys written are read back by x/crypto's parser, which has its own
+// bcrypt_pbkdf, so this checks ours as well
+func TestMarshalPrivateKeyRoundTrip(t *testing.T) {
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{"ed25519", edKey},
+		{"rsa", rsaKey},
+	}
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		k, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, struct {
+			name string
+			key  crypto.Signer
+		}{"ecdsa " + curve.Params().Name, k})
+	}
+
+	for _, k := range keys {
+		for _, passphrase := range []string{"", "correct horse"} {
+
+			raw, err := MarshalPrivateKeyWithPassphrase(k.key, []byte(passphrase))
+			if err != nil {
+				t.Fatalf("%s %q: %v", k.name, passphrase, err)
+			}
+			b := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: raw})
+
+			var signer ssh.Signer
+			if passphrase == "" {
+				signer, err = ssh.ParsePrivateKey(b)
+			} else {
+				_, err = ssh.ParsePrivateKey(b)
+				var missing *ssh.PassphraseMissingError
+				if !errors.As(err, &missing) {
+					t.Fatalf("%s: encrypted key parsed without a passphrase: %v", k.name, err)
+				}
+				_, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte("wrong"))
+				if !errors.Is(err, x509.IncorrectPasswordError) {
+					t.Fatalf("%s: wrong passphrase: %v", k.name, err)
+				}
+				signer, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte(passphrase))
+			}
+			if err != nil {
+				t.Fatalf("%s %q: parsing: %v", k.name, passphrase, err)
+			}
+
+			want, err := ssh.NewPublicKey(k.key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), want.Marshal()) {
+				t.Fatalf("%s %q: public key changed", k.name, passphrase)
+			}
+
+			// the private half must have survived too
+			data := []byte("sign me")
+			sig, err := signer.Sign(rand.Reader, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := want.Verify(data, sig); err != nil {
+				t.Fatalf("%s %q: %v", k.name, passphrase, err)
+			}
+		}
+	}
+}
+
+func TestBcryptPbkdf(t *testing.T) {
+
+	a, err := bcrypt_pbkdf([]byte("password"), []byte("salt"), 4, 48)
+	if err != nil || len(a) != 48 {
+		t.Fatal(len(a), err)
+	}
+	b, _ := bcrypt_pbkdf([]byte("password"), []byte("salt"), 4, 48)
+	if !bytes.Equal(a, b) {
+		t.Fatal("not deterministic")
+	}
+	for _, other := range [][]byte{
+		must_pbkdf(t, "Password", "salt", 4),
+		must_pbkdf(t, "password", "Salt", 4),
+		must_pbkdf(t, "password", "salt", 5),
+	} {
+		if bytes.Equal(a, other) {
+			t.Fatal("input ignored")
+		}
+	}
+
+	bad := []struct {
+		password, salt string
+		rounds, keyLen int
+	}{
+		{"password", "salt", 0, 32},
+		{"", "salt", 4, 32},
+		{"password", "", 4, 32},
+		{"password", "salt", 4, 2048},
+	}
+	for _, tt := range bad {
+		if _, err := bcrypt_pbkdf([]byte(tt.password), []byte(tt.salt), tt.rounds, tt.keyLen); err == nil {
+			t.Errorf("%+v: no error", tt)
+		}
+	}
+}
+
+func must_pbkdf(t *testing.T, password, salt string, rounds int) []byte {
+	t.Helper()
+	k, err := bcrypt_pbkdf([]byte(password), []byte(salt), rounds, 48)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
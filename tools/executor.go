@@ -0,0 +1,77 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Remote operations started from the window run on an executor, away from
+// the ui goroutine so the window keeps drawing while they wait on the
+// network. An executor belongs to a connection and runs one operation at a
+// time, starting another while one is in flight is refused.
+
+type executor struct {
+	mu      sync.Mutex
+	running string // what the job in flight is doing, "" when idle
+	cancel  context.CancelFunc
+
+	// on_busy is called with the job starting and with "" once it is over,
+	// the ui disables what starts jobs in between
+	on_busy func(job string)
+}
+
+// busyError is returned when a job is started while another is running.
+type busyError struct {
+	running string
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("%s is still running", e.running)
+}
+
+// start runs job in its own goroutine unless another job is running. The
+// job's context is cancelled by cancel_job.
+func (x *executor) start(name string, job func(ctx context.Context)) error {
+
+	x.mu.Lock()
+	if x.running != "" {
+		defer x.mu.Unlock()
+		return &busyError{x.running}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	x.running, x.cancel = name, cancel
+	x.mu.Unlock()
+
+	x.busy(name)
+
+	go func() {
+		defer func() {
+			cancel()
+			// the ui hears first so it never shows idle while the next
+			// job is running
+			x.busy("")
+			x.mu.Lock()
+			x.running, x.cancel = "", nil
+			x.mu.Unlock()
+		}()
+		job(ctx)
+	}()
+
+	return nil
+}
+
+func (x *executor) busy(job string) {
+	if x.on_busy != nil {
+		x.on_busy(job)
+	}
+}
+
+// cancel_job cancels the job in flight, if any.
+func (x *executor) cancel_job() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.cancel != nil {
+		x.cancel()
+	}
+}
@@ -0,0 +1,289 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Fanout is the Fan-out tab, a viewer run on several hosts at once with a
+// row per host in Grid. Picking a row shows that host's output.
+type Fanout struct {
+	Hosts    *widget.SelectEntry
+	Viewer   *widget.Select
+	Parallel *widget.Entry
+	Run      *widget.Button
+	Cancel   *widget.Button
+	Export   *widget.Button
+	Grid     *widget.Table
+	Output   *widget.Entry
+	Status   *widget.Label
+
+	// fan-outs have connections of their own, so they run apart from the
+	// jobs of the connected host
+	jobs *executor
+
+	mu       sync.Mutex
+	viewer   string
+	results  []fanResult
+	selected int // row of the host whose output is shown, -1 for none
+}
+
+var fanColumns = []struct {
+	title string
+	width float32
+}{
+	{"host", 200}, {"status", 90}, {"exit", 45}, {"how it went", 300}, {"output", 300},
+}
+
+func NewFanout() *Fanout {
+
+	f := &Fanout{
+		Hosts:    widget.NewSelectEntry([]string{}),
+		Viewer:   widget.NewSelect([]string{}, func(string) {}),
+		Parallel: widget.NewEntry(),
+		Run:      widget.NewButtonWithIcon("Run", theme.MediaPlayIcon(), func() {}),
+		Cancel:   widget.NewButtonWithIcon("Cancel", theme.CancelIcon(), func() {}),
+		Export:   widget.NewButtonWithIcon("Export", theme.DocumentSaveIcon(), func() {}),
+		Output:   widget.NewMultiLineEntry(),
+		Status:   widget.NewLabel("pick hosts or tags and a viewer to run on them"),
+		selected: -1,
+	}
+
+	f.Hosts.SetPlaceHolder("hosts or tags, eg openwrt")
+	f.Viewer.PlaceHolder = "(viewer)"
+	f.Parallel.SetPlaceHolder(strconv.Itoa(defaultParallel))
+	f.Cancel.Hide()
+	f.Export.Disable()
+	f.Output.TextStyle = fyne.TextStyle{Monospace: true}
+	f.Output.Disable()
+
+	f.Grid = widget.NewTable(f.size, func() fyne.CanvasObject {
+		return widget.NewLabel("")
+	}, f.cell)
+	for i, c := range fanColumns {
+		f.Grid.SetColumnWidth(i, c.width)
+	}
+	f.Grid.OnSelected = func(id widget.TableCellID) {
+		f.mu.Lock()
+		f.selected = id.Row - 1
+		f.mu.Unlock()
+		f.showOutput()
+	}
+
+	f.jobs = &executor{on_busy: f.setBusy}
+	f.Cancel.OnTapped = f.jobs.cancel_job
+
+	return f
+}
+
+// size is the grid's size, a header row and a row per host.
+func (f *Fanout) size() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.results) + 1, len(fanColumns)
+}
+
+func (f *Fanout) cell(id widget.TableCellID, o fyne.CanvasObject) {
+
+	l := o.(*widget.Label)
+	if id.Row == 0 {
+		l.TextStyle = fyne.TextStyle{Bold: true}
+		l.SetText(fanColumns[id.Col].title)
+		return
+	}
+
+	f.mu.Lock()
+	if id.Row > len(f.results) {
+		f.mu.Unlock()
+		return
+	}
+	r := f.results[id.Row-1]
+	f.mu.Unlock()
+
+	text := ""
+	switch id.Col {
+	case 0:
+		text = r.host
+	case 1:
+		text = r.state
+	case 2:
+		text = r.exit_code()
+	case 3:
+		if r.res != nil || r.err != nil {
+			text = r.summary()
+		}
+	case 4:
+		text, _, _ = strings.Cut(strings.TrimSpace(r.output), "\n")
+	}
+	l.TextStyle = fyne.TextStyle{Monospace: id.Col == 4}
+	l.SetText(text)
+}
+
+// showOutput shows the output of the host picked in the grid.
+func (f *Fanout) showOutput() {
+	f.mu.Lock()
+	text := ""
+	if f.selected >= 0 && f.selected < len(f.results) {
+		text = fan_report(f.viewer, f.results[f.selected:f.selected+1])
+	}
+	f.mu.Unlock()
+	f.Output.SetText(text)
+}
+
+// setBusy swaps Run for Cancel while a fan-out runs.
+func (f *Fanout) setBusy(job string) {
+	if job != "" {
+		f.Run.Disable()
+		f.Export.Disable()
+		f.Cancel.Show()
+		return
+	}
+	f.Cancel.Hide()
+	f.Run.Enable()
+	f.Export.Enable()
+}
+
+// setConfig offers the hosts and tags of config to pick from, and the
+// viewers of the hosts picked.
+func (f *Fanout) setConfig(config *Config) {
+
+	var picks []string
+	for _, name := range config.HostNames() {
+		if name != "" {
+			picks = append(picks, name)
+		}
+	}
+	f.Hosts.SetOptions(append(config.TagNames(), picks...))
+
+	f.Parallel.SetText("")
+	if config.Parallel > 0 {
+		f.Parallel.SetText(strconv.Itoa(config.Parallel))
+	}
+
+	f.Hosts.OnChanged = func(s string) {
+		hosts, err := select_hosts(config, s)
+		if err != nil {
+			hosts = config.HostNames()
+		}
+		f.Viewer.Options = config.ViewerNames(hosts)
+		f.Viewer.Refresh()
+	}
+	f.Hosts.OnChanged(f.Hosts.Text)
+}
+
+// runFanout runs the viewer picked on the hosts picked, filling in the
+// grid as each host goes along.
+func (ui *Tools) runFanout() {
+
+	f := ui.Fanout
+	config := ui.config
+
+	hosts, err := select_hosts(config, f.Hosts.Text)
+	if err != nil {
+		f.Status.SetText("fail: " + err.Error())
+		return
+	}
+	viewer := f.Viewer.Selected
+	if viewer == "" {
+		f.Status.SetText("fail: pick a viewer to run")
+		return
+	}
+	parallel := config.Parallel
+	if f.Parallel.Text != "" {
+		parallel, err = strconv.Atoi(f.Parallel.Text)
+		if err != nil || parallel <= 0 {
+			f.Status.SetText(fmt.Sprintf("fail: %q is not a number of hosts to run at once", f.Parallel.Text))
+			return
+		}
+	}
+
+	// hosts are not asked about, they all use the key typed for the
+	// connected host and fall back on its password
+	password, key := ui.Password.Text, ui.PrivateKey.Text
+	setup := func(c *conn) {
+		c.password = password
+		c.key = key
+	}
+
+	f.mu.Lock()
+	f.viewer = viewer
+	f.results = make([]fanResult, len(hosts))
+	for i, host := range hosts {
+		f.results[i] = fanResult{host: host, state: fanWaiting}
+	}
+	f.selected = -1
+	f.mu.Unlock()
+	f.Grid.UnselectAll()
+	f.Grid.Refresh()
+	f.Output.SetText("")
+
+	name := fmt.Sprintf("%s on %d hosts", viewer, len(hosts))
+	err = f.jobs.start(name, func(ctx context.Context) {
+
+		err := unlock_key(key, ui.askUnlock)
+		if err != nil {
+			f.Status.SetText("fail: " + err.Error())
+			return
+		}
+		f.Status.SetText("running " + name + "...")
+
+		update := func(i int, r fanResult) {
+			f.mu.Lock()
+			f.results[i] = r
+			shown := i == f.selected
+			f.mu.Unlock()
+			f.Grid.Refresh()
+			if shown {
+				f.showOutput()
+			}
+		}
+		results := fan_out(ctx, config, hosts, viewer, parallel, setup, update)
+
+		done, failed, stopped := fan_counts(results)
+		f.Status.SetText(fmt.Sprintf("%s: %d done, %d failed, %d cancelled",
+			name, done, failed, stopped))
+	})
+	if err != nil {
+		f.Status.SetText("busy: " + err.Error())
+	}
+}
+
+// exportFanout saves the combined output of the last fan-out to a file.
+func (ui *Tools) exportFanout() {
+
+	f := ui.Fanout
+	f.mu.Lock()
+	report := fan_report(f.viewer, f.results)
+	viewer := f.viewer
+	f.mu.Unlock()
+
+	d := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+		if err != nil {
+			f.Status.SetText("fail: " + err.Error())
+			return
+		}
+		if w == nil {
+			return
+		}
+		_, err = w.Write([]byte(report))
+		cerr := w.Close()
+		if err == nil {
+			err = cerr
+		}
+		if err != nil {
+			f.Status.SetText("fail: exporting: " + err.Error())
+			return
+		}
+		f.Status.SetText("exported the output of " + viewer + " to " + w.URI().Path())
+	}, ui.Window)
+	d.SetFileName(viewer + ".txt")
+	d.Show()
+}
@@ -0,0 +1,285 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A viewer can be fanned out, run on several hosts at once, each over a
+// connection of its own. Hosts are picked by name or by tag, at most
+// Config.Parallel of them run at a time and each host's output is kept
+// apart, for the grid and for the combined report.
+
+// hosts run at once when the config does not set Parallel
+const defaultParallel = 4
+
+// states of a host in a fan-out
+const (
+	fanWaiting    = "waiting"
+	fanConnecting = "connecting"
+	fanRunning    = "running"
+	fanDone       = "done"
+	fanFailed     = "failed"
+	fanCancelled  = "cancelled"
+)
+
+// fanResult is how the viewer went on one host.
+type fanResult struct {
+	host   string
+	state  string
+	output string
+	res    *JobResult // nil when the viewer reads a file or never ran
+	err    error
+}
+
+// summary describes how the viewer ended on the host, or where it is.
+func (r *fanResult) summary() string {
+	switch {
+	case r.res != nil:
+		return r.res.summary()
+	case r.err != nil:
+		return r.err.Error()
+	}
+	return r.state
+}
+
+// exit_code is the command's exit status for the grid, "" when it has none.
+func (r *fanResult) exit_code() string {
+	if r.res == nil || r.res.ExitCode < 0 {
+		return ""
+	}
+	return fmt.Sprint(r.res.ExitCode)
+}
+
+// select_hosts resolves picks, host names and tags separated by commas or
+// spaces, to the hosts they stand for in config order. A name is taken as
+// a host before a tag.
+func select_hosts(config *Config, picks string) ([]string, error) {
+
+	chosen := map[string]bool{}
+	fields := strings.FieldsFunc(picks, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+
+	for _, pick := range fields {
+		if _, ok := config.Hosts[pick]; ok {
+			chosen[pick] = true
+			continue
+		}
+		found := false
+		for name, h := range config.Hosts {
+			// the empty host is the template for new hosts
+			if name != "" && has_tag(h, pick) {
+				chosen[name] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no host or tag %q in the config", pick)
+		}
+	}
+
+	if len(chosen) == 0 {
+		return nil, errors.New("no hosts picked")
+	}
+
+	var hosts []string
+	for _, name := range config.HostNames() {
+		if chosen[name] {
+			hosts = append(hosts, name)
+		}
+	}
+	return hosts, nil
+}
+
+func has_tag(h Host, tag string) bool {
+	for _, t := range h.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// fan_out runs viewer on hosts, parallel at a time, until all are done or
+// ctx is. setup is given each host's connection once configured, to set
+// the password and key, and update is told every change of a host's state.
+// It returns the result of each host in the order of hosts.
+func fan_out(ctx context.Context, config *Config, hosts []string, viewer string, parallel int,
+	setup func(c *conn), update func(i int, r fanResult)) []fanResult {
+
+	if parallel <= 0 {
+		parallel = defaultParallel
+	}
+
+	var mu sync.Mutex
+	results := make([]fanResult, len(hosts))
+	for i, host := range hosts {
+		results[i] = fanResult{host: host, state: fanWaiting}
+	}
+
+	// update hears of a copy, the host's goroutine goes on changing it
+	set := func(i int, change func(r *fanResult)) {
+		mu.Lock()
+		change(&results[i])
+		r := results[i]
+		mu.Unlock()
+		if update != nil {
+			update(i, r)
+		}
+	}
+
+	// hosts start in order as slots come free
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	for i, host := range hosts {
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		// hosts not started yet are not started at all once cancelled
+		if ctx.Err() != nil {
+			for j := i; j < len(hosts); j++ {
+				set(j, func(r *fanResult) { r.state, r.err = fanCancelled, ctx.Err() })
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			output, res, err := fan_host(ctx, config, host, viewer, setup, func(state string) {
+				set(i, func(r *fanResult) { r.state = state })
+			})
+
+			set(i, func(r *fanResult) {
+				r.output, r.res, r.err = output, res, err
+				switch {
+				case err == nil:
+					r.state = fanDone
+				case is_cancelled(err):
+					r.state = fanCancelled
+				default:
+					r.state = fanFailed
+				}
+			})
+		}(i, host)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// fan_host runs viewer on host over a connection of its own, keeping the
+// last lines of the output as the viewer tab does.
+func fan_host(ctx context.Context, config *Config, host, viewer string,
+	setup func(c *conn), state func(string)) (string, *JobResult, error) {
+
+	job, ok := config.Hosts[host].Viewers[viewer]
+	if !ok {
+		return "", nil, fmt.Errorf("host has no viewer %q", viewer)
+	}
+
+	c := conn{}
+	c.configure(config, host)
+	if setup != nil {
+		setup(&c)
+	}
+
+	state(fanConnecting)
+	err := connect_ctx(ctx, &c)
+	if err != nil {
+		return "", nil, cancelled(ctx, err)
+	}
+	defer c.close()
+
+	state(fanRunning)
+	if job["file"] != "" {
+		text, err := c.get_content_ctx(ctx, job["file"])
+		if err != nil && !is_cancelled(err) {
+			err = fmt.Errorf("%s %s: %w", c.transport_name(), job["file"], err)
+		}
+		return text, nil, err
+	}
+
+	lines := new_line_buffer(job_lines(job))
+	res := c.run_job(ctx, job["cmd"], lines.add)
+	text, dropped, _ := lines.take()
+	if dropped > 0 {
+		text = fmt.Sprintf("[%d earlier lines not kept]\n", dropped) + text
+	}
+
+	return text, res, res.Err
+}
+
+// unlock_key asks for the passphrase of key, or of the identity used
+// without one, before the hosts are fanned out to, so it is asked once
+// rather than failing every host. ask returning no passphrase leaves the
+// key locked.
+func unlock_key(key string, ask func(need *passphraseNeededError) ([]byte, error)) error {
+
+	if key == "" {
+		key = find_identity()
+	}
+	if key == "" || !path_exists(key) {
+		return nil
+	}
+
+	for {
+		_, err := get_keys(key)
+		var need *passphraseNeededError
+		if !errors.As(err, &need) {
+			// other trouble with the key is up to each host to report
+			return nil
+		}
+		passphrase, err := ask(need)
+		if err != nil || passphrase == nil {
+			return err
+		}
+		cache_passphrase(need.file, passphrase)
+	}
+}
+
+// fan_report is the combined output of a fan-out, each host's output and
+// stderr under a line saying how it went there.
+func fan_report(viewer string, results []fanResult) string {
+
+	var sb strings.Builder
+	for _, r := range results {
+		fmt.Fprintf(&sb, "==> %s: %s, %s <==\n", r.host, viewer, r.summary())
+		if r.output != "" {
+			sb.WriteString(strings.TrimRight(r.output, "\n"))
+			sb.WriteString("\n")
+		}
+		if r.res != nil && r.res.Stderr != "" {
+			sb.WriteString("--- stderr ---\n")
+			sb.WriteString(r.res.Stderr)
+			sb.WriteString("\n")
+		}
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// fan_counts is how many hosts are done, failed and cancelled.
+func fan_counts(results []fanResult) (done, failed, stopped int) {
+	for _, r := range results {
+		switch r.state {
+		case fanDone:
+			done++
+		case fanFailed:
+			failed++
+		case fanCancelled:
+			stopped++
+		}
+	}
+	return
+}
@@ -0,0 +1,258 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelectHosts(t *testing.T) {
+
+	config := &Config{Hosts: Hosts{
+		// the template is never picked by tag
+		"":        {Tags: []string{"core", "openwrt"}},
+		"gw":      {Tags: []string{"core", "openwrt"}},
+		"ap1":     {Tags: []string{"openwrt"}},
+		"ap2":     {Tags: []string{"openwrt", "wifi"}},
+		"nas":     {},
+		"openwrt": {}, // a name is taken before a tag
+	}}
+
+	tests := []struct {
+		picks string
+		want  string // hosts joined by commas, or the error
+	}{
+		{"nas", "nas"},
+		{"core", "gw"},
+		{"wifi,nas", "ap2,nas"},
+		{"nas gw, ap1", "ap1,gw,nas"},
+		{"core, gw,,core", "gw"},
+		{"openwrt", "openwrt"},
+		{"wifi openwrt", "ap2,openwrt"},
+		{"nas,nope", `no host or tag "nope" in the config`},
+		{"", "no hosts picked"},
+		{" , ", "no hosts picked"},
+	}
+
+	for _, tt := range tests {
+		hosts, err := select_hosts(config, tt.picks)
+		got := strings.Join(hosts, ",")
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.picks, got, tt.want)
+		}
+	}
+}
+
+// fan_test_config has n hosts served here, their viewers made by viewers
+// from the host's index, and the password for them set by setup.
+func fan_test_config(t *testing.T, n int, viewers func(i int) Jobs) (config *Config, hosts []string, setup func(c *conn)) {
+	t.Helper()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	config = &Config{File: filepath.Join(home, "config.json"), Hosts: Hosts{"": {}}}
+	for i := 0; i < n; i++ {
+		c := exec_host(t, config.KnownHostsFile(), nil)
+		config.Hosts[c.host] = Host{Viewers: viewers(i)}
+		hosts = append(hosts, c.host)
+	}
+
+	return config, hosts, func(c *conn) { c.password = "pw" }
+}
+
+// fanWatch follows the updates of a fan-out, counting the most hosts
+// under way at once.
+type fanWatch struct {
+	mu      sync.Mutex
+	hosts   []string
+	states  map[string][]string
+	active  map[string]bool
+	most    int
+	running func(n int) // told how many hosts are running on each change
+}
+
+func (w *fanWatch) update(t *testing.T) func(i int, r fanResult) {
+	w.states = map[string][]string{}
+	w.active = map[string]bool{}
+	return func(i int, r fanResult) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.hosts[i] != r.host {
+			t.Errorf("update %d is for %s", i, r.host)
+		}
+		w.states[r.host] = append(w.states[r.host], r.state)
+		w.active[r.host] = r.state == fanConnecting || r.state == fanRunning
+		n, running := 0, 0
+		for h, a := range w.active {
+			if a {
+				n++
+			}
+			if a && w.states[h][len(w.states[h])-1] == fanRunning {
+				running++
+			}
+		}
+		if n > w.most {
+			w.most = n
+		}
+		if w.running != nil {
+			w.running(running)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+
+	config, hosts, setup := fan_test_config(t, 5, func(i int) Jobs {
+		if i == 4 {
+			return Jobs{"other": {"cmd": "true"}}
+		}
+		return Jobs{"v": {
+			"cmd":   fmt.Sprintf("sleep 0.2; seq %d; echo oops%d >&2; exit %d", i+1, i, i%2*3),
+			"lines": "2",
+		}}
+	})
+
+	for _, parallel := range []int{1, 2, 5} {
+
+		w := &fanWatch{hosts: hosts}
+		start := time.Now()
+		results := fan_out(context.Background(), config, hosts, "v", parallel, setup, w.update(t))
+		took := time.Since(start)
+
+		// the host without the viewer is never under way
+		if w.most != min_int(parallel, 4) {
+			t.Errorf("parallel %d: %d hosts at once", parallel, w.most)
+		}
+		if parallel == 1 && took < 800*time.Millisecond {
+			t.Errorf("four hosts sleeping in turn took %v", took)
+		}
+
+		outputs := []string{"1", "1\n2", "[1 earlier lines not kept]\n2\n3", "[2 earlier lines not kept]\n3\n4"}
+		for i, r := range results[:4] {
+			wantState, wantCode := fanDone, "0"
+			if i%2 == 1 {
+				wantState, wantCode = fanFailed, "3"
+			}
+			if r.host != hosts[i] || r.state != wantState || r.output != outputs[i] || r.exit_code() != wantCode ||
+				r.res == nil || r.res.Stderr != fmt.Sprintf("oops%d", i) {
+				t.Errorf("parallel %d, host %d: %+v %+v", parallel, i, r, r.res)
+			}
+			want := "connecting,running," + wantState
+			if got := strings.Join(w.states[r.host], ","); got != want {
+				t.Errorf("parallel %d, host %d: updates %s", parallel, i, got)
+			}
+		}
+
+		// a host lacking the viewer fails without connecting
+		r := results[4]
+		if r.state != fanFailed || r.summary() != `host has no viewer "v"` || r.res != nil {
+			t.Errorf("parallel %d: %+v", parallel, r)
+		}
+		if got := strings.Join(w.states[r.host], ","); got != fanFailed {
+			t.Errorf("parallel %d: updates %s", parallel, got)
+		}
+
+		if done, failed, stopped := fan_counts(results); done != 2 || failed != 3 || stopped != 0 {
+			t.Error(done, failed, stopped)
+		}
+		report := fan_report("v", results)
+		if !strings.Contains(report, "==> "+hosts[3]+": v, exit 3 after ") || !strings.Contains(report, "--- stderr ---\noops3\n") {
+			t.Error(report)
+		}
+	}
+}
+
+func TestFanOutCancelled(t *testing.T) {
+
+	config, hosts, setup := fan_test_config(t, 3, func(i int) Jobs {
+		return Jobs{"v": {"cmd": "echo started; sleep 10"}}
+	})
+
+	// cancelled before it starts, no host is started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := fan_out(ctx, config, hosts, "v", 0, setup, nil)
+	for _, r := range results {
+		if r.state != fanCancelled || !errors.Is(r.err, context.Canceled) {
+			t.Errorf("%s: %+v", r.host, r)
+		}
+	}
+
+	// cancelled with two hosts running and the third waiting for a slot
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var once sync.Once
+	w := &fanWatch{hosts: hosts, running: func(n int) {
+		if n == 2 {
+			once.Do(func() { time.AfterFunc(200*time.Millisecond, cancel) })
+		}
+	}}
+
+	start := time.Now()
+	results = fan_out(ctx, config, hosts, "v", 2, setup, w.update(t))
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("took %v", took)
+	}
+	if w.most != 2 {
+		t.Errorf("%d hosts at once", w.most)
+	}
+
+	for i, r := range results {
+		if r.state != fanCancelled || !is_cancelled(r.err) {
+			t.Errorf("host %d: %+v", i, r)
+		}
+	}
+	if got := strings.Join(w.states[hosts[2]], ","); got != fanCancelled {
+		t.Errorf("waiting host: updates %s", got)
+	}
+	if done, failed, stopped := fan_counts(results); done != 0 || failed != 0 || stopped != 3 {
+		t.Error(done, failed, stopped)
+	}
+}
+
+func TestFanReport(t *testing.T) {
+
+	start := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	results := []fanResult{
+		{host: "gw", state: fanDone, output: "up\n\n",
+			res: &JobResult{ExitCode: 0, Start: start}},
+		{host: "ap1", state: fanFailed, output: "half",
+			res: &JobResult{ExitCode: 2, Stderr: "oops", Start: start, Duration: time.Second, Err: errors.New("exit 2")}},
+		{host: "ap2", state: fanFailed, err: errors.New("connection refused")},
+		{host: "nas", state: fanWaiting},
+	}
+
+	want := `==> gw: uptime, exit 0 after 0s, started 15:04:05 <==
+up
+
+==> ap1: uptime, exit 2 after 1s, started 15:04:05 <==
+half
+--- stderr ---
+oops
+
+==> ap2: uptime, connection refused <==
+
+==> nas: uptime, waiting <==
+
+`
+	if got := fan_report("uptime", results); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	if results[1].exit_code() != "2" || results[2].exit_code() != "" {
+		t.Error(results[1].exit_code(), results[2].exit_code())
+	}
+	if done, failed, stopped := fan_counts(results); done != 1 || failed != 2 || stopped != 0 {
+		t.Error(done, failed, stopped)
+	}
+}
@@ -0,0 +1,124 @@
+package tools
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// jump_hosts returns the hosts to go through to reach spec, from the host's
+// Jump setting or else the ProxyJump of ~/.ssh/config. The chain is a comma
+// separated list of specs, eg "user@bastion:22,user@inner:2222".
+func (c *conn) jump_hosts(spec hostSpec) []hostSpec {
+
+	chain := c.jump
+	if chain == "" {
+		chain = spec.proxyJump
+	}
+
+	var hops []hostSpec
+	for _, s := range strings.Split(chain, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		hops = append(hops, parse_host_spec(s))
+	}
+
+	return hops
+}
+
+// route describes the jump hosts for status messages, empty when the host
+// is dialled directly.
+func (c *conn) route() string {
+	hops := c.jump_hosts(parse_host_spec(c.host))
+	if len(hops) == 0 {
+		return ""
+	}
+	var names []string
+	for _, h := range hops {
+		names = append(names, h.user+"@"+h.addr)
+	}
+	return " via " + strings.Join(names, ", ")
+}
+
+// dial connects to spec through its jump hosts, each hop authenticating
+// with its own user and keys. The password is only offered to spec itself.
+// Returns the client along with the key used for spec.
+func (c *conn) dial(spec hostSpec, checkHostKey ssh.HostKeyCallback) (*ssh.Client, ssh_key, error) {
+
+	chain := append(c.jump_hosts(spec), spec)
+
+	var client *ssh.Client
+	var sk ssh_key
+
+	for i, hop := range chain {
+
+		last := i == len(chain)-1
+
+		config, hopKey, err := c.client_config(hop, checkHostKey, last)
+		if err != nil {
+			c.close()
+			return nil, sk, err
+		}
+
+		if client == nil {
+			client, err = dial_direct(hop.addr, config, c.connect_timeout())
+		} else {
+			client, err = dial_through(client, hop.addr, config, c.connect_timeout())
+		}
+		if err != nil {
+			c.close()
+			if c.host_key_err != nil {
+				return nil, sk, c.host_key_err
+			}
+			if len(chain) > 1 {
+				err = fmt.Errorf("%s@%s: %w", hop.user, hop.addr, err)
+			}
+			return nil, sk, err
+		}
+
+		if !last {
+			c.hops = append(c.hops, client)
+		}
+		sk = hopKey
+	}
+
+	return client, sk, nil
+}
+
+// dial_through opens a tcp forward to addr on an established client and
+// runs a new ssh handshake over it.
+func dial_through(client *ssh.Client, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+
+	// the jump host may take its time reaching addr
+	type dialed struct {
+		nc  net.Conn
+		err error
+	}
+	r := make(chan dialed, 1)
+	go func() {
+		nc, err := client.Dial("tcp", addr)
+		r <- dialed{nc, err}
+	}()
+
+	var d dialed
+	select {
+	case d = <-r:
+	case <-time.After(timeout):
+		go func() {
+			if d := <-r; d.nc != nil {
+				d.nc.Close()
+			}
+		}()
+		return nil, fmt.Errorf("%s did not answer within %s", addr, timeout)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return handshake(d.nc, addr, config, timeout)
+}
@@ -0,0 +1,165 @@
+package tools
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestJumpHosts(t *testing.T) {
+
+	tests := []struct {
+		jump      string
+		proxyJump string
+		want      []string
+		route     string
+	}{
+		{"", "", nil, ""},
+		{"a@bastion", "", []string{"a@bastion:22"}, " via a@bastion:22"},
+		{"a@bastion:2222, b@inner:22", "", []string{"a@bastion:2222", "b@inner:22"}, " via a@bastion:2222, b@inner:22"},
+		{" ,a@bastion,, ", "", []string{"a@bastion:22"}, " via a@bastion:22"},
+		{"", "p@proxy:10022", []string{"p@proxy:10022"}, ""},
+		{"a@bastion", "p@proxy", []string{"a@bastion:22"}, " via a@bastion:22"},
+	}
+
+	for _, tt := range tests {
+		c := conn{host: "u@target:22", jump: tt.jump}
+		spec := parse_host_spec("u@target:22")
+		spec.proxyJump = tt.proxyJump
+
+		var got []string
+		for _, h := range c.jump_hosts(spec) {
+			got = append(got, h.user+"@"+h.addr)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("jump %q proxy %q: got %v, want %v", tt.jump, tt.proxyJump, got, tt.want)
+		}
+		// the route only knows the configured chain of c.host
+		if tt.proxyJump == "" && c.route() != tt.route {
+			t.Errorf("jump %q: route %q, want %q", tt.jump, c.route(), tt.route)
+		}
+	}
+}
+
+// listen_ssh runs an ssh server on a loopback port and returns its address.
+func listen_ssh(t *testing.T, config *ssh.ServerConfig, serve func(sc *ssh.ServerConn, chans <-chan ssh.NewChannel)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve_conn(nc, config, serve)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// forward_to serves a jump host, its forwards go to the servers of hosts
+// by address, which forward in turn. Other addresses are refused.
+func forward_to(t *testing.T, hosts map[string]*ssh.ServerConfig) func(sc *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+	return func(sc *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+		for nc := range chans {
+
+			var dest struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if nc.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nc.ExtraData(), &dest) != nil {
+				nc.Reject(ssh.UnknownChannelType, "forwards only")
+				continue
+			}
+			config, ok := hosts[net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port)))]
+			if !ok {
+				nc.Reject(ssh.ConnectionFailed, "no route to host")
+				continue
+			}
+
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+
+			next := serve_ssh(t, config, forward_to(t, hosts))
+			go func() {
+				io.Copy(next, ch)
+				next.Close()
+			}()
+			go func() {
+				io.Copy(ch, next)
+				ch.Close()
+			}()
+		}
+	}
+}
+
+func TestJumpChain(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	keyFile, keySigner := test_key(t, home, "id_test")
+	other := test_signer(t)
+
+	byKey := test_server_config(t, false, keySigner.PublicKey())
+	byPassword := test_server_config(t, true)
+	byOtherKey := test_server_config(t, false, other.PublicKey())
+
+	tests := []struct {
+		name   string
+		first  *ssh.ServerConfig // the jump host dialled directly
+		hosts  map[string]*ssh.ServerConfig
+		jump   string // after the first jump host
+		target string
+		ok     bool
+		errHas string
+	}{
+		{"one jump", byKey, map[string]*ssh.ServerConfig{"target:22": byKey}, "", "u@target", true, ""},
+		{"two jumps", byKey, map[string]*ssh.ServerConfig{"inner:22": byKey, "target:22": byKey}, "i@inner", "u@target", true, ""},
+		{"password for the target", byKey, map[string]*ssh.ServerConfig{"target:22": byPassword}, "", "u@target", true, ""},
+		{"no password for jump hosts", byPassword, map[string]*ssh.ServerConfig{"target:22": byKey}, "", "u@target", false, "j@127.0.0.1"},
+		{"inner jump refuses the key", byKey, map[string]*ssh.ServerConfig{"inner:22": byOtherKey, "target:22": byKey}, "i@inner", "u@target", false, "i@inner:22"},
+		{"target refuses the key", byKey, map[string]*ssh.ServerConfig{"target:22": byOtherKey}, "", "u@target", false, "u@target:22"},
+		{"no route to the target", byKey, map[string]*ssh.ServerConfig{}, "", "u@target", false, "no route to host"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			addr := listen_ssh(t, tt.first, forward_to(t, tt.hosts))
+			jump := "j@" + addr
+			if tt.jump != "" {
+				jump += "," + tt.jump
+			}
+
+			c := conn{host: tt.target, key: keyFile, password: "pw", jump: jump}
+			client, _, err := c.dial(parse_host_spec(tt.target), accept_any_host_key)
+			if err == nil {
+				client.Close()
+				c.close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("dial: %v, want ok %v", err, tt.ok)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.errHas) {
+				t.Fatalf("dial: %v, want it to name %q", err, tt.errHas)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Connections are watched for dropping: the client ending, or the host
+// not answering keepalive@openssh.com requests for keepAliveCountMax
+// intervals in a row, as ssh's ServerAliveInterval does. A lost connection
+// is no longer isConnected, so the next job connects again.
+
+const (
+	defaultConnectTimeout = 15 * time.Second
+	defaultKeepAlive      = 30 * time.Second
+	keepAliveCountMax     = 3
+)
+
+// connection states passed to on_state
+const (
+	stateConnected = "connected"
+	stateLost      = "lost"
+)
+
+// connState is whether a connection is still up, shared with the
+// goroutines watching it.
+type connState struct {
+	mu      sync.Mutex
+	lost    error // why the connection dropped, nil while up
+	stopped bool  // closed on purpose, see close
+	stop    chan struct{}
+}
+
+func (s *connState) up() bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lost == nil && !s.stopped
+}
+
+// set_lost records why the connection dropped, reporting whether this is
+// news, a connection closed on purpose is not lost.
+func (s *connState) set_lost(err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.lost != nil {
+		return false
+	}
+	s.lost = err
+	return true
+}
+
+func (s *connState) stop_watching() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+	}
+}
+
+// connect_timeout is how long to wait for a host to answer.
+func (c *conn) connect_timeout() time.Duration {
+	if c.timeout > 0 {
+		return time.Duration(c.timeout) * time.Second
+	}
+	return defaultConnectTimeout
+}
+
+// keepalive_interval is how often to check the host is there, 0 for never.
+func (c *conn) keepalive_interval() time.Duration {
+	switch {
+	case c.keep_alive < 0:
+		return 0
+	case c.keep_alive > 0:
+		return time.Duration(c.keep_alive) * time.Second
+	}
+	return defaultKeepAlive
+}
+
+// watch starts watching the new connection for dropping.
+func (c *conn) watch() {
+
+	s := &connState{stop: make(chan struct{})}
+	c.state = s
+	client := c.ssh.Client
+	notify := c.on_state
+
+	lost := func(err error) {
+		if s.set_lost(err) && notify != nil {
+			notify(stateLost, err)
+		}
+	}
+
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = errors.New("connection closed by the host")
+		}
+		lost(err)
+	}()
+
+	interval := c.keepalive_interval()
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		missed := 0
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+			}
+			if keepalive(client, interval) {
+				missed = 0
+				continue
+			}
+			missed++
+			if missed >= keepAliveCountMax {
+				lost(fmt.Errorf("no answer to %d keepalives", missed))
+				client.Close()
+				return
+			}
+		}
+	}()
+}
+
+// keepalive asks the host for a reply, any reply will do as hosts refuse
+// requests they don't know.
+func keepalive(client *ssh.Client, timeout time.Duration) bool {
+	r := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		r <- err
+	}()
+	select {
+	case err := <-r:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// dial_direct connects to addr, see handshake for the timeout.
+func dial_direct(addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return handshake(nc, addr, config, timeout)
+}
+
+// handshake sets the ssh connection up over nc, giving up when the host
+// has not shown its key within timeout. Logging in after that may wait on
+// the user so it is not timed.
+func handshake(nc net.Conn, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		nc.Close()
+	})
+
+	cfg := *config
+	cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		timer.Stop()
+		return config.HostKeyCallback(hostname, remote, key)
+	}
+
+	cc, chans, reqs, err := ssh.NewClientConn(nc, addr, &cfg)
+	timer.Stop()
+	if err != nil {
+		nc.Close()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return nil, fmt.Errorf("%s did not answer within %s", addr, timeout)
+		}
+		return nil, err
+	}
+
+	return ssh.NewClient(cc, chans, reqs), nil
+}
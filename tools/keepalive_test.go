@@ -0,0 +1,269 @@
+package tools
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnTimeouts(t *testing.T) {
+
+	config := &Config{Hosts: Hosts{
+		"a": {},
+		"b": {ConnectTimeout: 5, KeepAlive: 10},
+		"c": {KeepAlive: -1},
+	}}
+
+	tests := []struct {
+		host      string
+		timeout   time.Duration
+		keepalive time.Duration
+	}{
+		{"a", defaultConnectTimeout, defaultKeepAlive},
+		{"b", 5 * time.Second, 10 * time.Second},
+		{"c", defaultConnectTimeout, 0},
+	}
+
+	for _, tt := range tests {
+		c := conn{}
+		c.configure(config, tt.host)
+		if c.connect_timeout() != tt.timeout || c.keepalive_interval() != tt.keepalive {
+			t.Errorf("%s: %v %v", tt.host, c.connect_timeout(), c.keepalive_interval())
+		}
+	}
+}
+
+// a host that takes the connection and never says anything is given up on
+func TestHandshakeTimeout(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer nc.Close()
+		}
+	}()
+
+	c := conn{host: "u@" + l.Addr().String(), password: "pw", timeout: 1,
+		known_hosts: []string{filepath.Join(home, "known_hosts")}}
+	start := time.Now()
+	err = c.Connect()
+	if err == nil || !strings.Contains(err.Error(), "did not answer within 1s") {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("took %v", took)
+	}
+}
+
+// stall_proxy forwards connections to addr, passing nothing on in either
+// direction while stalled, like a link gone dead without a reset.
+func stall_proxy(t *testing.T, addr string) (string, func(stalled bool)) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	stalled := false
+	pipe := func(dst, src net.Conn) {
+		defer dst.Close()
+		b := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(b)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			s := stalled
+			mu.Unlock()
+			if s {
+				// the connection is dead for good
+				io.Copy(io.Discard, src)
+				return
+			}
+			dst.Write(b[:n])
+		}
+	}
+
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", addr)
+			if err != nil {
+				nc.Close()
+				continue
+			}
+			go pipe(up, nc)
+			go pipe(nc, up)
+		}
+	}()
+
+	return l.Addr().String(), func(s bool) {
+		mu.Lock()
+		stalled = s
+		mu.Unlock()
+	}
+}
+
+// stateLog keeps the states a connection reports.
+type stateLog struct {
+	mu     sync.Mutex
+	states []string
+	errs   []error
+}
+
+func (l *stateLog) on_state(state string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.states = append(l.states, state)
+	l.errs = append(l.errs, err)
+}
+
+func (l *stateLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.states, ",")
+}
+
+// wait_lost waits for c to notice its connection dropped.
+func wait_lost(t *testing.T, c *conn, within time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for c.isConnected() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if c.isConnected() {
+		t.Fatal("still connected after", within)
+	}
+}
+
+// keepalive_host runs a server for run_sessions taking the password "pw",
+// handing each connection to conns, and trusts its host key for addrs as
+// well as its own address, which it returns.
+func keepalive_host(t *testing.T, kh string, conns chan<- *ssh.ServerConn) (string, func(addr string)) {
+	t.Helper()
+
+	config := test_server_config(t, true)
+	hostKey := test_signer(t)
+	config.AddHostKey(hostKey)
+	addr := listen_ssh(t, config, func(sc *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+		if conns != nil {
+			conns <- sc
+		}
+		run_sessions(nil)(sc, chans)
+	})
+
+	trust := func(addr string) {
+		if err := trust_host_key(kh, addr, hostKey.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trust(addr)
+
+	return addr, trust
+}
+
+func TestKeepAliveLost(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	kh := filepath.Join(home, "known_hosts")
+	addr, trust := keepalive_host(t, kh, nil)
+	proxy, stall := stall_proxy(t, addr)
+	trust(proxy)
+
+	log := &stateLog{}
+	c := &conn{host: "u@" + proxy, password: "pw", known_hosts: []string{kh}, keep_alive: 1, on_state: log.on_state}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	// answered keepalives keep it up
+	time.Sleep(2500 * time.Millisecond)
+	if !c.isConnected() {
+		t.Fatal("lost while the host answers")
+	}
+
+	stall(true)
+	wait_lost(t, c, 8*time.Second)
+	if got := log.String(); got != "connected,lost" {
+		t.Fatal(got)
+	}
+	if err := log.errs[1]; err == nil || !strings.Contains(err.Error(), "no answer to 3 keepalives") {
+		t.Error(err)
+	}
+
+	// the next job connects again
+	stall(false)
+	out, err := c.output("echo back")
+	if err != nil || out != "back\n" {
+		t.Fatal(out, err)
+	}
+	if got := log.String(); got != "connected,lost,connected" {
+		t.Error(got)
+	}
+}
+
+func TestHostClosed(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	kh := filepath.Join(home, "known_hosts")
+	conns := make(chan *ssh.ServerConn, 2)
+	addr, _ := keepalive_host(t, kh, conns)
+
+	// without keepalives the host closing is noticed all the same
+	log := &stateLog{}
+	c := &conn{host: "u@" + addr, password: "pw", known_hosts: []string{kh}, keep_alive: -1, on_state: log.on_state}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	(<-conns).Close()
+	wait_lost(t, c, 5*time.Second)
+	if got := log.String(); got != "connected,lost" || log.errs[1] == nil {
+		t.Fatal(got, log.errs)
+	}
+
+	// closing it ourselves is not losing it
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	<-conns
+	c.close()
+	time.Sleep(200 * time.Millisecond)
+	if got := log.String(); got != "connected,lost,connected" {
+		t.Error(got)
+	}
+	if c.isConnected() {
+		t.Error("connected after closing")
+	}
+}
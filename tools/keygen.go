@@ -0,0 +1,287 @@
+package tools
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Key types we generate. The sk ones are made on a FIDO security key by
+// ssh-keygen, which talks to the key, and are used through ssh-agent since
+// only the key can sign with them: load them with ssh-add.
+const (
+	keyED25519   = "ed25519"
+	keyECDSA     = "ecdsa"
+	keyRSA       = "rsa"
+	keyED25519SK = "ed25519-sk"
+	keyECDSASK   = "ecdsa-sk"
+)
+
+// key_types lists the key types in the order their standard identity files
+// are looked for, ed25519 first as that is what we generate by default.
+func key_types() []string {
+	return []string{keyED25519, keyECDSA, keyRSA, keyED25519SK, keyECDSASK}
+}
+
+func is_sk_key_type(t string) bool {
+	return t == keyED25519SK || t == keyECDSASK
+}
+
+// key_bits checks bits is a size ssh-keygen would make for a key of type t
+// and returns it, or the default size when bits is 0.
+func key_bits(t string, bits int) (int, error) {
+	switch t {
+	case "", keyED25519, keyED25519SK, keyECDSASK:
+		if bits != 0 {
+			return 0, fmt.Errorf("%s keys have a fixed size", key_type_name(t))
+		}
+		return 0, nil
+	case keyRSA:
+		if bits == 0 {
+			return 3072, nil
+		}
+		if bits < 2048 || bits > 16384 {
+			return 0, fmt.Errorf("rsa keys must be 2048 to 16384 bits, not %d", bits)
+		}
+		return bits, nil
+	case keyECDSA:
+		if bits == 0 {
+			return 256, nil
+		}
+		if bits != 256 && bits != 384 && bits != 521 {
+			return 0, fmt.Errorf("ecdsa keys must be 256, 384 or 521 bits, not %d", bits)
+		}
+		return bits, nil
+	}
+	return 0, fmt.Errorf("unknown key type %q, use one of %s", t, strings.Join(key_types(), ", "))
+}
+
+func key_type_name(t string) string {
+	if t == "" {
+		return keyED25519
+	}
+	return t
+}
+
+// identity_file is the standard private key file for keys of type t, as
+// ssh looks for them when no key is given.
+func identity_file(t string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "id_"+strings.ReplaceAll(key_type_name(t), "-", "_"))
+}
+
+// default_key_file is the key generate_ssh_keys creates by default.
+func default_key_file() string {
+	return identity_file(keyED25519)
+}
+
+// find_identity returns the first standard identity file there is, or ""
+// when there is none.
+func find_identity() string {
+	for _, f := range identity_files() {
+		if path_exists(f) {
+			return f
+		}
+	}
+	return ""
+}
+
+func identity_files() []string {
+	var files []string
+	for _, t := range key_types() {
+		if f := identity_file(t); f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// identity_signers loads the standard identity files other than except.
+// Encrypted ones are skipped unless their passphrase was given already, as
+// are security keys, the agent signs for those.
+func identity_signers(except string) []ssh.Signer {
+	var signers []ssh.Signer
+	for _, f := range identity_files() {
+		if f == except || !path_exists(f) {
+			continue
+		}
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && cached_passphrase(f) != nil {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(b, cached_passphrase(f))
+		}
+		if err != nil {
+			continue
+		}
+		if _, cs := load_cert(f, signer); cs != nil {
+			signers = append(signers, cs)
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// key_type_of returns the type and size of a public key as key_bits takes
+// them, to make a new key like it.
+func key_type_of(pub ssh.PublicKey) (string, int) {
+	switch pub.Type() {
+	case ssh.KeyAlgoRSA:
+		if k, ok := pub.(ssh.CryptoPublicKey); ok {
+			if rk, ok := k.CryptoPublicKey().(*rsa.PublicKey); ok {
+				return keyRSA, rk.N.BitLen()
+			}
+		}
+		return keyRSA, 0
+	case ssh.KeyAlgoECDSA256:
+		return keyECDSA, 256
+	case ssh.KeyAlgoECDSA384:
+		return keyECDSA, 384
+	case ssh.KeyAlgoECDSA521:
+		return keyECDSA, 521
+	case ssh.KeyAlgoSKED25519:
+		return keyED25519SK, 0
+	case ssh.KeyAlgoSKECDSA256:
+		return keyECDSASK, 0
+	}
+	return keyED25519, 0
+}
+
+// new_passphrase asks for the passphrase of a key of type t about to be
+// generated at file and caches it so the key can be used straight away.
+// Without ask, with an empty answer or for a security key, the key has none.
+func new_passphrase(ask func(file string) ([]byte, error), file, t string) ([]byte, error) {
+	if ask == nil || is_sk_key_type(t) {
+		return nil, nil
+	}
+	passphrase, err := ask(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) > 0 {
+		cache_passphrase(file, passphrase)
+	}
+	return passphrase, nil
+}
+
+// generate_ssh_keys makes sure there is a standard identity file for keys
+// of type t, generating one of bits size when there is none.
+func generate_ssh_keys(t string, bits int, passphrase []byte) (string, error) {
+
+	private := identity_file(t)
+	if private == "" {
+		return "", errors.New("no home directory for the ssh key")
+	}
+	if path_exists(private) {
+		return private, nil
+	}
+
+	err := generate_key(private, t, bits, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	return private, nil
+}
+
+// generate_key writes a new key pair of type t to private and private.pub,
+// bits being 0 for the default size.
+func generate_key(private, t string, bits int, passphrase []byte) error {
+
+	bits, err := key_bits(t, bits)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(private), 0700)
+	if err != nil {
+		return err
+	}
+
+	if is_sk_key_type(t) {
+		return generate_sk_key(private, t, passphrase)
+	}
+
+	var key crypto.Signer
+	switch t {
+	case keyRSA:
+		key, err = rsa.GenerateKey(rand.Reader, bits)
+	case keyECDSA:
+		curve := map[int]elliptic.Curve{256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}[bits]
+		key, err = ecdsa.GenerateKey(curve, rand.Reader)
+	default:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+
+	privBytes, err := MarshalPrivateKeyWithPassphrase(key, passphrase)
+	if err != nil {
+		return err
+	}
+
+	privateKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: privBytes,
+	})
+
+	err = os.WriteFile(private, privateKey, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(private+".pub", []byte(authorized_key_line(publicKey)), 0644)
+}
+
+// generate_sk_key has ssh-keygen make the key on the security key, which
+// may want a touch or a pin on the terminal. The file only holds a handle
+// to the key, so it gets no passphrase, ssh-keygen would only take one on
+// its command line for all to see.
+func generate_sk_key(private, t string, passphrase []byte) error {
+
+	if len(passphrase) > 0 {
+		return fmt.Errorf("%s keys are protected by the security key, not a passphrase", t)
+	}
+
+	path, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		return fmt.Errorf("%s keys are made by ssh-keygen: %w", t, err)
+	}
+
+	cmd := exec.Command(path, "-q", "-t", t, "-f", private,
+		"-N", "", "-C", key_comment())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("ssh-keygen -t %s: %w", t, err)
+	}
+
+	return nil
+}
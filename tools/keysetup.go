@@ -0,0 +1,356 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keysetup works like ssh-copy-id: make sure we have a key pair,
+// install its public key on the host and check the key alone logs in.
+
+// authorized_key_line formats key for an authorized_keys or .pub file,
+// commented with who we are.
+func authorized_key_line(key ssh.PublicKey) string {
+	return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n") + " " + key_comment()
+}
+
+// key_comment is user@host of who we are.
+func key_comment() string {
+	name := GetDefaultUsername
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+// InstallKey policies for putting our public key on a host after
+// connecting, the empty string is never.
+const (
+	installNever  = "never"
+	installAsk    = "ask"
+	installAlways = "always"
+)
+
+func install_policies() []string {
+	return []string{installNever, installAsk, installAlways}
+}
+
+// remote_path quotes p for the remote shell, expanding a leading ~ to the
+// remote home directory.
+func remote_path(p string) string {
+	if p == "~" {
+		return "\"$HOME\""
+	}
+	if strings.HasPrefix(p, "~/") {
+		return "\"$HOME\"/" + shell_quote(p[2:])
+	}
+	return shell_quote(p)
+}
+
+// key_script sets $k to the key line, $m to the key without options and
+// comment to look for, and the positional parameters to the authorized_keys
+// files. Without files that is the one sshd or dropbear reads for the user,
+// dropbear on openwrt reads root's keys from /etc/dropbear.
+func key_script(key string, files []string) string {
+
+	fields := strings.Fields(key)
+	match := key
+	if len(fields) >= 2 {
+		match = fields[0] + " " + fields[1]
+	}
+
+	var sb strings.Builder
+	sb.WriteString("k=" + shell_quote(key) + "; ")
+	sb.WriteString("m=" + shell_quote(match) + "; ")
+	if len(files) == 0 {
+		sb.WriteString("d=\"$HOME/.ssh\"; ")
+		sb.WriteString("if [ -d /etc/dropbear ] && [ \"$(id -u)\" = 0 ]; then d=/etc/dropbear; fi; ")
+		sb.WriteString("set -- \"$d/authorized_keys\"; ")
+	} else {
+		sb.WriteString("set --")
+		for _, f := range files {
+			sb.WriteString(" " + remote_path(f))
+		}
+		sb.WriteString("; ")
+	}
+	return sb.String()
+}
+
+// install_key_cmd adds key to each authorized_keys file unless a line with
+// the same key is already there. The files, and ~/.ssh, are made 600 and
+// 700 as sshd requires, whether they are new or not. It prints "installed"
+// or "present" and the file for each file.
+func install_key_cmd(key string, files []string) string {
+	var sb strings.Builder
+	sb.WriteString(key_script(key, files))
+	sb.WriteString("umask 077; for f; do ")
+	sb.WriteString("d=$(dirname \"$f\"); ")
+	sb.WriteString("[ -d \"$d\" ] || mkdir -p \"$d\" || exit 1; ")
+	sb.WriteString("[ -f \"$f\" ] || touch \"$f\" || exit 1; ")
+	// sshd ignores keys in files others can write to, so fix up old ones too
+	sb.WriteString("{ [ \"$d\" != \"$HOME/.ssh\" ] || chmod 700 \"$d\"; } && chmod 600 \"$f\" || exit 1; ")
+	sb.WriteString("if grep -qF \"$m\" \"$f\"; then echo \"present $f\"; continue; fi; ")
+	// don't glue the key onto a last line without a newline
+	sb.WriteString("if [ -s \"$f\" ] && [ -n \"$(tail -c 1 \"$f\")\" ]; then echo >> \"$f\"; fi; ")
+	sb.WriteString("printf '%s\\n' \"$k\" >> \"$f\" && echo \"installed $f\" || exit 1; ")
+	sb.WriteString("done")
+	return sb.String()
+}
+
+// check_key_cmd prints "present" or "missing" and the file for each
+// authorized_keys file.
+func check_key_cmd(key string, files []string) string {
+	var sb strings.Builder
+	sb.WriteString(key_script(key, files))
+	sb.WriteString("for f; do ")
+	sb.WriteString("if [ -f \"$f\" ] && grep -qF \"$m\" \"$f\"; then echo \"present $f\"; ")
+	sb.WriteString("else echo \"missing $f\"; fi; ")
+	sb.WriteString("done")
+	return sb.String()
+}
+
+// uninstall_key_cmd removes the first line of file that is exactly line,
+// keeping the file's mode and owner. It prints "removed" or "absent".
+func uninstall_key_cmd(line, file string) string {
+	var sb strings.Builder
+	sb.WriteString("k=" + shell_quote(line) + "; ")
+	sb.WriteString("f=" + remote_path(file) + "; ")
+	sb.WriteString("if [ -f \"$f\" ] && grep -qxF \"$k\" \"$f\"; then ")
+	sb.WriteString("t=$(mktemp) || exit 1; ")
+	sb.WriteString("K=\"$k\" awk '!d && $0 == ENVIRON[\"K\"] { d = 1; next } 1' \"$f\" > \"$t\" && ")
+	sb.WriteString("cat \"$t\" > \"$f\"; r=$?; rm -f \"$t\"; [ $r = 0 ] || exit 1; ")
+	sb.WriteString("echo removed; ")
+	sb.WriteString("else echo absent; fi")
+	return sb.String()
+}
+
+// keyRecord remembers a line we added to an authorized_keys file, so that
+// exactly that line can be removed again.
+type keyRecord struct {
+	Host string    `json:"Host"`
+	File string    `json:"File"` // authorized_keys file on the host
+	Line string    `json:"Line"` // the line added
+	Key  string    `json:"Key"`  // our private key file
+	Time time.Time `json:"Time"`
+}
+
+func load_key_records(path string) ([]keyRecord, error) {
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []keyRecord
+	err = json.Unmarshal(b, &records)
+	if err != nil {
+		return nil, fmt.Errorf("bad key records: %s: %w", path, err)
+	}
+
+	return records, nil
+}
+
+func save_key_records(path string, records []keyRecord) error {
+
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0644)
+}
+
+// ensure_key returns the private key file to use, generating a key of type
+// t and size bits when it is missing. Without file that is any standard
+// identity there is, or the standard one for t when a type is asked for.
+// ask is asked for the passphrase of a generated key, see new_passphrase.
+func ensure_key(file, t string, bits int, ask func(file string) ([]byte, error)) (string, bool, error) {
+
+	if file == "" && t == "" {
+		file = find_identity()
+	}
+	if file == "" {
+		file = identity_file(t)
+	}
+	if file != "" && path_exists(file) {
+		return file, false, nil
+	}
+	if file == "" {
+		return "", false, errors.New("no home directory for the ssh key")
+	}
+
+	passphrase, err := new_passphrase(ask, file, t)
+	if err != nil {
+		return "", false, err
+	}
+	err = generate_key(file, t, bits, passphrase)
+	if err != nil {
+		return "", false, fmt.Errorf("generating key: %w", err)
+	}
+
+	return file, true, nil
+}
+
+// keyInstall is the state of our key in one authorized_keys file on the
+// host: "installed" when we added it, "present" when it was there already
+// or "missing".
+type keyInstall struct {
+	file   string
+	status string
+}
+
+// parse_key_status reads the "status file" lines install_key_cmd and
+// check_key_cmd print.
+func parse_key_status(out string) []keyInstall {
+	var r []keyInstall
+	for _, l := range strings.Split(out, "\n") {
+		status, file, ok := strings.Cut(strings.TrimSpace(l), " ")
+		if !ok {
+			continue
+		}
+		r = append(r, keyInstall{file: file, status: status})
+	}
+	return r
+}
+
+// missing_key lists the authorized_keys files on the host that do not have
+// the public key of the private key file.
+func (c *conn) missing_key(file string, files []string) ([]string, error) {
+
+	sk, err := get_keys(file)
+	if err != nil {
+		return nil, err
+	}
+	if sk.public_key == "" {
+		return nil, errors.New("no public key for " + file)
+	}
+
+	out, err := c.output(check_key_cmd(sk.public_key, files))
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, k := range parse_key_status(out) {
+		if k.status == "missing" {
+			missing = append(missing, k.file)
+		}
+	}
+
+	return missing, nil
+}
+
+// install_key installs the public key of the private key file in the
+// host's authorized_keys files, the default one when files is empty. The
+// lines added are recorded in the records file unless that is empty.
+func (c *conn) install_key(file string, files []string, records string) ([]keyInstall, error) {
+
+	sk, err := get_keys(file)
+	if err != nil {
+		return nil, err
+	}
+	if sk.public_key == "" {
+		return nil, errors.New("no public key for " + file)
+	}
+
+	out, err := c.output(install_key_cmd(sk.public_key, files))
+	if err != nil {
+		return nil, fmt.Errorf("installing key: %w", err)
+	}
+
+	r := parse_key_status(out)
+
+	if records == "" {
+		return r, nil
+	}
+
+	recs, err := load_key_records(records)
+	if err != nil {
+		return r, err
+	}
+	// present keys were not added by us and are not ours to remove
+	n := len(recs)
+	for _, k := range r {
+		if k.status == "installed" {
+			recs = append(recs, keyRecord{
+				Host: c.host, File: k.file, Line: sk.public_key, Key: file, Time: time.Now(),
+			})
+		}
+	}
+	if len(recs) > n {
+		err = save_key_records(records, recs)
+	}
+
+	return r, err
+}
+
+// verify_key checks the private key file alone logs in to host, over a
+// connection of its own configured from config.
+func verify_key(config *Config, host, file string) error {
+
+	v := conn{}
+	v.configure(config, host)
+	v.key = file
+	v.key_only = true
+
+	err := v.Connect()
+	if err != nil {
+		return fmt.Errorf("key login with %s failed: %w", file, err)
+	}
+	v.close()
+
+	return nil
+}
+
+// uninstall_keys removes the lines recorded as added to the host from its
+// authorized_keys files and drops their records. Lines found missing are
+// dropped from the records as well. It returns the records of the lines
+// removed.
+func (c *conn) uninstall_keys(records string) ([]keyRecord, error) {
+
+	recs, err := load_key_records(records)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept, removed []keyRecord
+	var errs []string
+	for _, rec := range recs {
+		if rec.Host != c.host {
+			kept = append(kept, rec)
+			continue
+		}
+		out, err := c.output(uninstall_key_cmd(rec.Line, rec.File))
+		if err != nil {
+			errs = append(errs, rec.File+": "+err.Error())
+			kept = append(kept, rec)
+			continue
+		}
+		if strings.TrimSpace(out) == "removed" {
+			removed = append(removed, rec)
+		}
+	}
+
+	if len(kept) != len(recs) {
+		err = save_key_records(records, kept)
+		if err != nil {
+			return removed, err
+		}
+	}
+	if len(errs) > 0 {
+		return removed, errors.New("removing key: " + strings.Join(errs, ", "))
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,209 @@
+package tools
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// key_host runs a server for run_sessions taking the password "pw" or a
+// key in the authorized_keys file under HOME, as sshd would. Its host key
+// is trusted in config's known_hosts file.
+func key_host(t *testing.T, config *Config) string {
+	t.Helper()
+
+	home := os.Getenv("HOME")
+	server := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if string(p) == "pw" {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			b, _ := os.ReadFile(filepath.Join(home, ".ssh", "authorized_keys"))
+			for len(b) > 0 {
+				k, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+				if err != nil {
+					break
+				}
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return &ssh.Permissions{}, nil
+				}
+				b = rest
+			}
+			return nil, errors.New("key not authorized")
+		},
+	}
+	hostKey := test_signer(t)
+	server.AddHostKey(hostKey)
+	addr := listen_ssh(t, server, run_sessions(nil))
+
+	err := trust_host_key(config.KnownHostsFile(), addr, hostKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "u@" + addr
+}
+
+func TestInstallKey(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	config := &Config{File: filepath.Join(home, "config.json"), Hosts: Hosts{"": {}}}
+	host := key_host(t, config)
+	records := config.KeyRecordFile()
+
+	key, signer := test_key(t, t.TempDir(), "id_test")
+	line := authorized_key_line(signer.PublicKey())
+
+	c := &conn{host: host, password: "pw", known_hosts: config.KnownHostsFiles()}
+	err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	// someone else's key, the last line without a newline, in a directory
+	// and file sshd would not trust
+	dir := filepath.Join(home, ".ssh")
+	ak := filepath.Join(dir, "authorized_keys")
+	other := authorized_key_line(test_signer(t).PublicKey())
+	os.Mkdir(dir, 0755)
+	os.WriteFile(ak, []byte(other), 0644)
+
+	missing, err := c.missing_key(key, nil)
+	if err != nil || len(missing) != 1 || missing[0] != ak {
+		t.Fatal(missing, err)
+	}
+	if err := verify_key(config, host, key); err == nil {
+		t.Fatal("logged in with a key not installed")
+	}
+
+	installs, err := c.install_key(key, nil, records)
+	if err != nil || len(installs) != 1 || installs[0] != (keyInstall{file: ak, status: "installed"}) {
+		t.Fatal(installs, err)
+	}
+	if b, _ := os.ReadFile(ak); string(b) != other+"\n"+line+"\n" {
+		t.Errorf("authorized_keys has\n%s", b)
+	}
+	for f, mode := range map[string]os.FileMode{dir: 0700, ak: 0600} {
+		if fi, err := os.Stat(f); err != nil || fi.Mode().Perm() != mode {
+			t.Errorf("%s: mode %v, %v", f, fi.Mode().Perm(), err)
+		}
+	}
+	if err := verify_key(config, host, key); err != nil {
+		t.Error(err)
+	}
+
+	// installing again adds nothing and records nothing
+	installs, err = c.install_key(key, nil, records)
+	if err != nil || len(installs) != 1 || installs[0].status != "present" {
+		t.Fatal(installs, err)
+	}
+	recs, err := load_key_records(records)
+	if err != nil || len(recs) != 1 || recs[0].Host != host || recs[0].File != ak || recs[0].Line != line || recs[0].Key != key {
+		t.Fatal(recs, err)
+	}
+
+	// files of our choosing, made as needed; a key already there is not
+	// ours to remove
+	custom := filepath.Join(home, "custom")
+	os.WriteFile(custom, []byte(line+"\n"), 0600)
+	files := []string{"~/keys/dir/authorized_keys", custom}
+	installs, err = c.install_key(key, files, records)
+	want := []keyInstall{{filepath.Join(home, "keys/dir/authorized_keys"), "installed"}, {custom, "present"}}
+	if err != nil || len(installs) != 2 || installs[0] != want[0] || installs[1] != want[1] {
+		t.Fatal(installs, err)
+	}
+	if missing, err := c.missing_key(key, files); err != nil || len(missing) != 0 {
+		t.Error(missing, err)
+	}
+
+	// records of other hosts are left alone
+	recs, _ = load_key_records(records)
+	recs = append(recs, keyRecord{Host: "u@elsewhere", File: ak, Line: line})
+	save_key_records(records, recs)
+
+	removed, err := c.uninstall_keys(records)
+	if err != nil || len(removed) != 2 {
+		t.Fatal(removed, err)
+	}
+	if b, _ := os.ReadFile(ak); string(b) != other+"\n" {
+		t.Errorf("authorized_keys has\n%s", b)
+	}
+	if fi, err := os.Stat(ak); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("mode", fi.Mode(), err)
+	}
+	if b, _ := os.ReadFile(want[0].file); len(b) != 0 {
+		t.Errorf("%s has\n%s", want[0].file, b)
+	}
+	if b, _ := os.ReadFile(custom); string(b) != line+"\n" {
+		t.Errorf("%s has\n%s", custom, b)
+	}
+	recs, err = load_key_records(records)
+	if err != nil || len(recs) != 1 || recs[0].Host != "u@elsewhere" {
+		t.Error(recs, err)
+	}
+	if err := verify_key(config, host, key); err == nil {
+		t.Error("logged in with the key removed")
+	}
+
+	// a line removed by hand has its record dropped all the same
+	c.install_key(key, nil, records)
+	os.WriteFile(ak, []byte(other+"\n"), 0600)
+	removed, err = c.uninstall_keys(records)
+	if recs, _ := load_key_records(records); err != nil || len(removed) != 0 || len(recs) != 1 {
+		t.Error(removed, recs, err)
+	}
+}
+
+func TestKeyRecords(t *testing.T) {
+
+	dir := t.TempDir()
+	f := filepath.Join(dir, "installed_keys.json")
+
+	if recs, err := load_key_records(f); err != nil || recs != nil {
+		t.Error("missing:", recs, err)
+	}
+
+	os.WriteFile(f, []byte("{"), 0644)
+	if _, err := load_key_records(f); err == nil || !strings.Contains(err.Error(), "bad key records") {
+		t.Error("bad:", err)
+	}
+
+	recs := []keyRecord{{Host: "u@gw:22", File: "~/.ssh/authorized_keys", Line: "ssh-ed25519 AAAA me@here", Key: "/k"}}
+	if err := save_key_records(f, recs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := load_key_records(f)
+	if err != nil || len(got) != 1 || got[0] != recs[0] {
+		t.Error(got, err)
+	}
+}
+
+func TestParseKeyStatus(t *testing.T) {
+
+	got := parse_key_status("installed /root/.ssh/authorized_keys\n  present /etc/dropbear/authorized_keys \n\nnoise\nmissing /a b\n")
+	want := []keyInstall{
+		{"/root/.ssh/authorized_keys", "installed"},
+		{"/etc/dropbear/authorized_keys", "present"},
+		{"/a b", "missing"},
+	}
+	if len(got) != len(want) {
+		t.Fatal(got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%d: %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
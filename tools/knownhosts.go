@@ -0,0 +1,138 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// unknownHostKeyError is returned by Connect when the server presents a
+// key that is in none of the known_hosts files. The caller decides whether
+// to trust it (see trust_host_key) and retry.
+type unknownHostKeyError struct {
+	host string
+	key  ssh.PublicKey
+}
+
+func (e *unknownHostKeyError) Error() string {
+	return fmt.Sprintf("unknown host key for %s: %s %s",
+		e.host, e.key.Type(), ssh.FingerprintSHA256(e.key))
+}
+
+func (e *unknownHostKeyError) fingerprint() string {
+	return ssh.FingerprintSHA256(e.key)
+}
+
+// changedHostKeyError is returned when the server presents a key that does
+// not match the one already recorded for it. This is never recoverable from
+// the ui, the offending line has to be removed by hand.
+type changedHostKeyError struct {
+	host string
+	key  ssh.PublicKey
+	want knownhosts.KnownKey
+}
+
+func (e *changedHostKeyError) Error() string {
+	return fmt.Sprintf(
+		"host key for %s has changed (now %s %s), offending key in %s:%d",
+		e.host, e.key.Type(), ssh.FingerprintSHA256(e.key),
+		e.want.Filename, e.want.Line)
+}
+
+func user_known_hosts_file() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+func host_key_callback(files []string) (ssh.HostKeyCallback, error) {
+
+	// knownhosts.New fails on missing files so only pass the ones we have
+	var existing []string
+	for _, f := range files {
+		if f != "" && path_exists(f) {
+			existing = append(existing, f)
+		}
+	}
+
+	check, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var ke *knownhosts.KeyError
+		if errors.As(err, &ke) {
+			// a key of another type than those recorded is new, not changed
+			for _, want := range ke.Want {
+				if want.Key.Type() == key.Type() {
+					return &changedHostKeyError{host: hostname, key: key, want: want}
+				}
+			}
+			return &unknownHostKeyError{host: hostname, key: key}
+		}
+		return err
+	}, nil
+}
+
+// known_host_key_types are the types of the keys the known_hosts files
+// record for addr, a host:port.
+func known_host_key_types(files []string, addr string) []string {
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "22"
+	}
+
+	var types []string
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		for len(b) > 0 {
+			marker, hosts, key, _, rest, err := ssh.ParseKnownHosts(b)
+			if err != nil {
+				break
+			}
+			if marker == "" && match_known_host(hosts, host, port) {
+				types = append(types, key.Type())
+			}
+			b = rest
+		}
+	}
+
+	return unique_strings(types)
+}
+
+// trust_host_key records key for host in the known_hosts file at path,
+// creating the file and its directory when needed.
+func trust_host_key(path, host string, key ssh.PublicKey) error {
+
+	if path == "" {
+		return errors.New("no known_hosts file configured")
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(host)}, key)
+	_, err = fmt.Fprintln(f, line)
+	return err
+}
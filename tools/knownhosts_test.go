@@ -0,0 +1,246 @@
+package tools
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func test_ecdsa_signer(t *testing.T) ssh.Signer {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// hashed_line is a known_hosts line for addr hashed as HashKnownHosts does.
+func hashed_line(addr string, key ssh.PublicKey) string {
+	return knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(addr))}, key)
+}
+
+func TestKnownHostLookup(t *testing.T) {
+
+	ed := test_signer(t).PublicKey()
+	ec := test_ecdsa_signer(t).PublicKey()
+	ca := test_signer(t).PublicKey()
+
+	lines := []string{
+		"# comment",
+		knownhosts.Line([]string{"plain.example", "10.0.0.1"}, ed),
+		knownhosts.Line([]string{"[ported.example]:2222"}, ec),
+		knownhosts.Line([]string{"*.lan", "!printer.lan"}, ed),
+		hashed_line("hashed.example:22", ec),
+		hashed_line("hashed.example:2222", ed),
+		hashed_line("both.example:22", ed),
+		hashed_line("both.example:22", ec),
+		"@cert-authority *.corp " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca))),
+		"@cert-authority " + knownhosts.HashHostname("hashedca.example") + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca))),
+		"@revoked revoked.example " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ed))),
+	}
+	kh := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(kh, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	files := []string{filepath.Join(t.TempDir(), "missing"), kh}
+
+	tests := []struct {
+		addr  string
+		types string
+		ca    bool
+	}{
+		{"plain.example:22", ssh.KeyAlgoED25519, false},
+		{"plain.example", ssh.KeyAlgoED25519, false},
+		{"10.0.0.1:22", ssh.KeyAlgoED25519, false},
+		{"plain.example:2222", "", false},
+		{"ported.example:2222", ssh.KeyAlgoECDSA256, false},
+		{"ported.example:22", "", false},
+		{"nas.lan:22", ssh.KeyAlgoED25519, false},
+		{"printer.lan:22", "", false},
+		{"hashed.example:22", ssh.KeyAlgoECDSA256, false},
+		{"hashed.example", ssh.KeyAlgoECDSA256, false},
+		{"hashed.example:2222", ssh.KeyAlgoED25519, false},
+		{"both.example:22", ssh.KeyAlgoED25519 + "," + ssh.KeyAlgoECDSA256, false},
+		{"other.example:22", "", false},
+		{"web.corp:22", "", true},
+		{"hashedca.example:22", "", true},
+		{"hashedca.example:2222", "", false},
+		{"revoked.example:22", "", false},
+	}
+
+	for _, tt := range tests {
+		types := strings.Join(known_host_key_types(files, tt.addr), ",")
+		if types != tt.types {
+			t.Errorf("%s: types %q, want %q", tt.addr, types, tt.types)
+		}
+		if ca := has_host_ca(files, tt.addr); ca != tt.ca {
+			t.Errorf("%s: ca %v", tt.addr, ca)
+		}
+	}
+}
+
+func TestMatchHashedHost(t *testing.T) {
+
+	p := knownhosts.HashHostname("host.example")
+
+	tests := []struct {
+		pattern, host string
+		ok            bool
+	}{
+		{p, "host.example", true},
+		{p, "Host.example", false},
+		{p, "other.example", false},
+		{"|1|bad base64|x", "host.example", false},
+		{"|2|" + p[3:], "host.example", false},
+		{"|1|", "host.example", false},
+	}
+
+	for _, tt := range tests {
+		if ok := match_hashed_host(tt.pattern, tt.host); ok != tt.ok {
+			t.Errorf("%q %q: %v", tt.pattern, tt.host, ok)
+		}
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+
+	ed := test_signer(t).PublicKey()
+	other := test_signer(t).PublicKey()
+	ec := test_ecdsa_signer(t).PublicKey()
+
+	kh := filepath.Join(t.TempDir(), "known_hosts")
+	lines := knownhosts.Line([]string{"plain.example"}, ed) + "\n" + hashed_line("hashed.example:2222", ed) + "\n"
+	os.WriteFile(kh, []byte(lines), 0600)
+
+	check, err := host_key_callback([]string{kh, filepath.Join(t.TempDir(), "missing"), ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		key  ssh.PublicKey
+		want string // ok, unknown or changed
+	}{
+		{"plain.example:22", ed, "ok"},
+		{"plain.example:22", other, "changed"},
+		// another type than recorded is a new key, not a changed one
+		{"plain.example:22", ec, "unknown"},
+		{"plain.example:2222", ed, "unknown"},
+		{"new.example:22", ed, "unknown"},
+		{"hashed.example:2222", ed, "ok"},
+		{"hashed.example:2222", other, "changed"},
+		{"hashed.example:22", ed, "unknown"},
+	}
+
+	for _, tt := range tests {
+		remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+		err := check(tt.host, remote, tt.key)
+		var unknown *unknownHostKeyError
+		var changed *changedHostKeyError
+		got := "ok"
+		switch {
+		case errors.As(err, &unknown):
+			got = "unknown"
+		case errors.As(err, &changed):
+			got = "changed"
+			if changed.want.Filename != kh || !strings.Contains(err.Error(), "offending key in "+kh) {
+				t.Errorf("%s: %v", tt.host, err)
+			}
+		case err != nil:
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: %s, want %s", tt.host, tt.key.Type(), got, tt.want)
+		}
+	}
+}
+
+func TestTrustHostKey(t *testing.T) {
+
+	key := test_signer(t).PublicKey()
+	kh := filepath.Join(t.TempDir(), "new", "known_hosts")
+
+	for _, host := range []string{"127.0.0.1:2222", "example.com:22"} {
+		if err := trust_host_key(kh, host, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, _ := os.ReadFile(kh)
+	want := knownhosts.Line([]string{"[127.0.0.1]:2222"}, key) + "\n" + knownhosts.Line([]string{"example.com"}, key) + "\n"
+	if string(b) != want {
+		t.Errorf("got\n%s\nwant\n%s", b, want)
+	}
+	if fi, err := os.Stat(kh); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("mode", fi.Mode(), err)
+	}
+
+	check, _ := host_key_callback([]string{kh})
+	if err := check("127.0.0.1:2222", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}, key); err != nil {
+		t.Error(err)
+	}
+
+	if err := trust_host_key("", "example.com:22", key); err == nil {
+		t.Error("trusted without a file")
+	}
+}
+
+// a host with keys of two types, only one of them known and that one
+// hashed, must be asked for the one we know
+func TestConnectKnownHosts(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	ed := test_signer(t)
+	ec := test_ecdsa_signer(t)
+	config := test_server_config(t, true)
+	config.AddHostKey(ed)
+	config.AddHostKey(ec)
+	addr := listen_ssh(t, config, nil)
+
+	kh := filepath.Join(t.TempDir(), "known_hosts")
+	connect := func() error {
+		c := conn{host: "u@" + addr, password: "pw", known_hosts: []string{kh}}
+		err := c.Connect()
+		if err == nil {
+			c.close()
+		}
+		return err
+	}
+
+	// nothing known, on first use the key has to be trusted
+	err := connect()
+	var unknown *unknownHostKeyError
+	if !errors.As(err, &unknown) || unknown.host != addr {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(kh, []byte(hashed_line(addr, ec.PublicKey())+"\n"), 0600)
+	if err := connect(); err != nil {
+		t.Fatal("hashed ecdsa key:", err)
+	}
+
+	// changed, whether hashed or not
+	for _, line := range []string{hashed_line(addr, test_ecdsa_signer(t).PublicKey()), knownhosts.Line([]string{knownhosts.Normalize(addr)}, test_signer(t).PublicKey())} {
+		os.WriteFile(kh, []byte(line+"\n"), 0600)
+		var changed *changedHostKeyError
+		if err := connect(); !errors.As(err, &changed) {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+}
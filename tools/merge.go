@@ -0,0 +1,104 @@
+package tools
+
+import "strings"
+
+// merge3 merges the changes made from base to mine and from base to theirs,
+// line by line as diff3 does. Where both sides changed the same lines
+// differently the result holds both between conflict markers and ok is
+// false.
+func merge3(base, mine, theirs string) (merged string, ok bool) {
+
+	o, a, b := split_lines(base), split_lines(mine), split_lines(theirs)
+	ma, mb := match_lines(o, a), match_lines(o, b)
+
+	var sb strings.Builder
+	ok = true
+
+	lo, la, lb := 0, 0, 0
+	for lo < len(o) || la < len(a) || lb < len(b) {
+
+		// lines unchanged on both sides
+		i := 0
+		for lo+i < len(o) && ma[lo+i] == la+i && mb[lo+i] == lb+i {
+			i++
+		}
+		if i > 0 {
+			for _, l := range o[lo : lo+i] {
+				sb.WriteString(l)
+			}
+			lo, la, lb = lo+i, la+i, lb+i
+			continue
+		}
+
+		// a changed chunk runs to the next base line both sides kept
+		q := lo
+		for q < len(o) && (ma[q] < 0 || mb[q] < 0) {
+			q++
+		}
+		ea, eb := len(a), len(b)
+		if q < len(o) {
+			ea, eb = ma[q], mb[q]
+		}
+
+		co, ca, cb := o[lo:q], a[la:ea], b[lb:eb]
+		switch {
+		case equal_lines(ca, co):
+			write_lines(&sb, cb)
+		case equal_lines(cb, co), equal_lines(ca, cb):
+			write_lines(&sb, ca)
+		default:
+			ok = false
+			sb.WriteString("<<<<<<< mine\n")
+			write_conflict_lines(&sb, ca)
+			sb.WriteString("||||||| base\n")
+			write_conflict_lines(&sb, co)
+			sb.WriteString("=======\n")
+			write_conflict_lines(&sb, cb)
+			sb.WriteString(">>>>>>> remote\n")
+		}
+
+		lo, la, lb = q, ea, eb
+	}
+
+	return sb.String(), ok
+}
+
+// has_conflict_markers reports whether text still holds a conflict left by
+// merge3.
+func has_conflict_markers(text string) bool {
+	for _, l := range split_lines(text) {
+		if strings.HasPrefix(l, "<<<<<<< ") || strings.HasPrefix(l, ">>>>>>> ") {
+			return true
+		}
+	}
+	return false
+}
+
+func equal_lines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func write_lines(sb *strings.Builder, lines []string) {
+	for _, l := range lines {
+		sb.WriteString(l)
+	}
+}
+
+// write_conflict_lines makes sure the marker after the lines starts on a
+// line of its own.
+func write_conflict_lines(sb *strings.Builder, lines []string) {
+	for _, l := range lines {
+		sb.WriteString(l)
+		if !strings.HasSuffix(l, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+}
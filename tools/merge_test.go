@@ -0,0 +1,69 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+
+	base := "a\nb\nc\nd\ne\n"
+
+	tests := []struct {
+		name               string
+		base, mine, theirs string
+		want               string
+		ok                 bool
+	}{
+		{"nothing changed", base, base, base, base, true},
+		{"only mine", base, "a\nB\nc\nd\ne\n", base, "a\nB\nc\nd\ne\n", true},
+		{"only theirs", base, base, "a\nb\nc\nd\nE\n", "a\nb\nc\nd\nE\n", true},
+		{"apart", base, "a\nB\nc\nd\ne\n", "a\nb\nc\nD\ne\nf\n", "a\nB\nc\nD\ne\nf\n", true},
+		{"same change", base, "a\nX\nc\nd\ne\n", "a\nX\nc\nd\ne\n", "a\nX\nc\nd\ne\n", true},
+		{"both delete", base, "a\nc\nd\ne\n", "a\nc\nd\ne\n", "a\nc\nd\ne\n", true},
+		{"delete and edit apart", base, "b\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "b\nc\nd\nE\n", true},
+		{"theirs replaces all", base, base, "z\n", "z\n", true},
+		{"from empty", "", "x\n", "x\n", "x\n", true},
+		{"no newline at the end", "a\n", "a\nx", "y\na\n", "y\na\nx", true},
+		{"crlf kept", "a\r\nb\r\nc\r\n", "A\r\nb\r\nc\r\n", "a\r\nb\r\nC\r\n", "A\r\nb\r\nC\r\n", true},
+		// as with diff3, changes to neighbouring lines conflict
+		{"neighbours", "a\nb\n", "A\nb\n", "a\nB\n",
+			"<<<<<<< mine\nA\nb\n||||||| base\na\nb\n=======\na\nB\n>>>>>>> remote\n", false},
+		{"conflict", base, "a\nX\nc\nd\ne\n", "a\nY\nc\nd\ne\n",
+			"a\n<<<<<<< mine\nX\n||||||| base\nb\n=======\nY\n>>>>>>> remote\nc\nd\ne\n", false},
+		{"conflict without newlines", "a", "b", "c",
+			"<<<<<<< mine\nb\n||||||| base\na\n=======\nc\n>>>>>>> remote\n", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := merge3(tt.base, tt.mine, tt.theirs)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %v %q, want %v %q", tt.name, ok, got, tt.ok, tt.want)
+		}
+		if has_conflict_markers(got) == tt.ok {
+			t.Errorf("%s: conflict markers %v with ok %v", tt.name, has_conflict_markers(got), ok)
+		}
+	}
+}
+
+// merging with an unchanged side gives the other side back, whatever it is
+func TestMerge3OneSided(t *testing.T) {
+
+	texts := []string{
+		"", "a\n", "a\nb\n", "b\na\n", "a\na\na\n", "x\ny\nz", "a\nb\nc\nd\ne\nf\ng\n", "g\nf\na\nd\nc\n",
+	}
+	for _, base := range texts {
+		for _, other := range texts {
+			if got, ok := merge3(base, base, other); !ok || got != other {
+				t.Errorf("%q -> theirs %q: got %v %q", base, other, ok, got)
+			}
+			if got, ok := merge3(base, other, base); !ok || got != other {
+				t.Errorf("%q -> mine %q: got %v %q", base, other, ok, got)
+			}
+		}
+	}
+
+	if has_conflict_markers(strings.Repeat("<<<<<<<\n", 2)) {
+		t.Error("markers without the side name")
+	}
+}
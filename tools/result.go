@@ -0,0 +1,172 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JobResult is how a remote command went: what it wrote, how it exited and
+// how long it took.
+type JobResult struct {
+	Cmd      string
+	Stdout   string // empty when the output was passed on as it came
+	Stderr   string // the last defaultLines lines
+	ExitCode int    // -1 when the command did not exit by itself
+	Signal   string // the signal it was killed by, without SIG
+	Start    time.Time
+	Duration time.Duration
+	Err      error // nil when the command exited 0
+}
+
+// summary describes how the command ended for the status line.
+func (r *JobResult) summary() string {
+
+	took := r.Duration.Round(10 * time.Millisecond)
+	at := r.Start.Format("15:04:05")
+
+	switch {
+	case r.Signal != "":
+		return fmt.Sprintf("killed by SIG%s after %s, started %s", r.Signal, took, at)
+	case r.ExitCode >= 0:
+		return fmt.Sprintf("exit %d after %s, started %s", r.ExitCode, took, at)
+	}
+	return fmt.Sprintf("%s after %s, started %s", r.Err, took, at)
+}
+
+// error is Err with the last of what the command wrote to stderr, which
+// says why where the exit status does not, nil when it exited 0.
+func (r *JobResult) error() error {
+	if r.Err == nil {
+		return nil
+	}
+	msg := strings.TrimSpace(r.Stderr)
+	if msg == "" {
+		return r.Err
+	}
+	if i := strings.LastIndex(msg, "\n"); i >= 0 {
+		msg = msg[i+1:]
+	}
+	return fmt.Errorf("%w: %s", r.Err, msg)
+}
+
+// script runs a command of our own, such as the steps of a save, failing
+// with what it wrote to stderr.
+func (c *conn) script(text string) error {
+	return c.run_job(context.Background(), text, nil).error()
+}
+
+// finish records how the command ended, from the error its session gave.
+func (r *JobResult) finish(ctx context.Context, err error) *JobResult {
+
+	r.Duration = time.Since(r.Start)
+	r.Err = cancelled(ctx, err)
+
+	var exit *ssh.ExitError
+	switch {
+	case err == nil:
+		r.ExitCode = 0
+	case errors.As(err, &exit):
+		r.ExitCode = exit.ExitStatus()
+		r.Signal = exit.Signal()
+	}
+
+	return r
+}
+
+// run_job runs the command and returns how it went, stopping it when ctx
+// is done. Its output is kept in the result, or passed to stdout a line at
+// a time as it comes when stdout is set.
+func (c *conn) run_job(ctx context.Context, text string, stdout func(line string)) *JobResult {
+
+	r := &JobResult{Cmd: text, ExitCode: -1, Start: time.Now()}
+
+	if !c.isConnected() {
+		err := c.Connect()
+		if err != nil {
+			return r.finish(ctx, err)
+		}
+	}
+
+	sess, err := c.new_session()
+	if err != nil {
+		return r.finish(ctx, err)
+	}
+
+	defer sess.Close()
+	defer cancel_on_done(ctx, sess)()
+
+	stderr := new_line_buffer(defaultLines)
+	errR, errW := io.Pipe()
+	sess.Stderr = errW
+	errDone := make(chan struct{})
+	go func() {
+		scan_lines(errR, stderr.add)
+		close(errDone)
+	}()
+
+	var out bytes.Buffer
+	outR, outW := io.Pipe()
+	sess.Stdout = &out
+	if stdout != nil {
+		sess.Stdout = outW
+	}
+
+	err = sess.Start(text)
+	if err != nil {
+		errW.Close()
+		return r.finish(ctx, err)
+	}
+
+	waited := make(chan error, 1)
+	go func() {
+		err := sess.Wait()
+		outW.Close()
+		errW.Close()
+		waited <- err
+	}()
+
+	if stdout != nil {
+		scan_lines(outR, stdout)
+	}
+	err = <-waited
+	<-errDone
+
+	r.Stdout = out.String()
+	r.Stderr, _, _ = stderr.take()
+
+	return r.finish(ctx, err)
+}
+
+// lines longer than this are passed on in pieces
+const maxLine = 1024 * 1024
+
+// scan_lines passes on each line read from r, splitting lines longer than
+// maxLine rather than holding them whole.
+func scan_lines(r *io.PipeReader, line func(string)) {
+	defer r.Close()
+	br := bufio.NewReaderSize(r, 64*1024)
+	var long []byte
+	for {
+		b, more, err := br.ReadLine()
+		if err != nil {
+			if len(long) > 0 {
+				line(string(long))
+			}
+			return
+		}
+		long = append(long, b...)
+		if more && len(long) < maxLine {
+			continue
+		}
+		line(string(long))
+		long = long[:0]
+	}
+}
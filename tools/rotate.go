@@ -0,0 +1,322 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Key rotation replaces our key on every configured host: a new key pair is
+// generated next to the current one as "<key>.new", then installed and
+// checked on each host. Only once every host takes the new key is the old
+// key archived, the new one moved into its place and the old public key
+// removed from the hosts. If a host fails both keys stay everywhere, so
+// rotating again picks up the same new key and retries.
+
+type rotateResult struct {
+	host    string
+	step    string // the step that failed
+	err     error
+	removed int // lines of the old key removed
+}
+
+// remove_key_cmd removes every line with key, whatever its options and
+// comment, from the authorized_keys files, keeping their mode and owner.
+// It prints the number of lines removed.
+func remove_key_cmd(key string, files []string) string {
+	var sb strings.Builder
+	sb.WriteString(key_script(key, files))
+	sb.WriteString("n=0; for f; do ")
+	sb.WriteString("[ -f \"$f\" ] && grep -qF \"$m\" \"$f\" || continue; ")
+	sb.WriteString("c=$(grep -cF \"$m\" \"$f\"); ")
+	sb.WriteString("t=$(mktemp) || exit 1; ")
+	sb.WriteString("grep -vF \"$m\" \"$f\" > \"$t\"; ")
+	sb.WriteString("cat \"$t\" > \"$f\"; r=$?; rm -f \"$t\"; [ $r = 0 ] || exit 1; ")
+	sb.WriteString("n=$((n+c)); ")
+	sb.WriteString("done; echo $n")
+	return sb.String()
+}
+
+// rotate_key rotates key, the private key file, on every host of config,
+// connecting with password where keys are not enough. The new key is of
+// type t and size bits, without t it is like the old one. It returns a
+// result per host and, when all hosts were rotated, where the old key went.
+// Once ctx is done no more hosts are started. ask is asked for the new
+// key's passphrase, see new_passphrase.
+func rotate_key(ctx context.Context, config *Config, key, t string, bits int, password string,
+	ask func(file string) ([]byte, error)) ([]rotateResult, string, error) {
+
+	newKey := key + ".new"
+
+	oldKeys, err := get_keys(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if oldKeys.public_key == "" {
+		return nil, "", errors.New("no public key for " + key)
+	}
+
+	// a new key left by an earlier rotation that failed somewhere is kept,
+	// hosts that got it already accept it
+	if !path_exists(newKey) {
+		if t == "" {
+			old, _, _, _, err := ssh.ParseAuthorizedKey([]byte(oldKeys.public_key))
+			if err != nil {
+				return nil, "", fmt.Errorf("bad public key for %s: %w", key, err)
+			}
+			t, bits = key_type_of(old)
+		}
+		passphrase, err := new_passphrase(ask, newKey, t)
+		if err != nil {
+			return nil, "", err
+		}
+		err = generate_key(newKey, t, bits, passphrase)
+		if err != nil {
+			return nil, "", fmt.Errorf("generating key: %w", err)
+		}
+	}
+
+	// the new key goes on every host while the old one still works
+	var results []rotateResult
+	failed := false
+	for _, host := range config.HostNames() {
+		// the empty host is the template for new hosts
+		if host == "" {
+			continue
+		}
+		r := rotateResult{host: host}
+		if ctx.Err() != nil {
+			r.step, r.err = "start", ctx.Err()
+		} else {
+			r = add_new_key(config, host, key, newKey, password)
+		}
+		if r.err != nil {
+			failed = true
+		}
+		results = append(results, r)
+	}
+
+	if failed {
+		return results, "", nil
+	}
+
+	archive, err := promote_key(key, newKey, config.KeyRecordFile())
+	if err != nil {
+		return results, "", err
+	}
+	forget_passphrase(key)
+	if p := cached_passphrase(newKey); p != nil {
+		cache_passphrase(key, p)
+	}
+
+	// only now does the old key go, the new one being in place and taken
+	// by every host. a host failing here keeps both keys.
+	for i := range results {
+		results[i] = remove_old_key(config, results[i], key, archive, oldKeys.public_key, password)
+	}
+
+	return results, archive, nil
+}
+
+// add_new_key installs newKey on host and checks that it logs in.
+func add_new_key(config *Config, host, key, newKey, password string) rotateResult {
+
+	r := rotateResult{host: host}
+	h := config.Hosts[host]
+
+	c := conn{}
+	c.configure(config, host)
+	c.password = password
+	defer c.close()
+
+	// log in with the old key, or the new one if this host got it already
+	c.key = key
+	r.err = c.Connect()
+	if r.err != nil {
+		c.key = newKey
+		if c.Connect() == nil {
+			r.err = nil
+		}
+	}
+	if r.err != nil {
+		r.step = "connect"
+		return r
+	}
+
+	_, r.err = c.install_key(newKey, h.AuthorizedKeys, config.KeyRecordFile())
+	if r.err != nil {
+		r.step = "install new key"
+		return r
+	}
+
+	r.err = verify_key(config, host, newKey)
+	if r.err != nil {
+		r.step = "log in with new key"
+	}
+
+	return r
+}
+
+// remove_old_key removes oldPublic, archived as archive, from the host of r
+// logging in with key, the new key now.
+func remove_old_key(config *Config, r rotateResult, key, archive, oldPublic, password string) rotateResult {
+
+	h := config.Hosts[r.host]
+
+	c := conn{}
+	c.configure(config, r.host)
+	c.password = password
+	c.key = key
+	defer c.close()
+
+	r.err = c.Connect()
+	if r.err != nil {
+		r.step = "connect with new key"
+		return r
+	}
+
+	// the old key goes from every file it was recorded in as well, ""
+	// stands for the default file, see key_script
+	files := append([]string(nil), h.AuthorizedKeys...)
+	if len(files) == 0 {
+		files = []string{""}
+	}
+	records, _ := load_key_records(config.KeyRecordFile())
+	for _, rec := range records {
+		if rec.Host == c.host && rec.Key == archive {
+			files = append(files, rec.File)
+		}
+	}
+	for _, f := range unique_strings(files) {
+		var fs []string
+		if f != "" {
+			fs = []string{f}
+		}
+		var out string
+		out, r.err = c.output(remove_key_cmd(oldPublic, fs))
+		if r.err != nil {
+			r.step = "remove old key"
+			return r
+		}
+		n := 0
+		fmt.Sscan(strings.TrimSpace(out), &n)
+		r.removed += n
+	}
+
+	r.err = forget_key_records(config.KeyRecordFile(), c.host, archive)
+	if r.err != nil {
+		r.step = "update key records"
+	}
+
+	return r
+}
+
+// promote_key archives key and its public half with a timestamp and moves
+// newKey into its place. Records of both keys are updated to their new
+// names. Returns the archived private key file.
+func promote_key(key, newKey, records string) (string, error) {
+
+	archive := key + "." + time.Now().Format(backupTimeFormat) + ".old"
+
+	for _, suffix := range []string{"", ".pub"} {
+		if !path_exists(key + suffix) {
+			continue
+		}
+		err := os.Rename(key+suffix, archive+suffix)
+		if err != nil {
+			return "", fmt.Errorf("archiving old key: %w", err)
+		}
+	}
+	for _, suffix := range []string{"", ".pub"} {
+		err := os.Rename(newKey+suffix, key+suffix)
+		if err != nil {
+			return archive, fmt.Errorf("moving new key in place: %w", err)
+		}
+	}
+
+	recs, err := load_key_records(records)
+	if err != nil || len(recs) == 0 {
+		return archive, err
+	}
+	for i := range recs {
+		switch recs[i].Key {
+		case key:
+			recs[i].Key = archive
+		case newKey:
+			recs[i].Key = key
+		}
+	}
+
+	return archive, save_key_records(records, recs)
+}
+
+// forget_key_records drops the records of key on host.
+func forget_key_records(records, host, key string) error {
+
+	recs, err := load_key_records(records)
+	if err != nil || len(recs) == 0 {
+		return err
+	}
+
+	var kept []keyRecord
+	for _, rec := range recs {
+		if rec.Host != host || rec.Key != key {
+			kept = append(kept, rec)
+		}
+	}
+	if len(kept) == len(recs) {
+		return nil
+	}
+
+	return save_key_records(records, kept)
+}
+
+func unique_strings(a []string) []string {
+	seen := map[string]bool{}
+	var r []string
+	for _, s := range a {
+		if !seen[s] {
+			seen[s] = true
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+// rotate_report formats the results of rotate_key, a line per host.
+func rotate_report(key string, results []rotateResult, archive string) string {
+
+	var sb strings.Builder
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			failed++
+			fmt.Fprintf(&sb, "%-30s failed to %s: %s\n", r.host, r.step, r.err)
+		case archive == "":
+			fmt.Fprintf(&sb, "%-30s has the new key, the old key is kept for now\n", r.host)
+		default:
+			fmt.Fprintf(&sb, "%-30s rotated, %d old key lines removed\n", r.host, r.removed)
+		}
+	}
+
+	sb.WriteString("\n")
+	switch {
+	case failed > 0 && archive == "":
+		fmt.Fprintf(&sb, "%d of %d hosts failed to take the new key, both keys are kept on every host.\n"+
+			"%s is still in use and the new key stays in %s.new, rotate again to retry\n",
+			failed, len(results), key, key)
+	case failed > 0:
+		fmt.Fprintf(&sb, "the new key is in place as %s and the old key is archived as %s,\n"+
+			"it could not be removed from %d of %d hosts\n", key, archive, failed, len(results))
+	case archive != "":
+		fmt.Fprintf(&sb, "all %d hosts rotated, the old key is archived as %s\n", len(results), archive)
+	}
+
+	return sb.String()
+}
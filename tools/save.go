@@ -0,0 +1,271 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Remote files are saved by uploading next to the target and renaming over
+// it, so a dropped connection never leaves a half written file behind. The
+// version being replaced is kept as "<file>.<timestamp>~", a name tools that
+// read whole directories such as dnsmasq's conf-dir skip.
+
+// backups kept by default when the job does not set "backups"
+const defaultBackups = 1
+
+const backupTimeFormat = "20060102T150405"
+
+// backup_count is the number of backups to keep for a job, from its
+// "backups" setting.
+func backup_count(job map[string]string) int {
+	n, err := strconv.Atoi(job["backups"])
+	if err != nil || n < 0 {
+		return defaultBackups
+	}
+	return n
+}
+
+// job_rollback reports whether a job's "rollback" setting asks for the
+// previous content to be put back when its command fails after a save.
+func job_rollback(job map[string]string) bool {
+	b, _ := strconv.ParseBool(job["rollback"])
+	return b
+}
+
+// temp_path is where content is uploaded before replacing remotePath.
+func temp_path(remotePath string) string {
+	dir, name := path.Split(remotePath)
+	return dir + "." + name + ".ssh-tools.tmp"
+}
+
+// validationError is returned by save_content when the job's validate
+// command rejected the new content, the remote file is left untouched.
+type validationError struct {
+	cmd    string
+	err    error
+	result *JobResult
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("validation \"%s\" failed: %s", e.cmd, e.result.error())
+}
+
+func (e *validationError) Unwrap() error {
+	return e.err
+}
+
+// commandError is returned by save_job when the file was saved but the
+// job's command failed afterwards.
+type commandError struct {
+	file, cmd   string
+	err         error
+	rolledBack  bool       // the previous content was put back
+	rollbackErr error      // putting the previous content back failed
+	result      *JobResult // how the command went
+	retry       *JobResult // how it went again after rolling back
+}
+
+func (e *commandError) Error() string {
+	why := e.result.error()
+	switch {
+	case e.rollbackErr != nil:
+		return fmt.Sprintf(
+			"failed running \"%s\" (%s) and could not roll back \"%s\": %s",
+			e.cmd, why, e.file, e.rollbackErr)
+	case e.rolledBack && e.retry.Err != nil:
+		return fmt.Sprintf(
+			"failed running \"%s\" (%s), rolled back \"%s\" but \"%s\" failed again: %s, %s",
+			e.cmd, why, e.file, e.cmd, e.retry.error(), e.retry.summary())
+	case e.rolledBack:
+		return fmt.Sprintf(
+			"failed running \"%s\" (%s), rolled back \"%s\" and ran \"%s\" again, %s",
+			e.cmd, why, e.file, e.cmd, e.retry.summary())
+	}
+	return fmt.Sprintf("saved \"%s\" but failed running \"%s\": %s", e.file, e.cmd, why)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// save_job saves text to the job's file and runs the job's command,
+// returning how the command went, nil when there is none, or how the
+// validate command went when it rejected text. When the command
+// fails and the job asks for rollback, previous is put back and the command
+// run again.
+func (c *conn) save_job(job map[string]string, text, previous string) (*JobResult, error) {
+
+	file := job["file"]
+
+	err := c.save_content(text, file, backup_count(job), job["validate"])
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		return invalid.result, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := job["cmd"]
+	if cmd == "" {
+		return nil, nil
+	}
+
+	// a save is not cancelled part way
+	res := c.run_job(context.Background(), cmd, nil)
+	if res.Err == nil {
+		return res, nil
+	}
+
+	failed := &commandError{file: file, cmd: cmd, err: res.Err, result: res}
+	if !job_rollback(job) {
+		return res, failed
+	}
+
+	failed.rollbackErr = c.save_content(previous, file, -1, "")
+	if failed.rollbackErr != nil {
+		return res, failed
+	}
+	failed.rolledBack = true
+	failed.retry = c.run_job(context.Background(), cmd, nil)
+
+	return res, failed
+}
+
+// save_content replaces remotePath with text, keeping its mode and owner,
+// and keeps the previous version as a backup, pruning all but the newest
+// backups of them. A negative count makes no backup and prunes none.
+//
+// When validate is set it is run once the text is uploaded and before it
+// replaces the file, with $FILE naming the uploaded copy, eg nft -c -f "$FILE".
+func (c *conn) save_content(text, remotePath string, backups int, validate string) error {
+
+	tmp := temp_path(remotePath)
+
+	kept, err := c.set_temp_content(text, tmp, remotePath)
+	if err != nil {
+		return err
+	}
+
+	if validate != "" {
+		res := c.run_job(context.Background(), "FILE="+shell_quote(tmp)+"; "+validate, nil)
+		if res.Err != nil {
+			_ = c.script("rm -f " + shell_quote(tmp))
+			return &validationError{cmd: validate, err: res.Err, result: res}
+		}
+	}
+
+	backup := remotePath + "." + time.Now().Format(backupTimeFormat) + "~"
+
+	return c.script(save_script(remotePath, tmp, backup, backups, kept))
+}
+
+// save_script moves tmp over remotePath, first copying remotePath to backup
+// when backups is positive. Unless kept, tmp is given the file's mode and
+// owner and flushed first. Nothing is replaced when any step fails.
+func save_script(remotePath, tmp, backup string, backups int, kept bool) string {
+
+	var sb strings.Builder
+	sb.WriteString("f=" + shell_quote(remotePath) + "; ")
+	sb.WriteString("t=" + shell_quote(tmp) + "; ")
+	sb.WriteString("b=" + shell_quote(backup) + "; ")
+	sb.WriteString("n=" + strconv.Itoa(backups) + "; ")
+	sb.WriteString("if [ -e \"$f\" ]; then ")
+	if !kept {
+		sb.WriteString(keep_mode_cmd() + " && ")
+	}
+	sb.WriteString("{ [ \"$n\" -le 0 ] || cp -p \"$f\" \"$b\"; }; ")
+	sb.WriteString("fi && ")
+	if !kept {
+		sb.WriteString(fsync_cmd() + " && ")
+	}
+	sb.WriteString("mv -f \"$t\" \"$f\" || { rm -f \"$t\"; exit 1; }; ")
+	sb.WriteString("[ \"$n\" -lt 0 ] || { " + prune_backups_cmd() + "; }")
+
+	return sb.String()
+}
+
+// lsModeAwk turns a line of ls -ln into the octal mode and uid:gid.
+const lsModeAwk = `{ p = $1; m = 0; s = 0
+for (i = 2; i <= 10; i++) { c = substr(p, i, 1); m = m * 2 + (c != "-" && c != "S" && c != "T") }
+if (substr(p, 4, 1) ~ /[sS]/) s += 4
+if (substr(p, 7, 1) ~ /[sS]/) s += 2
+if (substr(p, 10, 1) ~ /[tT]/) s += 1
+printf "%o%03o %s:%s\n", s, m, $3, $4 }`
+
+// keep_mode_cmd gives $t the mode and owner of $f, with ls as stat -c is
+// GNU only. chown only works for root and goes first as it clears the
+// setuid bits.
+func keep_mode_cmd() string {
+	var sb strings.Builder
+	sb.WriteString("o=$(ls -ln \"$f\" | awk '" + lsModeAwk + "') && ")
+	sb.WriteString("{ chown \"${o#* }\" \"$t\" 2>/dev/null || true; } && ")
+	sb.WriteString("chmod \"${o% *}\" \"$t\"")
+	return sb.String()
+}
+
+// fsync_cmd flushes $t to disk before it is renamed into place, where dd
+// knows how. A bare sync would flush every file on the host.
+func fsync_cmd() string {
+	return "{ dd if=/dev/null of=\"$t\" conv=notrunc,fsync 2>/dev/null || true; }"
+}
+
+// prune_backups_cmd removes all but the newest $n backups of $f.
+func prune_backups_cmd() string {
+	var sb strings.Builder
+	sb.WriteString("ls -1d \"$f\".[0-9]*T[0-9]*~ 2>/dev/null | sort -r | ")
+	sb.WriteString("tail -n +$((n+1)) | while read -r o; do rm -f \"$o\"; done")
+	return sb.String()
+}
+
+// list_backups returns the backups of remotePath, newest first.
+func (c *conn) list_backups(remotePath string) ([]string, error) {
+
+	out, err := c.output(
+		"ls -1d " + shell_quote(remotePath) + ".[0-9]*T[0-9]*~ 2>/dev/null | sort -r; true")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, l := range strings.Split(out, "\n") {
+		if l != "" {
+			backups = append(backups, l)
+		}
+	}
+
+	return backups, nil
+}
+
+// restore_backup puts the newest backup of remotePath back in its place,
+// the same way save_content replaces the file. The backup is used up so
+// restoring again goes back another version.
+func (c *conn) restore_backup(remotePath string) (string, error) {
+
+	backups, err := c.list_backups(remotePath)
+	if err != nil {
+		return "", err
+	}
+	if len(backups) == 0 {
+		return "", errors.New("no backup of " + remotePath)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("f=" + shell_quote(remotePath) + "; ")
+	sb.WriteString("t=" + shell_quote(temp_path(remotePath)) + "; ")
+	sb.WriteString("b=" + shell_quote(backups[0]) + "; ")
+	sb.WriteString("cp -p \"$b\" \"$t\" && " + fsync_cmd() + " && mv -f \"$t\" \"$f\" && rm -f \"$b\" ")
+	sb.WriteString("|| { rm -f \"$t\"; exit 1; }")
+
+	err = c.script(sb.String())
+	if err != nil {
+		return "", fmt.Errorf("restoring %s: %w", backups[0], err)
+	}
+
+	return backups[0], nil
+}
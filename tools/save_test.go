@@ -0,0 +1,226 @@
+package tools
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the save script is run here with sh on local files, with commands made
+// to fail by putting failing ones first on the PATH
+func TestSaveScript(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		exists   bool
+		backups  int
+		kept     bool
+		failing  string // a command that fails
+		ok       bool
+		mode     os.FileMode
+		nBackups int
+	}{
+		{"new file", false, 3, false, "", true, 0600, 0},
+		{"replaced", true, 3, false, "", true, 0640, 3},
+		{"replaced, mode kept by the transport", true, 3, true, "", true, 0600, 3},
+		{"old backups pruned", true, 2, false, "", true, 0640, 2},
+		{"no backups", true, 0, false, "", true, 0640, 0},
+		{"no backups and none pruned", true, -1, false, "", true, 0640, 2},
+		{"backup fails", true, 3, false, "cp", false, 0640, 2},
+		{"backup fails, mode kept by the transport", true, 3, true, "cp", false, 0640, 2},
+		{"mode not kept", true, 3, false, "chmod", false, 0640, 2},
+		{"mode not read", true, 3, false, "awk", false, 0640, 2},
+		// the backup is made, of the file left as it was
+		{"not moved", true, 3, false, "mv", false, 0640, 3},
+		// nothing to back up, so nothing to fail
+		{"no backups, cp fails", true, 0, false, "cp", true, 0640, 0},
+	}
+
+	for _, tt := range tests {
+
+		dir := t.TempDir()
+		f := filepath.Join(dir, "it's a file")
+		tmp := temp_path(f)
+		os.WriteFile(tmp, []byte("new"), 0600)
+		if tt.exists {
+			os.WriteFile(f, []byte("old"), 0640)
+			os.Chmod(f, 0640)
+			// backups of earlier saves, to be pruned past backups
+			os.WriteFile(f+".20200101T000000~", nil, 0600)
+			os.WriteFile(f+".20210101T000000~", nil, 0600)
+		}
+
+		bin := t.TempDir()
+		if tt.failing != "" {
+			os.WriteFile(filepath.Join(bin, tt.failing), []byte("#!/bin/sh\nexit 1\n"), 0755)
+		}
+
+		cmd := exec.Command("sh", "-c", save_script(f, tmp, f+".20220101T000000~", tt.backups, tt.kept))
+		cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"))
+		out, err := cmd.CombinedOutput()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v %s", tt.name, err, out)
+		}
+
+		b, _ := os.ReadFile(f)
+		want := "new"
+		if !tt.ok {
+			want = "old"
+		}
+		if string(b) != want {
+			t.Errorf("%s: file has %q, want %q", tt.name, b, want)
+		}
+		if fi, err := os.Stat(f); err == nil && fi.Mode().Perm() != tt.mode {
+			t.Errorf("%s: mode %v, want %v", tt.name, fi.Mode().Perm(), tt.mode)
+		}
+		if tt.ok && path_exists(tmp) {
+			t.Errorf("%s: temp file left", tt.name)
+		}
+
+		backups, _ := filepath.Glob(f + ".*~")
+		if len(backups) != tt.nBackups {
+			t.Errorf("%s: backups %q", tt.name, backups)
+		}
+		if tt.ok && tt.backups > 0 && tt.exists {
+			b, _ := os.ReadFile(f + ".20220101T000000~")
+			if string(b) != "old" {
+				t.Errorf("%s: backup has %q", tt.name, b)
+			}
+		}
+	}
+}
+
+func TestSaveContent(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	c := exec_host(t, filepath.Join(t.TempDir(), "known_hosts"), nil)
+	defer c.close()
+
+	dir := t.TempDir()
+	f := filepath.Join(dir, "dnsmasq.conf")
+	os.WriteFile(f, []byte("v1\n"), 0600)
+	os.Chmod(f, 0750|os.ModeSetgid)
+	// a backup from an earlier save
+	os.WriteFile(f+".20200101T000000~", []byte("v0\n"), 0600)
+
+	if err := c.save_content("v2\n", f, 2, ""); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(f)
+	fi, _ := os.Stat(f)
+	if string(b) != "v2\n" || fi.Mode()&(os.ModePerm|os.ModeSetgid) != 0750|os.ModeSetgid {
+		t.Fatalf("saved %q, mode %v", b, fi.Mode())
+	}
+	if path_exists(temp_path(f)) {
+		t.Error("temp file left")
+	}
+
+	backups, err := c.list_backups(f)
+	if err != nil || len(backups) != 2 || backups[1] != f+".20200101T000000~" {
+		t.Fatal(backups, err)
+	}
+
+	// restoring goes back a version at a time, using the backups up
+	for _, want := range []string{"v1\n", "v0\n"} {
+		restored, err := c.restore_backup(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := os.ReadFile(f); string(b) != want || path_exists(restored) {
+			t.Errorf("restored %q from %s", b, restored)
+		}
+	}
+	if _, err := c.restore_backup(f); err == nil || !strings.Contains(err.Error(), "no backup of") {
+		t.Error(err)
+	}
+
+	// a new file has nothing to back up
+	n := filepath.Join(dir, "new")
+	if err := c.save_content("x", n, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if backups, _ := c.list_backups(n); len(backups) != 0 {
+		t.Error(backups)
+	}
+}
+
+func TestSaveJob(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	c := exec_host(t, filepath.Join(t.TempDir(), "known_hosts"), nil)
+	defer c.close()
+
+	tests := []struct {
+		name       string
+		job        map[string]string // the file is set for each
+		text       string
+		content    string // of the file afterwards
+		res        string // how the command that ran last went, or none
+		errHas     string
+		rolledBack bool
+	}{
+		{"no command", map[string]string{}, "good new\n", "good new\n", "none", "", false},
+		{"command runs", map[string]string{"cmd": `grep -q good "$F"`}, "good new\n", "good new\n", "exit 0", "", false},
+		{"valid", map[string]string{"validate": `grep -q good "$FILE"`}, "good new\n", "good new\n", "none", "", false},
+		{"not valid", map[string]string{"validate": `grep good "$FILE" || { echo no good >&2; exit 3; }`, "cmd": "true"},
+			"bad\n", "good old\n", "exit 3", `validation "grep good`, false},
+		{"command fails", map[string]string{"cmd": `grep -q good "$F"`}, "bad\n", "bad\n", "exit 1",
+			"saved \"$F\" but failed running", false},
+		{"rolled back", map[string]string{"cmd": `grep -q good "$F"`, "rollback": "true"}, "bad\n", "good old\n", "exit 1",
+			"rolled back \"$F\" and ran", true},
+		{"fails again after rolling back", map[string]string{"cmd": "echo broken >&2; false", "rollback": "true"}, "good new\n", "good old\n", "exit 1",
+			"failed again: Process exited with status 1: broken", true},
+		{"could not roll back", map[string]string{"cmd": `rm -rf "$D"; false`, "rollback": "true"}, "good new\n", "", "exit 1",
+			"could not roll back", false},
+	}
+
+	for _, tt := range tests {
+
+		dir := t.TempDir()
+		f := filepath.Join(dir, "f.conf")
+		os.WriteFile(f, []byte("good old\n"), 0644)
+		expand := strings.NewReplacer("$F", f, "$D", dir).Replace
+
+		job := map[string]string{"file": f}
+		for k, v := range tt.job {
+			job[k] = v
+			if k == "cmd" {
+				job[k] = expand(v)
+			}
+		}
+
+		res, err := c.save_job(job, tt.text, "good old\n")
+
+		got := "none"
+		if res != nil {
+			got = "exit " + strconv.Itoa(res.ExitCode)
+		}
+		if got != tt.res {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.res)
+		}
+		if (err == nil) != (tt.errHas == "") || err != nil && !strings.Contains(err.Error(), expand(tt.errHas)) {
+			t.Errorf("%s: %v, want %q", tt.name, err, expand(tt.errHas))
+		}
+
+		var failed *commandError
+		if errors.As(err, &failed) && failed.rolledBack != tt.rolledBack {
+			t.Errorf("%s: rolled back %v", tt.name, failed.rolledBack)
+		}
+		if b, _ := os.ReadFile(f); string(b) != tt.content {
+			t.Errorf("%s: file has %q, want %q", tt.name, b, tt.content)
+		}
+		if path_exists(temp_path(f)) {
+			t.Errorf("%s: temp file left", tt.name)
+		}
+	}
+}
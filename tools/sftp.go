@@ -0,0 +1,409 @@
+package tools
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A small client for version 3 of the sftp protocol, enough to read and
+// write single files. Requests are sent one at a time.
+
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpFsetstat = 10
+	sshFxpStat     = 17
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpAttrs    = 105
+	sshFxpExtended = 200
+
+	sshFxfRead                 = 0x01
+	sshFxfWrite                = 0x02
+	sshFxfCreat                = 0x08
+	sshFxfTrunc                = 0x10
+	sshFilexferAttrSize        = 0x01
+	sshFilexferAttrUidgid      = 0x02
+	sshFilexferAttrPermissions = 0x04
+	sshFilexferAttrAcmodtime   = 0x08
+
+	sshFxOk         = 0
+	sshFxEOF        = 1
+	sshFxNoSuchFile = 2
+	sshFxPermission = 3
+
+	// stay well under the 32k most servers accept
+	sftpChunk = 32*1024 - 1024
+)
+
+// errTransportUnavailable is returned when the remote does not offer a
+// transport at all, as opposed to the transfer itself failing.
+var errTransportUnavailable = errors.New("transport not available")
+
+type sftpStatusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (%d)", e.msg, e.code)
+}
+
+func (e *sftpStatusError) Is(target error) bool {
+	switch e.code {
+	case sshFxNoSuchFile:
+		return target == os.ErrNotExist
+	case sshFxPermission:
+		return target == os.ErrPermission
+	case sshFxEOF:
+		return target == io.EOF
+	}
+	return false
+}
+
+type sftpAttrs struct {
+	flags uint32
+	size  uint64
+	uid   uint32
+	gid   uint32
+	perms uint32
+	atime uint32
+	mtime uint32
+}
+
+type sftpClient struct {
+	sess *ssh.Session
+	w    io.WriteCloser
+	r    io.Reader
+	id   uint32
+	exts map[string]string
+	stop func() // stops the session being closed on cancel, see conn.sftp
+}
+
+func new_sftp_client(sess *ssh.Session) (*sftpClient, error) {
+
+	w, err := sess.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := sess.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = sess.RequestSubsystem("sftp")
+	if err != nil {
+		return nil, fmt.Errorf("sftp: %w", errTransportUnavailable)
+	}
+
+	s := &sftpClient{sess: sess, w: w, r: r, exts: map[string]string{}}
+
+	// a host can take the subsystem with no sftp-server to run it, the
+	// session then ends before the version comes back
+	unavailable := func(why interface{}) error {
+		return fmt.Errorf("sftp: %w (%v)", errTransportUnavailable, why)
+	}
+
+	// init carries no request id
+	err = s.send(sshFxpInit, ssh_u32(3))
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	typ, data, err := s.recv()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	if typ != sshFxpVersion || len(data) < 4 {
+		return nil, unavailable(fmt.Sprintf("unexpected reply %d to init", typ))
+	}
+	data = data[4:]
+	for len(data) > 0 {
+		var name, value string
+		name, data = take_string(data)
+		value, data = take_string(data)
+		s.exts[name] = value
+	}
+
+	return s, nil
+}
+
+func (s *sftpClient) Close() error {
+	if s.stop != nil {
+		s.stop()
+	}
+	s.w.Close()
+	return s.sess.Close()
+}
+
+func (s *sftpClient) send(typ byte, payload []byte) error {
+	b := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(1+len(payload)))
+	b[4] = typ
+	_, err := s.w.Write(append(b, payload...))
+	return err
+}
+
+func (s *sftpClient) recv() (byte, []byte, error) {
+	h := make([]byte, 5)
+	_, err := io.ReadFull(s.r, h)
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(h)
+	if n < 1 || n > 256*1024 {
+		return 0, nil, fmt.Errorf("sftp: bad packet length %d", n)
+	}
+	data := make([]byte, n-1)
+	_, err = io.ReadFull(s.r, data)
+	return h[4], data, err
+}
+
+// request sends a packet with a fresh id and returns the reply, status
+// replies other than ok come back as errors.
+func (s *sftpClient) request(typ byte, payload ...[]byte) (byte, []byte, error) {
+
+	s.id++
+	b := ssh_u32(s.id)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+
+	err := s.send(typ, b)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rtyp, data, err := s.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != s.id {
+		return 0, nil, errors.New("sftp: reply out of sequence")
+	}
+	data = data[4:]
+
+	if rtyp == sshFxpStatus {
+		code, rest := take_u32(data)
+		if code == sshFxOk {
+			return rtyp, nil, nil
+		}
+		msg, _ := take_string(rest)
+		return rtyp, nil, &sftpStatusError{code: code, msg: msg}
+	}
+
+	return rtyp, data, nil
+}
+
+func (s *sftpClient) open(path string, flags uint32, attrs sftpAttrs) (string, error) {
+	typ, data, err := s.request(sshFxpOpen, ssh_string(path), ssh_u32(flags), attrs.marshal())
+	if err != nil {
+		return "", err
+	}
+	if typ != sshFxpHandle {
+		return "", fmt.Errorf("sftp: unexpected reply %d to open", typ)
+	}
+	handle, _ := take_string(data)
+	return handle, nil
+}
+
+func (s *sftpClient) close(handle string) error {
+	_, _, err := s.request(sshFxpClose, ssh_string(handle))
+	return err
+}
+
+func (s *sftpClient) stat(path string) (sftpAttrs, error) {
+	typ, data, err := s.request(sshFxpStat, ssh_string(path))
+	if err != nil {
+		return sftpAttrs{}, err
+	}
+	if typ != sshFxpAttrs {
+		return sftpAttrs{}, fmt.Errorf("sftp: unexpected reply %d to stat", typ)
+	}
+	return unmarshal_attrs(data), nil
+}
+
+func (s *sftpClient) fsetstat(handle string, attrs sftpAttrs) error {
+	_, _, err := s.request(sshFxpFsetstat, ssh_string(handle), attrs.marshal())
+	return err
+}
+
+// fsync flushes an open file to disk, a no-op without the extension.
+func (s *sftpClient) fsync(handle string) error {
+	if _, ok := s.exts["fsync@openssh.com"]; !ok {
+		return nil
+	}
+	_, _, err := s.request(sshFxpExtended, ssh_string("fsync@openssh.com"), ssh_string(handle))
+	return err
+}
+
+func (s *sftpClient) read_file(path string) ([]byte, error) {
+
+	handle, err := s.open(path, sshFxfRead, sftpAttrs{})
+	if err != nil {
+		return nil, err
+	}
+	defer s.close(handle)
+
+	var result []byte
+	for {
+		typ, data, err := s.request(sshFxpRead,
+			ssh_string(handle), ssh_u64(uint64(len(result))), ssh_u32(sftpChunk))
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if typ != sshFxpData {
+			return nil, fmt.Errorf("sftp: unexpected reply %d to read", typ)
+		}
+		chunk, _ := take_string(data)
+		result = append(result, chunk...)
+	}
+}
+
+func (s *sftpClient) write(handle string, data []byte) error {
+	for off := 0; off < len(data); off += sftpChunk {
+		end := off + sftpChunk
+		if end > len(data) {
+			end = len(data)
+		}
+		_, _, err := s.request(sshFxpWrite,
+			ssh_string(handle), ssh_u64(uint64(off)), ssh_string(string(data[off:end])))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpClient) write_file(path string, data []byte) error {
+
+	handle, err := s.open(path, sshFxfWrite|sshFxfCreat|sshFxfTrunc, sftpAttrs{})
+	if err != nil {
+		return err
+	}
+
+	err = s.write(handle, data)
+	if err != nil {
+		s.close(handle)
+		return err
+	}
+
+	return s.close(handle)
+}
+
+// write_file_like writes data to path with the mode and, where the server
+// lets us, the owner of like, and flushes it to disk, ready to be renamed
+// over like. A missing like leaves path as created.
+func (s *sftpClient) write_file_like(path, like string, data []byte) error {
+
+	attrs, err := s.stat(like)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	exists := err == nil
+
+	handle, err := s.open(path, sshFxfWrite|sshFxfCreat|sshFxfTrunc, sftpAttrs{})
+	if err != nil {
+		return err
+	}
+
+	err = s.write(handle, data)
+	if err == nil && exists {
+		// the owner goes first as changing it clears the setuid bits, and
+		// only root may give the file away
+		_ = s.fsetstat(handle, sftpAttrs{flags: sshFilexferAttrUidgid, uid: attrs.uid, gid: attrs.gid})
+		err = s.fsetstat(handle, sftpAttrs{flags: sshFilexferAttrPermissions, perms: attrs.perms & 07777})
+	}
+	if err == nil {
+		err = s.fsync(handle)
+	}
+	if err != nil {
+		s.close(handle)
+		return err
+	}
+
+	return s.close(handle)
+}
+
+func (a sftpAttrs) marshal() []byte {
+	b := ssh_u32(a.flags)
+	if a.flags&sshFilexferAttrSize != 0 {
+		b = append(b, ssh_u64(a.size)...)
+	}
+	if a.flags&sshFilexferAttrUidgid != 0 {
+		b = append(b, ssh_u32(a.uid)...)
+		b = append(b, ssh_u32(a.gid)...)
+	}
+	if a.flags&sshFilexferAttrPermissions != 0 {
+		b = append(b, ssh_u32(a.perms)...)
+	}
+	if a.flags&sshFilexferAttrAcmodtime != 0 {
+		b = append(b, ssh_u32(a.atime)...)
+		b = append(b, ssh_u32(a.mtime)...)
+	}
+	return b
+}
+
+func unmarshal_attrs(b []byte) sftpAttrs {
+	var a sftpAttrs
+	a.flags, b = take_u32(b)
+	if a.flags&sshFilexferAttrSize != 0 && len(b) >= 8 {
+		a.size = binary.BigEndian.Uint64(b)
+		b = b[8:]
+	}
+	if a.flags&sshFilexferAttrUidgid != 0 {
+		a.uid, b = take_u32(b)
+		a.gid, b = take_u32(b)
+	}
+	if a.flags&sshFilexferAttrPermissions != 0 {
+		a.perms, b = take_u32(b)
+	}
+	if a.flags&sshFilexferAttrAcmodtime != 0 {
+		a.atime, b = take_u32(b)
+		a.mtime, _ = take_u32(b)
+	}
+	return a
+}
+
+func ssh_u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func ssh_u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func ssh_string(s string) []byte {
+	return append(ssh_u32(uint32(len(s))), s...)
+}
+
+func take_u32(b []byte) (uint32, []byte) {
+	if len(b) < 4 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint32(b), b[4:]
+}
+
+func take_string(b []byte) (string, []byte) {
+	n, b := take_u32(b)
+	if int(n) > len(b) {
+		return "", nil
+	}
+	return string(b[:n]), b[n:]
+}
@@ -0,0 +1,236 @@
+package tools
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSftpAttrs(t *testing.T) {
+	tests := []sftpAttrs{
+		{},
+		{flags: sshFilexferAttrSize, size: 1 << 40},
+		{flags: sshFilexferAttrUidgid, uid: 1000, gid: 100},
+		{flags: sshFilexferAttrPermissions, perms: 0100644},
+		{flags: sshFilexferAttrAcmodtime, atime: 1, mtime: 2},
+		{flags: sshFilexferAttrSize | sshFilexferAttrUidgid | sshFilexferAttrPermissions | sshFilexferAttrAcmodtime,
+			size: 3, uid: 4, gid: 5, perms: 04755, atime: 6, mtime: 7},
+	}
+	for _, a := range tests {
+		if got := unmarshal_attrs(a.marshal()); got != a {
+			t.Errorf("%+v came back as %+v", a, got)
+		}
+	}
+}
+
+// fakeSftp is an in memory sftp server, enough for sftpClient.
+type fakeSftp struct {
+	files   map[string][]byte
+	attrs   map[string]sftpAttrs
+	handles map[string]string
+	// requests seen, by name, in order
+	log []string
+}
+
+// serve answers requests from r on w until r is closed.
+func (f *fakeSftp) serve(r io.Reader, w io.Writer) {
+
+	send := func(typ byte, id uint32, payload ...[]byte) {
+		b := ssh_u32(id)
+		for _, p := range payload {
+			b = append(b, p...)
+		}
+		h := ssh_u32(uint32(1 + len(b)))
+		w.Write(append(append(h, typ), b...))
+	}
+	status := func(id, code uint32) {
+		send(sshFxpStatus, id, ssh_u32(code), ssh_string("status"), ssh_string(""))
+	}
+
+	for {
+		h := make([]byte, 5)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(h)-1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return
+		}
+		id, data := take_u32(data)
+
+		switch h[4] {
+		case sshFxpOpen:
+			path, rest := take_string(data)
+			flags, _ := take_u32(rest)
+			f.log = append(f.log, "open")
+			if _, ok := f.files[path]; !ok && flags&sshFxfCreat == 0 {
+				status(id, sshFxNoSuchFile)
+				continue
+			}
+			if flags&sshFxfTrunc != 0 || f.files[path] == nil {
+				f.files[path] = []byte{}
+			}
+			handle := "h" + path
+			f.handles[handle] = path
+			send(sshFxpHandle, id, ssh_string(handle))
+		case sshFxpRead:
+			handle, rest := take_string(data)
+			off := binary.BigEndian.Uint64(rest)
+			n, _ := take_u32(rest[8:])
+			content := f.files[f.handles[handle]]
+			if off >= uint64(len(content)) {
+				status(id, sshFxEOF)
+				continue
+			}
+			end := off + uint64(n)
+			if end > uint64(len(content)) {
+				end = uint64(len(content))
+			}
+			send(sshFxpData, id, ssh_string(string(content[off:end])))
+		case sshFxpWrite:
+			handle, rest := take_string(data)
+			off := binary.BigEndian.Uint64(rest)
+			chunk, _ := take_string(rest[8:])
+			path := f.handles[handle]
+			content := f.files[path]
+			for uint64(len(content)) < off+uint64(len(chunk)) {
+				content = append(content, 0)
+			}
+			copy(content[off:], chunk)
+			f.files[path] = content
+			status(id, sshFxOk)
+		case sshFxpClose:
+			handle, _ := take_string(data)
+			delete(f.handles, handle)
+			f.log = append(f.log, "close")
+			status(id, sshFxOk)
+		case sshFxpStat:
+			path, _ := take_string(data)
+			a, ok := f.attrs[path]
+			if _, exists := f.files[path]; !ok || !exists {
+				status(id, sshFxNoSuchFile)
+				continue
+			}
+			send(sshFxpAttrs, id, a.marshal())
+		case sshFxpFsetstat:
+			handle, rest := take_string(data)
+			a := unmarshal_attrs(rest)
+			path := f.handles[handle]
+			now := f.attrs[path]
+			if a.flags&sshFilexferAttrUidgid != 0 {
+				f.log = append(f.log, "chown")
+				// not root
+				if a.uid != 1000 {
+					status(id, sshFxPermission)
+					continue
+				}
+				now.uid, now.gid = a.uid, a.gid
+			}
+			if a.flags&sshFilexferAttrPermissions != 0 {
+				f.log = append(f.log, "chmod")
+				now.perms = a.perms
+			}
+			f.attrs[path] = now
+			status(id, sshFxOk)
+		case sshFxpExtended:
+			name, _ := take_string(data)
+			f.log = append(f.log, name)
+			status(id, sshFxOk)
+		default:
+			status(id, 8) // op unsupported
+		}
+	}
+}
+
+// fake_sftp_client connects a client to f, with the extensions given.
+func fake_sftp_client(t *testing.T, f *fakeSftp, exts ...string) *sftpClient {
+	t.Helper()
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	go f.serve(sr, sw)
+	t.Cleanup(func() { cw.Close() })
+
+	s := &sftpClient{w: cw, r: cr, exts: map[string]string{}}
+	for _, e := range exts {
+		s.exts[e] = "1"
+	}
+	return s
+}
+
+func new_fake_sftp() *fakeSftp {
+	return &fakeSftp{files: map[string][]byte{}, attrs: map[string]sftpAttrs{}, handles: map[string]string{}}
+}
+
+func TestSftpReadWrite(t *testing.T) {
+
+	f := new_fake_sftp()
+	s := fake_sftp_client(t, f)
+
+	// more than a chunk to go both ways
+	big := strings.Repeat("0123456789abcdef", sftpChunk/8)
+	for _, text := range []string{"", "short\n", big} {
+		if err := s.write_file("/f", []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		if string(f.files["/f"]) != text {
+			t.Fatalf("wrote %d bytes, server has %d", len(text), len(f.files["/f"]))
+		}
+		got, err := s.read_file("/f")
+		if err != nil || string(got) != text {
+			t.Fatalf("read %d bytes back, %v", len(got), err)
+		}
+	}
+
+	_, err := s.read_file("/missing")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if len(f.handles) != 0 {
+		t.Fatal("handles left open", f.handles)
+	}
+}
+
+func TestSftpWriteFileLike(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		like  sftpAttrs // of the file replaced, no flags for none
+		exts  []string
+		perms uint32
+		uid   uint32
+		log   string
+	}{
+		{"new file", sftpAttrs{}, nil, 0, 0, "open,close"},
+		{"kept mode and owner", sftpAttrs{flags: sshFilexferAttrUidgid | sshFilexferAttrPermissions, uid: 1000, gid: 1000, perms: 0104750},
+			nil, 04750, 1000, "open,chown,chmod,close"},
+		{"owner not ours to give", sftpAttrs{flags: sshFilexferAttrUidgid | sshFilexferAttrPermissions, uid: 0, perms: 0100640},
+			nil, 0640, 0, "open,chown,chmod,close"},
+		{"flushed", sftpAttrs{flags: sshFilexferAttrPermissions, perms: 0100600},
+			[]string{"fsync@openssh.com"}, 0600, 0, "open,chown,chmod,fsync@openssh.com,close"},
+	}
+
+	for _, tt := range tests {
+		f := new_fake_sftp()
+		if tt.like.flags != 0 {
+			f.files["/etc/f"] = []byte("old")
+			f.attrs["/etc/f"] = tt.like
+		}
+		s := fake_sftp_client(t, f, tt.exts...)
+
+		err := s.write_file_like("/etc/.f.tmp", "/etc/f", []byte("new"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := f.attrs["/etc/.f.tmp"]
+		if string(f.files["/etc/.f.tmp"]) != "new" || got.perms != tt.perms || got.uid != tt.uid {
+			t.Errorf("%s: %q %+v", tt.name, f.files["/etc/.f.tmp"], got)
+		}
+		if log := strings.Join(f.log, ","); log != tt.log {
+			t.Errorf("%s: requests %s, want %s", tt.name, log, tt.log)
+		}
+	}
+}
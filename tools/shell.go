@@ -0,0 +1,55 @@
+package tools
+
+import (
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// shell starts a login shell on a pty of rows by cols, returning the
+// session with its input and output. vtScreen handles what xterm's basics
+// need, so that is the terminal type we ask for.
+func (c *conn) shell(rows, cols int) (*ssh.Session, io.WriteCloser, io.Reader, error) {
+
+	if !c.isConnected() {
+		err := c.Connect()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	sess, err := c.new_session()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 38400,
+		ssh.TTY_OP_OSPEED: 38400,
+	}
+	err = sess.RequestPty("xterm", rows, cols, modes)
+	if err != nil {
+		sess.Close()
+		return nil, nil, nil, err
+	}
+
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, nil, nil, err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, nil, nil, err
+	}
+
+	err = sess.Shell()
+	if err != nil {
+		sess.Close()
+		return nil, nil, nil, err
+	}
+
+	return sess, stdin, stdout, nil
+}
@@ -0,0 +1,309 @@
+package tools
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The subset of ssh_config(5) we need to resolve the names typed into the
+// host entry the same way OpenSSH would: Host and Match host blocks,
+// Include, and the HostName, User, Port, IdentityFile and ProxyJump
+// keywords. As with OpenSSH the first value obtained for a keyword wins.
+
+const sshConfigMaxDepth = 16
+
+type sshConfigBlock struct {
+	host  []string // Host patterns, nil for a Match block
+	match []string // Match criteria and their arguments
+	opts  [][2]string
+}
+
+type sshConfig struct {
+	blocks []*sshConfigBlock
+}
+
+type sshHostConfig struct {
+	HostName      string
+	User          string
+	Port          string
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+func user_ssh_dir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh")
+}
+
+// load_ssh_config reads ~/.ssh/config, a missing file is an empty config.
+func load_ssh_config() (*sshConfig, error) {
+	c := &sshConfig{}
+	dir := user_ssh_dir()
+	if dir == "" {
+		return c, nil
+	}
+	f := filepath.Join(dir, "config")
+	if !path_exists(f) {
+		return c, nil
+	}
+	// lines before the first Host apply to every host
+	global := &sshConfigBlock{host: []string{"*"}}
+	c.blocks = append(c.blocks, global)
+	return c, c.parse(f, global, 0)
+}
+
+func (c *sshConfig) parse(file string, current *sshConfigBlock, depth int) error {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+
+		key, args := ssh_config_line(scanner.Text())
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			current = &sshConfigBlock{host: args}
+			c.blocks = append(c.blocks, current)
+		case "match":
+			current = &sshConfigBlock{match: args}
+			c.blocks = append(c.blocks, current)
+		case "include":
+			if depth >= sshConfigMaxDepth {
+				continue
+			}
+			for _, pattern := range args {
+				pattern = expand_home(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(user_ssh_dir(), pattern)
+				}
+				files, _ := filepath.Glob(pattern)
+				for _, inc := range files {
+					// an included file may start new blocks, the lines
+					// after the Include still belong to ours
+					block := &sshConfigBlock{host: current.host, match: current.match}
+					c.blocks = append(c.blocks, block)
+					err := c.parse(inc, block, depth+1)
+					if err != nil {
+						return err
+					}
+					next := &sshConfigBlock{host: current.host, match: current.match}
+					c.blocks = append(c.blocks, next)
+					current = next
+				}
+			}
+		default:
+			if len(args) > 0 {
+				current.opts = append(current.opts, [2]string{key, strings.Join(args, " ")})
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// ssh_config_line splits a line into its lower cased keyword and arguments,
+// keyword and arguments may be separated by whitespace or an '='.
+func ssh_config_line(line string) (string, []string) {
+
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), nil
+	}
+	key := strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	var sb strings.Builder
+	quoted, inArg := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, sb.String())
+				sb.Reset()
+				inArg = false
+			}
+		default:
+			sb.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, sb.String())
+	}
+
+	return key, args
+}
+
+// match_patterns reports whether s matches the pattern list, a negated
+// pattern that matches rules the whole list out.
+func match_patterns(patterns []string, s string) bool {
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if ok, _ := path.Match(p[1:], s); ok {
+				return false
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, s); ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+func (b *sshConfigBlock) matches(alias, hostname, user string) bool {
+
+	if b.match == nil {
+		return match_patterns(b.host, alias)
+	}
+
+	for i := 0; i < len(b.match); i++ {
+
+		criterion := strings.ToLower(b.match[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		var ok bool
+		switch criterion {
+		case "all":
+			ok = true
+		case "host", "originalhost", "user":
+			if i+1 >= len(b.match) {
+				return false
+			}
+			i++
+			patterns := strings.Split(b.match[i], ",")
+			switch criterion {
+			case "host":
+				ok = match_patterns(patterns, hostname)
+			case "originalhost":
+				ok = match_patterns(patterns, alias)
+			case "user":
+				ok = match_patterns(patterns, user)
+			}
+		default:
+			// exec, canonical, localuser... are not supported
+			return false
+		}
+
+		if ok == negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookup resolves alias, user is the one given on the host spec if any.
+func (c *sshConfig) lookup(alias, user string) sshHostConfig {
+
+	h := sshHostConfig{}
+
+	for _, b := range c.blocks {
+
+		hostname := alias
+		if h.HostName != "" {
+			hostname = h.HostName
+		}
+		u := user
+		if u == "" {
+			u = h.User
+		}
+
+		if !b.matches(alias, hostname, u) {
+			continue
+		}
+
+		for _, opt := range b.opts {
+			switch opt[0] {
+			case "hostname":
+				if h.HostName == "" {
+					h.HostName = strings.ReplaceAll(opt[1], "%h", alias)
+				}
+			case "user":
+				if h.User == "" {
+					h.User = opt[1]
+				}
+			case "port":
+				if h.Port == "" {
+					h.Port = opt[1]
+				}
+			case "identityfile":
+				h.IdentityFiles = append(h.IdentityFiles, opt[1])
+			case "proxyjump":
+				if h.ProxyJump == "" {
+					h.ProxyJump = opt[1]
+				}
+			}
+		}
+	}
+
+	hostname := alias
+	if h.HostName != "" {
+		hostname = h.HostName
+	}
+	for i, f := range h.IdentityFiles {
+		f = strings.ReplaceAll(f, "%h", hostname)
+		f = strings.ReplaceAll(f, "%r", h.User)
+		f = strings.ReplaceAll(f, "%%", "%")
+		h.IdentityFiles[i] = expand_home(f)
+	}
+
+	return h
+}
+
+// hosts lists the names given in Host lines that are not patterns, these
+// are what can be imported as hosts.
+func (c *sshConfig) hosts() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, b := range c.blocks {
+		for _, p := range b.host {
+			if strings.ContainsAny(p, "*?!") || seen[p] {
+				continue
+			}
+			seen[p] = true
+			names = append(names, p)
+		}
+	}
+	return names
+}
+
+func expand_home(s string) string {
+	if s == "~" || strings.HasPrefix(s, "~/") || strings.HasPrefix(s, "%d/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return s
+		}
+		if strings.HasPrefix(s, "%d") {
+			return home + s[2:]
+		}
+		return home + s[1:]
+	}
+	return s
+}
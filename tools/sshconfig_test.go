@@ -0,0 +1,162 @@
+package tools
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSSHConfig = `# global settings come first
+IdentityFile ~/.ssh/id_global
+
+Host web web2
+	HostName %h.example.com
+	User www
+	Port 2222
+	IdentityFile ~/.ssh/id_%h
+
+Host *.lan !printer.lan
+	User admin
+	ProxyJump jump@bastion:22
+
+Host direct
+	HostName 10.0.0.5
+	ProxyJump none
+
+Match host 10.0.0.* user root
+	Port 2200
+
+Host = quoted
+	HostName "name with space"
+
+Include conf.d/*
+
+Host *
+	User fallback
+	Port 22
+`
+
+const testSSHConfigInclude = `Host db
+	HostName db.internal
+	User postgres
+`
+
+func TestSSHConfigLookup(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, ".ssh")
+	os.MkdirAll(filepath.Join(dir, "conf.d"), 0700)
+	os.WriteFile(filepath.Join(dir, "config"), []byte(testSSHConfig), 0600)
+	os.WriteFile(filepath.Join(dir, "conf.d", "db"), []byte(testSSHConfigInclude), 0600)
+
+	sc, err := load_ssh_config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		alias, user string
+		want        sshHostConfig
+	}{
+		{"web", "", sshHostConfig{
+			HostName: "web.example.com", User: "www", Port: "2222",
+			IdentityFiles: []string{dir + "/id_global", dir + "/id_web.example.com"},
+		}},
+		// User is reported, the user on the spec wins in parse_host_spec
+		{"web2", "me", sshHostConfig{
+			HostName: "web2.example.com", User: "www", Port: "2222",
+			IdentityFiles: []string{dir + "/id_global", dir + "/id_web2.example.com"},
+		}},
+		{"nas.lan", "", sshHostConfig{
+			User: "admin", Port: "22", ProxyJump: "jump@bastion:22",
+			IdentityFiles: []string{dir + "/id_global"},
+		}},
+		{"printer.lan", "", sshHostConfig{
+			User: "fallback", Port: "22",
+			IdentityFiles: []string{dir + "/id_global"},
+		}},
+		{"direct", "root", sshHostConfig{
+			HostName: "10.0.0.5", User: "fallback", Port: "2200", ProxyJump: "none",
+			IdentityFiles: []string{dir + "/id_global"},
+		}},
+		{"direct", "", sshHostConfig{
+			HostName: "10.0.0.5", User: "fallback", Port: "22", ProxyJump: "none",
+			IdentityFiles: []string{dir + "/id_global"},
+		}},
+		{"quoted", "", sshHostConfig{
+			HostName: "name with space", User: "fallback", Port: "22",
+			IdentityFiles: []string{dir + "/id_global"},
+		}},
+		{"db", "", sshHostConfig{
+			HostName: "db.internal", User: "postgres", Port: "22",
+			IdentityFiles: []string{dir + "/id_global"},
+		}},
+	}
+
+	for _, tt := range tests {
+		got := sc.lookup(tt.alias, tt.user)
+		if got.HostName != tt.want.HostName || got.User != tt.want.User || got.Port != tt.want.Port ||
+			got.ProxyJump != tt.want.ProxyJump ||
+			strings.Join(got.IdentityFiles, ",") != strings.Join(tt.want.IdentityFiles, ",") {
+			t.Errorf("%s %q:\n got %+v\nwant %+v", tt.alias, tt.user, got, tt.want)
+		}
+	}
+
+	hosts := strings.Join(sc.hosts(), ",")
+	if hosts != "web,web2,direct,quoted,db" {
+		t.Errorf("hosts %s", hosts)
+	}
+}
+
+func TestHostSpecFromSSHConfig(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, ".ssh")
+	os.MkdirAll(filepath.Join(dir, "conf.d"), 0700)
+	os.WriteFile(filepath.Join(dir, "config"), []byte(testSSHConfig), 0600)
+
+	tests := []struct {
+		spec, user, addr, alias, proxyJump string
+	}{
+		{"web", "www", "web.example.com:2222", "web", ""},
+		{"me@web:22", "me", "web.example.com:22", "web", ""},
+		{"nas.lan", "admin", "nas.lan:22", "", "jump@bastion:22"},
+		{"direct", "fallback", "10.0.0.5:22", "direct", ""},
+		{"root@direct", "root", "10.0.0.5:2200", "direct", ""},
+	}
+
+	for _, tt := range tests {
+		h := parse_host_spec(tt.spec)
+		if h.user != tt.user || h.addr != tt.addr || h.alias != tt.alias || h.proxyJump != tt.proxyJump {
+			t.Errorf("%s: got %s@%s alias %q jump %q", tt.spec, h.user, h.addr, h.alias, h.proxyJump)
+		}
+	}
+}
+
+func TestSSHConfigLine(t *testing.T) {
+
+	tests := []struct {
+		line string
+		key  string
+		args []string
+	}{
+		{"", "", nil},
+		{"   # comment", "", nil},
+		{"HostName example.com", "hostname", []string{"example.com"}},
+		{"  Port=2222", "port", []string{"2222"}},
+		{"Port = 2222", "port", []string{"2222"}},
+		{"Host a b\tc", "host", []string{"a", "b", "c"}},
+		{`IdentityFile "~/my keys/id"`, "identityfile", []string{"~/my keys/id"}},
+		{"Compression", "compression", nil},
+	}
+
+	for _, tt := range tests {
+		key, args := ssh_config_line(tt.line)
+		if key != tt.key || strings.Join(args, "|") != strings.Join(tt.args, "|") {
+			t.Errorf("%q: got %q %q", tt.line, key, args)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package tools
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Viewer commands are streamed, their output shown line by line as it
+// arrives rather than when they finish. Only the last "lines" lines are
+// kept, and a job with "follow" set, such as logread -f, runs until it is
+// stopped.
+
+// lines kept by default when the job does not set "lines"
+const defaultLines = 5000
+
+// job_lines is the number of output lines to keep for a job, from its
+// "lines" setting.
+func job_lines(job map[string]string) int {
+	n, err := strconv.Atoi(job["lines"])
+	if err != nil || n <= 0 {
+		return defaultLines
+	}
+	return n
+}
+
+// job_follow reports whether a job's "follow" setting says its command
+// runs until stopped.
+func job_follow(job map[string]string) bool {
+	b, _ := strconv.ParseBool(job["follow"])
+	return b
+}
+
+// lineBuffer keeps the last lines of a command's output.
+type lineBuffer struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	dropped int  // lines no longer kept
+	changed bool // lines were added since the last take
+}
+
+func new_line_buffer(max int) *lineBuffer {
+	return &lineBuffer{max: max}
+}
+
+func (b *lineBuffer) add(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines = append(b.lines, line)
+	if len(b.lines) > b.max {
+		n := len(b.lines) - b.max
+		b.dropped += n
+		// copy down now and then rather than on every line
+		if cap(b.lines) > 2*b.max {
+			b.lines = append([]string(nil), b.lines[n:]...)
+		} else {
+			b.lines = b.lines[n:]
+		}
+	}
+	b.changed = true
+}
+
+// take returns the text of the lines kept and how many were dropped, ok
+// being false when nothing was added since it was last called.
+func (b *lineBuffer) take() (text string, dropped int, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.changed {
+		return "", b.dropped, false
+	}
+	b.changed = false
+	return strings.Join(b.lines, "\n"), b.dropped, true
+}
@@ -0,0 +1,383 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"golang.org/x/crypto/ssh"
+)
+
+// Terminal is the Terminal tab, a shell on the connected host drawn by
+// termView. Resizing the window resizes the remote pty.
+type Terminal struct {
+	View   *termView
+	Open   *widget.Button
+	Close  *widget.Button
+	Status *widget.Label
+
+	mu    sync.Mutex
+	sess  *ssh.Session
+	stdin io.WriteCloser
+}
+
+func NewTerminal() *Terminal {
+
+	t := &Terminal{
+		View:   newTermView(),
+		Open:   widget.NewButtonWithIcon("Open shell", theme.ComputerIcon(), func() {}),
+		Close:  widget.NewButtonWithIcon("Close", theme.CancelIcon(), func() {}),
+		Status: widget.NewLabel("no shell, connect to a host and open one"),
+	}
+
+	t.Close.Disable()
+	t.Close.OnTapped = t.close
+	t.View.input = t.write
+	t.View.resized = t.resize
+	// answers go out on their own, the screen is locked while it reads
+	t.View.screen.reply = func(b []byte) { go t.write(b) }
+
+	return t
+}
+
+// start shows the shell running in sess until it exits or is closed.
+func (t *Terminal) start(sess *ssh.Session, stdin io.WriteCloser, stdout io.Reader, host string) {
+
+	t.mu.Lock()
+	t.sess, t.stdin = sess, stdin
+	t.mu.Unlock()
+
+	t.View.screen.Write([]byte("\x1bc"))
+	t.View.changed()
+	t.Open.Disable()
+	t.Close.Enable()
+	t.Status.SetText("shell on " + host)
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				t.View.screen.Write(buf[:n])
+				t.View.changed()
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		err := sess.Wait()
+		t.mu.Lock()
+		t.sess, t.stdin = nil, nil
+		t.mu.Unlock()
+		sess.Close()
+
+		t.Open.Enable()
+		t.Close.Disable()
+		var exit *ssh.ExitError
+		switch {
+		case err == nil:
+			t.Status.SetText("shell on " + host + " exited")
+		case errors.As(err, &exit):
+			t.Status.SetText(fmt.Sprintf("shell on %s exited with %d", host, exit.ExitStatus()))
+		default:
+			t.Status.SetText(fmt.Sprintf("shell on %s ended: %s", host, err))
+		}
+	}()
+}
+
+func (t *Terminal) write(b []byte) {
+	t.mu.Lock()
+	w := t.stdin
+	t.mu.Unlock()
+	if w != nil {
+		w.Write(b)
+	}
+}
+
+// resize tells the remote pty the terminal's new size.
+func (t *Terminal) resize(rows, cols int) {
+	t.mu.Lock()
+	sess := t.sess
+	t.mu.Unlock()
+	if sess != nil {
+		sess.WindowChange(rows, cols)
+	}
+}
+
+func (t *Terminal) close() {
+	t.mu.Lock()
+	sess := t.sess
+	t.mu.Unlock()
+	if sess != nil {
+		sess.Close()
+	}
+}
+
+// openShell starts a shell on the connected host in the Terminal tab. Only
+// opening it is a job, the shell runs alongside the other jobs.
+func (ui *Tools) openShell() {
+
+	t := ui.Terminal
+	if ui.conn.host == "" {
+		t.Status.SetText("connect to a host to open a shell on it")
+		return
+	}
+
+	ui.startJob("opening a shell", func(context.Context) {
+		t.Status.SetText("opening a shell on " + ui.conn.host + "...")
+		rows, cols := t.View.screen.size()
+		sess, stdin, stdout, err := ui.conn.shell(rows, cols)
+		if err != nil {
+			t.Status.SetText("fail: opening a shell: " + err.Error())
+			return
+		}
+		t.start(sess, stdin, stdout, ui.conn.host)
+		ui.Window.Canvas().Focus(t.View)
+	})
+}
+
+// termView draws a vtScreen on a TextGrid and passes what is typed on to
+// input, as a terminal would send it.
+type termView struct {
+	widget.BaseWidget
+	grid    *widget.TextGrid
+	screen  *vtScreen
+	input   func([]byte)
+	resized func(rows, cols int)
+	focused bool
+	pending int32 // a redraw is due, see changed
+}
+
+func newTermView() *termView {
+	v := &termView{
+		grid:   widget.NewTextGrid(),
+		screen: new_vt_screen(24, 80),
+	}
+	v.ExtendBaseWidget(v)
+	return v
+}
+
+// changed redraws the view soon, output coming in many small reads is
+// drawn once.
+func (v *termView) changed() {
+	if atomic.CompareAndSwapInt32(&v.pending, 0, 1) {
+		time.AfterFunc(20*time.Millisecond, func() {
+			atomic.StoreInt32(&v.pending, 0)
+			v.Refresh()
+		})
+	}
+}
+
+// draw copies the screen to the grid.
+func (v *termView) draw() {
+
+	cells, cx, cy, cursor := v.screen.snapshot()
+
+	rows := make([]widget.TextGridRow, len(cells))
+	for y, row := range cells {
+		r := widget.TextGridRow{Cells: make([]widget.TextGridCell, len(row))}
+		for x, c := range row {
+			fg, bg := term_color(c.fg, c.bold), term_color(c.bg, false)
+			// the cursor is drawn reversed
+			if c.reverse != (cursor && v.focused && x == cx && y == cy) {
+				fg, bg = bg, fg
+				if fg == nil {
+					fg = theme.BackgroundColor()
+				}
+				if bg == nil {
+					bg = theme.ForegroundColor()
+				}
+			}
+			cell := widget.TextGridCell{Rune: c.r}
+			if fg != nil || bg != nil {
+				cell.Style = &widget.CustomTextGridStyle{FGColor: fg, BGColor: bg}
+			}
+			r.Cells[x] = cell
+		}
+		rows[y] = r
+	}
+
+	v.grid.Rows = rows
+	v.grid.Refresh()
+}
+
+// the xterm colours
+var termPalette = []color.Color{
+	color.NRGBA{0x00, 0x00, 0x00, 0xff}, color.NRGBA{0xcd, 0x00, 0x00, 0xff},
+	color.NRGBA{0x00, 0xcd, 0x00, 0xff}, color.NRGBA{0xcd, 0xcd, 0x00, 0xff},
+	color.NRGBA{0x00, 0x00, 0xee, 0xff}, color.NRGBA{0xcd, 0x00, 0xcd, 0xff},
+	color.NRGBA{0x00, 0xcd, 0xcd, 0xff}, color.NRGBA{0xe5, 0xe5, 0xe5, 0xff},
+	color.NRGBA{0x7f, 0x7f, 0x7f, 0xff}, color.NRGBA{0xff, 0x00, 0x00, 0xff},
+	color.NRGBA{0x00, 0xff, 0x00, 0xff}, color.NRGBA{0xff, 0xff, 0x00, 0xff},
+	color.NRGBA{0x5c, 0x5c, 0xff, 0xff}, color.NRGBA{0xff, 0x00, 0xff, 0xff},
+	color.NRGBA{0x00, 0xff, 0xff, 0xff}, color.NRGBA{0xff, 0xff, 0xff, 0xff},
+}
+
+// term_color is colour c, brightened for bold text, or nil for the
+// theme's own.
+func term_color(c int, bold bool) color.Color {
+	if c < 0 {
+		return nil
+	}
+	if bold && c < 8 {
+		c += 8
+	}
+	return termPalette[c]
+}
+
+func (v *termView) CreateRenderer() fyne.WidgetRenderer {
+	return &termRenderer{v}
+}
+
+func (v *termView) Tapped(*fyne.PointEvent) {
+	if c := fyne.CurrentApp().Driver().CanvasForObject(v); c != nil {
+		c.Focus(v)
+	}
+}
+
+func (v *termView) FocusGained() {
+	v.focused = true
+	v.Refresh()
+}
+
+func (v *termView) FocusLost() {
+	v.focused = false
+	v.Refresh()
+}
+
+// AcceptsTab keeps tab for the shell's completion rather than moving the
+// focus on.
+func (v *termView) AcceptsTab() bool {
+	return true
+}
+
+func (v *termView) TypedRune(r rune) {
+	v.send(string(r))
+}
+
+func (v *termView) TypedKey(e *fyne.KeyEvent) {
+
+	cursor := "\x1b["
+	if v.screen.app_cursor() {
+		cursor = "\x1bO"
+	}
+
+	keys := map[fyne.KeyName]string{
+		fyne.KeyReturn:    "\r",
+		fyne.KeyEnter:     "\r",
+		fyne.KeyBackspace: "\x7f",
+		fyne.KeyTab:       "\t",
+		fyne.KeyEscape:    "\x1b",
+		fyne.KeyUp:        cursor + "A",
+		fyne.KeyDown:      cursor + "B",
+		fyne.KeyRight:     cursor + "C",
+		fyne.KeyLeft:      cursor + "D",
+		fyne.KeyHome:      cursor + "H",
+		fyne.KeyEnd:       cursor + "F",
+		fyne.KeyInsert:    "\x1b[2~",
+		fyne.KeyDelete:    "\x1b[3~",
+		fyne.KeyPageUp:    "\x1b[5~",
+		fyne.KeyPageDown:  "\x1b[6~",
+		fyne.KeyF1:        "\x1bOP",
+		fyne.KeyF2:        "\x1bOQ",
+		fyne.KeyF3:        "\x1bOR",
+		fyne.KeyF4:        "\x1bOS",
+		fyne.KeyF5:        "\x1b[15~",
+		fyne.KeyF6:        "\x1b[17~",
+		fyne.KeyF7:        "\x1b[18~",
+		fyne.KeyF8:        "\x1b[19~",
+		fyne.KeyF9:        "\x1b[20~",
+		fyne.KeyF10:       "\x1b[21~",
+		fyne.KeyF11:       "\x1b[23~",
+		fyne.KeyF12:       "\x1b[24~",
+	}
+
+	if s, ok := keys[e.Name]; ok {
+		v.send(s)
+	}
+}
+
+// TypedShortcut takes the control keys, which come as shortcuts: ctrl-c
+// interrupts rather than copies and ctrl-v pastes.
+func (v *termView) TypedShortcut(s fyne.Shortcut) {
+	switch s := s.(type) {
+	case *fyne.ShortcutPaste:
+		v.send(s.Clipboard.Content())
+	case *fyne.ShortcutCopy:
+		v.send("\x03")
+	case *fyne.ShortcutCut:
+		v.send("\x18")
+	case *fyne.ShortcutSelectAll:
+		v.send("\x01")
+	case *desktop.CustomShortcut:
+		if s.Modifier != fyne.KeyModifierControl || len(s.KeyName) != 1 {
+			return
+		}
+		c := s.KeyName[0]
+		switch {
+		case c >= 'A' && c <= 'Z':
+			v.send(string(rune(c - 'A' + 1)))
+		case c == '[':
+			v.send("\x1b")
+		case c == '\\':
+			v.send("\x1c")
+		case c == ']':
+			v.send("\x1d")
+		}
+	}
+}
+
+func (v *termView) send(s string) {
+	if v.input != nil && s != "" {
+		v.input([]byte(s))
+	}
+}
+
+type termRenderer struct {
+	v *termView
+}
+
+// Layout fits the screen to the space the view has, in characters.
+func (r *termRenderer) Layout(size fyne.Size) {
+
+	r.v.grid.Resize(size)
+
+	cell := fyne.MeasureText("M", theme.TextSize(), fyne.TextStyle{Monospace: true})
+	cols := int(size.Width / float32(math.Round(float64(cell.Width))))
+	rows := int(size.Height / float32(math.Round(float64(cell.Height))))
+	if rows < 1 || cols < 1 {
+		return
+	}
+
+	if r.v.screen.resize(rows, cols) && r.v.resized != nil {
+		go r.v.resized(rows, cols)
+	}
+	r.v.draw()
+}
+
+func (r *termRenderer) MinSize() fyne.Size {
+	cell := fyne.MeasureText("M", theme.TextSize(), fyne.TextStyle{Monospace: true})
+	return fyne.NewSize(cell.Width*20, cell.Height*5)
+}
+
+func (r *termRenderer) Refresh() {
+	r.v.draw()
+}
+
+func (r *termRenderer) Objects() []fyne.CanvasObject {
+	return []fyne.CanvasObject{r.v.grid}
+}
+
+func (r *termRenderer) Destroy() {
+}
@@ -1,11 +1,14 @@
 package tools
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -54,9 +57,14 @@ func (ui *JobsEditor) GetJobs() Jobs {
 type Editor struct {
 	Menu            *widget.Select
 	Save            *widget.Button
+	Restore         *widget.Button
+	Keys            *widget.Button
 	View            *widget.Entry
 	Status          *widget.Label
 	Progress        *widget.ProgressBarInfinite
+	Cancel          *widget.Button
+	Stderr          *widget.Entry
+	Details         *widget.Accordion // holds Stderr
 	EditorConfig    map[string]map[string]string
 	conn            conn
 	text            string
@@ -88,12 +96,14 @@ func (ui *Editor) EnableMenuControls() {
 	ui.addConfig.Enable()
 	ui.DelConfig.Enable()
 	ui.EditConfig.Enable()
+	ui.Restore.Enable()
 }
 
 func (ui *Editor) DisableMenuControls() {
 	ui.addConfig.Disable()
 	ui.DelConfig.Disable()
 	ui.EditConfig.Disable()
+	ui.Restore.Disable()
 }
 
 func (ui *Editor) showMessage(s string) {
@@ -115,11 +125,90 @@ func (ui *Editor) hideProgress(s string) {
 	ui.Progress.Hide()
 }
 
+// jobCancelled reports whether the job was cancelled, saying so.
+func (ui *Editor) jobCancelled(ctx context.Context, what string) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	ui.hideProgress("cancelled: " + what)
+	return true
+}
+
+// showStream shows the lines run passes on in the view as they come,
+// keeping the last max of them. The view scrolls along with the output
+// unless the cursor was moved off its end.
+func (ui *Editor) showStream(max int, run func(line func(string))) {
+
+	buf := new_line_buffer(max)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	// the view is redrawn a few times a second, not for every line
+	go func() {
+		defer close(done)
+		t := time.NewTicker(100 * time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				ui.flushStream(buf)
+				return
+			case <-t.C:
+				ui.flushStream(buf)
+			}
+		}
+	}()
+
+	run(buf.add)
+	close(stop)
+	<-done
+}
+
+// showResult puts the stderr of the job's command in the panel under the
+// view, which is hidden when there is none.
+func (ui *Editor) showResult(res *JobResult) {
+
+	if res == nil || res.Stderr == "" {
+		ui.Stderr.SetText("")
+		ui.Details.Hide()
+		return
+	}
+
+	n := strings.Count(res.Stderr, "\n") + 1
+	ui.Details.Items[0].Title = fmt.Sprintf("stderr of \"%s\", %d lines", res.Cmd, n)
+	ui.Stderr.SetText(res.Stderr)
+	ui.Details.Refresh()
+	ui.Details.Show()
+}
+
+func (ui *Editor) flushStream(buf *lineBuffer) {
+
+	text, dropped, ok := buf.take()
+	if !ok {
+		return
+	}
+	if dropped > 0 {
+		text = fmt.Sprintf("[%d earlier lines not kept]\n", dropped) + text
+	}
+
+	atEnd := ui.View.CursorRow >= strings.Count(ui.View.Text, "\n")
+	ui.View.SetText(text)
+	if atEnd {
+		ui.View.CursorRow = strings.Count(text, "\n")
+		ui.View.CursorColumn = 0
+		ui.View.Refresh()
+	}
+}
+
 func (ui *Editor) help() string {
 	h := "The Editor"
 	h += "\n" + strings.Repeat("-", len(h)) + "\n\n"
 	h += "Allows editing of the specified remote file\n"
-	h += "and runs the specified command on successful save\n\n"
+	h += "and runs the specified command on successful save\n"
+	h += "the previous version is kept as a backup and can be restored\n"
+	h += "an optional validate command checks the new content, in $FILE,\n"
+	h += "before it replaces the file, and with rollback set a failing\n"
+	h += "command puts the previous content back and runs again\n\n"
 	if ui.EditorConfig != nil {
 		f := "%-18v %-38v %-24v\n"
 		h += fmt.Sprintf(f, "name", "file", "command")
@@ -137,9 +226,13 @@ func NewEditor() *Editor {
 	ui := &Editor{
 		Menu:       widget.NewSelect([]string{}, func(s string) {}),
 		Save:       widget.NewButton("Save", func() {}),
+		Restore:    widget.NewButtonWithIcon("Restore", theme.HistoryIcon(), func() {}),
+		Keys:       widget.NewButtonWithIcon("Keys", theme.AccountIcon(), func() {}),
 		View:       widget.NewMultiLineEntry(),
 		Status:     widget.NewLabel("Status..."),
 		Progress:   widget.NewProgressBarInfinite(),
+		Cancel:     widget.NewButtonWithIcon("Cancel", theme.CancelIcon(), func() {}),
+		Stderr:     widget.NewMultiLineEntry(),
 		conn:       conn{},
 		addConfig:  widget.NewButtonWithIcon("", theme.ContentAddIcon(), func() {}),
 		DelConfig:  widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {}),
@@ -152,9 +245,16 @@ func NewEditor() *Editor {
 	ui.DisableMenuControls()
 	ui.Menu.ClearSelected()
 	ui.Save.Disable()
+	ui.Keys.Disable()
 	ui.View.Disable()
 	ui.View.TextStyle = fyne.TextStyle{Monospace: true, TabWidth: 4}
 	ui.Progress.Hide()
+	ui.Cancel.Hide()
+	ui.Stderr.TextStyle = fyne.TextStyle{Monospace: true}
+	ui.Stderr.SetMinRowsVisible(6)
+	ui.Stderr.Disable()
+	ui.Details = widget.NewAccordion(widget.NewAccordionItem("stderr", ui.Stderr))
+	ui.Details.Hide()
 	ui.Status.Show()
 	ui.EditConfig.Disable()
 	ui.DelConfig.Disable()
@@ -178,11 +278,14 @@ type Tools struct {
 	HostDescLabel *widget.Label
 	Password      *widget.Entry
 	ConnectBtn    *widget.Button
+	ConnState     *widget.Label
 	PrivateKey    *widget.Entry
 	conn          conn
 	config        *Config
 	Editor        *Editor
 	Viewer        *Editor
+	Terminal      *Terminal
+	Fanout        *Fanout
 	HelpStatus    *widget.Label
 	HelpProgress  *widget.ProgressBarInfinite
 	JsonView      *widget.Entry
@@ -193,38 +296,382 @@ type Tools struct {
 	err           error
 	delHost       *widget.Button
 	MenuOpen      *fyne.MenuItem
-	editHost      *widget.Button
+	MenuImport    *fyne.MenuItem
+	MenuRotate    *fyne.MenuItem
+	EditHost      *widget.Button
 	editHostPopup *widget.PopUp
+	jobs          *executor          // runs the remote operations on conn
+	idle          []fyne.Disableable // what setBusy disabled, to enable again
 	App           fyne.App
 	Window        fyne.Window
 }
 
 func (ui *Tools) Connect() error {
 
-	user, host := ParseHostSpecToUserHost(ui.HostEntry.Text)
+	spec := parse_host_spec(ui.HostEntry.Text)
+	user, host := spec.user, spec.addr
 
-	ui.conn.host = user + "@" + host
+	ui.conn.configure(ui.config, ui.HostEntry.Text)
 	ui.conn.password = ui.Password.Text
 	ui.conn.key = ui.PrivateKey.Text
 
 	ui.showProgress(fmt.Sprintf(
-		"connecting to %s as %s...", host, user))
+		"connecting to %s as %s%s...", host, user, ui.conn.route()))
 
 	err := ui.conn.Connect()
 	if err != nil {
 		ui.hideProgress(fmt.Sprintf(
-			"could not dial out to %s as %s\n%s", host, user, err))
+			"could not dial out to %s as %s%s\n%s", host, user, ui.conn.route(), err))
+		var unknown *unknownHostKeyError
+		if errors.As(err, &unknown) {
+			ui.confirmHostKey(unknown)
+		}
+		var needPassphrase *passphraseNeededError
+		if errors.As(err, &needPassphrase) {
+			ui.askPassphrase(needPassphrase)
+		}
 		return err
 	}
 
 	ui.HostEntry.SetText(ui.conn.host)
 	ui.hideProgress(fmt.Sprintf(
-		"success: connected to %s as %s", host, user))
+		"success: connected to %s as %s%s%s", host, user, ui.conn.route(), ui.conn.cert_status()))
 
 	return nil
 
 }
 
+// connectHost connects to the host entered and sets the ui up for it, as a
+// job since the login may wait on askChallenge.
+func (ui *Tools) connectHost() {
+
+	if err := ui.Connect(); err != nil {
+		ui.ConnectBtn.Enable()
+		return
+	}
+	user, host := ParseHostSpecToUserHost(ui.HostEntry.Text)
+
+	// a new host starts with the jobs of the one before, a configured one
+	// keeps its own settings
+	if _, ok := ui.config.Hosts[ui.HostEntry.Text]; !ok {
+		ui.config.Hosts[ui.HostEntry.Text] = ui.config.Hosts[ui.config.Host]
+	}
+
+	ui.SetHostConfig(ui.HostEntry.Text)
+	ui.SetHostConn(ui.HostEntry.Text)
+
+	ui.HostEntry.SetOptions(maps.Keys(ui.config.Hosts))
+
+	// fmt.Println((ui.config))
+
+	ui.Editor.Menu.ClearSelected()
+	ui.Viewer.Menu.ClearSelected()
+
+	ui.Editor.View.SetText("")
+	ui.Viewer.View.SetText("")
+
+	// ui.Editor.Menu.Disable()
+	ui.Editor.addConfig.Disable()
+	ui.Editor.DelConfig.Disable()
+	ui.Editor.EditConfig.Disable()
+	// ui.Viewer.Menu.Disable()
+	ui.Viewer.addConfig.Disable()
+	ui.Viewer.DelConfig.Disable()
+	ui.Viewer.EditConfig.Disable()
+
+	ui.config.Save()
+
+	ui.SetConnected(ui.HostEntry.Text)
+	ui.showMessage(fmt.Sprintf(
+		"successfully connected as %s to %s", user, host))
+
+	ui.hideProgress(fmt.Sprintf(
+		"success: connected to %s as %s%s%s", host, user, ui.conn.route(), ui.conn.cert_status()))
+
+	ui.installKey(ui.HostEntry.Text)
+}
+
+// confirmHostKey asks whether to trust a host key seen for the first time,
+// records it in the config's known_hosts store and connects again if so.
+func (ui *Tools) confirmHostKey(unknown *unknownHostKeyError) {
+
+	msg := fmt.Sprintf(
+		"The authenticity of host %s can't be established.\n"+
+			"%s key fingerprint is\n%s\n\nTrust this key and connect?",
+		unknown.host, unknown.key.Type(), unknown.fingerprint())
+
+	dialog.ShowConfirm("Unknown host key", msg, func(ok bool) {
+		if !ok {
+			return
+		}
+		err := trust_host_key(ui.config.KnownHostsFile(), unknown.host, unknown.key)
+		if err != nil {
+			ui.showError("fail: saving host key: " + err.Error())
+			return
+		}
+		ui.ConnectBtn.OnTapped()
+	}, ui.Window)
+
+}
+
+// installKey puts our public key on the connected host when its InstallKey
+// policy says so, asking first for "ask".
+func (ui *Tools) installKey(host string) {
+
+	h := ui.config.Hosts[host]
+	if h.InstallKey != installAsk && h.InstallKey != installAlways {
+		return
+	}
+
+	key := ui.conn.key_file
+	missing, err := ui.conn.missing_key(key, h.AuthorizedKeys)
+	if err != nil {
+		ui.showError("fail: checking for our key: " + err.Error())
+		return
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	install := func() {
+		installs, err := ui.conn.install_key(key, h.AuthorizedKeys, ui.config.KeyRecordFile())
+		if err != nil {
+			ui.showError("fail: installing key: " + err.Error())
+			return
+		}
+		var files []string
+		for _, k := range installs {
+			if k.status == "installed" {
+				files = append(files, k.file)
+			}
+		}
+		ui.showMessage(fmt.Sprintf(
+			"installed %s.pub in %s", key, strings.Join(files, ", ")))
+	}
+
+	if h.InstallKey == installAlways {
+		install()
+		return
+	}
+
+	msg := fmt.Sprintf("Add %s.pub to\n%s\non %s?",
+		key, strings.Join(missing, "\n"), ui.conn.host)
+	dialog.ShowConfirm("Install key", msg, func(ok bool) {
+		if ok {
+			ui.startJob("installing "+key+".pub", func(context.Context) { install() })
+		}
+	}, ui.Window)
+
+}
+
+// uninstallKey removes the key lines recorded as added to the connected
+// host, after asking.
+func (ui *Tools) uninstallKey() {
+
+	if !ui.conn.isConnected() {
+		ui.showError("fail: connect to the host to remove our key from it")
+		return
+	}
+
+	msg := fmt.Sprintf("Remove the keys we added to %s?", ui.conn.host)
+	dialog.ShowConfirm("Uninstall key", msg, func(ok bool) {
+		if !ok {
+			return
+		}
+		ui.startJob("removing our key", func(context.Context) {
+			removed, err := ui.conn.uninstall_keys(ui.config.KeyRecordFile())
+			if err != nil {
+				ui.showError("fail: " + err.Error())
+				return
+			}
+			if len(removed) == 0 {
+				ui.showMessage("no keys of ours recorded on " + ui.conn.host)
+				return
+			}
+			var files []string
+			for _, r := range removed {
+				files = append(files, r.File)
+			}
+			ui.showMessage(fmt.Sprintf(
+				"removed our key from %s on %s", strings.Join(files, ", "), ui.conn.host))
+		})
+	}, ui.Window)
+
+}
+
+// rotateKey replaces our key with a new one on every configured host, after
+// asking, and shows how each host went.
+func (ui *Tools) rotateKey() {
+
+	key := ui.PrivateKey.Text
+	if key == "" {
+		key = find_identity()
+	}
+	if key == "" {
+		key = default_key_file()
+	}
+	if !path_exists(key) {
+		ui.showError("fail: no key to rotate at " + key)
+		return
+	}
+
+	n := 0
+	for host := range ui.config.Hosts {
+		if host != "" {
+			n++
+		}
+	}
+
+	msg := fmt.Sprintf(
+		"Replace %s with a new key on all %d configured hosts?\n"+
+			"The old public key is removed from the hosts once all of them take the new key.",
+		key, n)
+
+	dialog.ShowConfirm("Rotate key", msg, func(ok bool) {
+		if !ok {
+			return
+		}
+		ui.startJob("rotating "+key, func(ctx context.Context) {
+			ui.showProgress("rotating " + key + "...")
+			results, archive, err := rotate_key(ctx, ui.config, key, ui.config.KeyType, ui.config.KeyBits,
+				ui.Password.Text, ui.askNewPassphrase)
+			report := rotate_report(key, results, archive)
+			if err != nil {
+				report += "\n" + err.Error() + "\n"
+			}
+			ui.hideProgress("key rotation finished")
+
+			view := widget.NewMultiLineEntry()
+			view.TextStyle = fyne.TextStyle{Monospace: true}
+			view.SetText(report)
+			d := dialog.NewCustom("Key rotation", "Close", view, ui.Window)
+			d.Resize(fyne.NewSize(600, 400))
+			d.Show()
+		})
+	}, ui.Window)
+
+}
+
+// askChallenge shows the prompts of a keyboard-interactive login, a one
+// time code say, in a form and waits for the answers. It blocks so it must
+// not run on the ui goroutine, jobs run on ui.jobs.
+func (ui *Tools) askChallenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+
+	var items []*widget.FormItem
+	if instruction != "" {
+		items = append(items, widget.NewFormItem("", widget.NewLabel(strings.TrimSpace(instruction))))
+	}
+	entries := make([]*widget.Entry, len(questions))
+	for i, q := range questions {
+		if echos[i] {
+			entries[i] = widget.NewEntry()
+		} else {
+			entries[i] = widget.NewPasswordEntry()
+		}
+		items = append(items, widget.NewFormItem(strings.TrimSpace(q), entries[i]))
+	}
+
+	title := name
+	if title == "" {
+		title = "Log in to " + ui.conn.host
+	}
+
+	done := make(chan bool)
+	dialog.ShowForm(title, "Log in", "Cancel", items, func(ok bool) {
+		done <- ok
+	}, ui.Window)
+	if len(entries) > 0 {
+		ui.Window.Canvas().Focus(entries[0])
+	}
+	if !<-done {
+		return nil, errors.New("login cancelled")
+	}
+
+	answers := make([]string, len(entries))
+	for i, e := range entries {
+		answers[i] = e.Text
+	}
+
+	return answers, nil
+}
+
+// askNewPassphrase asks for the passphrase of a key about to be generated
+// at file, twice to catch typos. It blocks like askChallenge.
+func (ui *Tools) askNewPassphrase(file string) ([]byte, error) {
+
+	entry := widget.NewPasswordEntry()
+	again := widget.NewPasswordEntry()
+	items := []*widget.FormItem{
+		widget.NewFormItem("", widget.NewLabel("A new key is generated at "+file+".\nLeave the passphrase empty for none.")),
+		widget.NewFormItem("Passphrase", entry),
+		widget.NewFormItem("Again", again),
+	}
+
+	done := make(chan bool)
+	dialog.ShowForm("New key", "Generate", "Cancel", items, func(ok bool) {
+		done <- ok
+	}, ui.Window)
+	ui.Window.Canvas().Focus(entry)
+	if !<-done {
+		return nil, errors.New("generating the key was cancelled")
+	}
+	if entry.Text != again.Text {
+		return nil, errors.New("the passphrases do not match")
+	}
+	if entry.Text == "" {
+		return nil, nil
+	}
+
+	return []byte(entry.Text), nil
+}
+
+// askPassphrase prompts for the passphrase of an encrypted private key,
+// caches it for the session and connects again.
+func (ui *Tools) askPassphrase(need *passphraseNeededError) {
+
+	entry := widget.NewPasswordEntry()
+	msg := "Passphrase for " + need.file
+	if need.incorrect {
+		msg = "Incorrect passphrase, try again"
+	}
+
+	dialog.ShowForm(msg, "Unlock", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Passphrase", entry)},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			cache_passphrase(need.file, []byte(entry.Text))
+			ui.ConnectBtn.OnTapped()
+		}, ui.Window)
+
+}
+
+// askUnlock asks for the passphrase of an encrypted private key like
+// askPassphrase, blocking until it is given, for jobs about to use the key
+// on several hosts. Cancelling gives none.
+func (ui *Tools) askUnlock(need *passphraseNeededError) ([]byte, error) {
+
+	entry := widget.NewPasswordEntry()
+	msg := "Passphrase for " + need.file
+	if need.incorrect {
+		msg = "Incorrect passphrase, try again"
+	}
+
+	done := make(chan bool)
+	dialog.ShowForm(msg, "Unlock", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Passphrase", entry)},
+		func(ok bool) {
+			done <- ok
+		}, ui.Window)
+	ui.Window.Canvas().Focus(entry)
+	if !<-done {
+		return nil, nil
+	}
+
+	return []byte(entry.Text), nil
+}
+
 func (ui *Tools) showMessage(s string) {
 	ui.Editor.Status.SetText(s)
 	ui.Viewer.Status.SetText(s)
@@ -252,6 +699,46 @@ func (ui *Tools) hideProgress(s string) {
 	ui.HelpProgress.Hide()
 }
 
+// startJob runs job on the connection's executor, saying so when another
+// job is in the way.
+func (ui *Tools) startJob(name string, job func(ctx context.Context)) bool {
+	err := ui.jobs.start(name, job)
+	if err != nil {
+		ui.showError("busy: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// setBusy shows the Cancel buttons while a job runs and disables what
+// would start another, enabling it again once the job is over.
+func (ui *Tools) setBusy(job string) {
+
+	if job != "" {
+		ui.idle = nil
+		for _, w := range []fyne.Disableable{ui.ConnectBtn, ui.Editor.Menu, ui.Viewer.Menu} {
+			if !w.Disabled() {
+				w.Disable()
+				ui.idle = append(ui.idle, w)
+			}
+		}
+		ui.Editor.Cancel.Show()
+		ui.Viewer.Cancel.Show()
+		return
+	}
+
+	ui.Editor.Cancel.Hide()
+	ui.Viewer.Cancel.Hide()
+	for _, w := range ui.idle {
+		w.Enable()
+	}
+	ui.idle = nil
+	// the job may have connected again
+	if ui.conn.isConnected() {
+		ui.ConnectBtn.Disable()
+	}
+}
+
 func (ui *Tools) SetHostConfig(host string) {
 
 	ui.config.Host = host
@@ -333,6 +820,44 @@ func (ui *Tools) SetConfig(config *Config) {
 	// ui.HostEntry = widget.NewSelectEntry(maps.Keys(ui.config.Hosts))
 	ui.HostEntry.SetOptions(maps.Keys(ui.config.Hosts))
 	ui.HostEntry.SetText(ui.config.DefaultHost())
+	ui.Fanout.setConfig(config)
+}
+
+// ImportSshConfig adds a host for every Host name in ~/.ssh/config that is
+// not configured yet, with the jobs of the current host.
+func (ui *Tools) ImportSshConfig() (int, error) {
+
+	sc, err := load_ssh_config()
+	if err != nil {
+		return 0, err
+	}
+
+	current := ui.config.Hosts[ui.config.Host]
+
+	n := 0
+	for _, name := range sc.hosts() {
+		if _, ok := ui.config.Hosts[name]; ok {
+			continue
+		}
+		hc := sc.lookup(name, "")
+		desc := "~/.ssh/config"
+		if hc.HostName != "" {
+			desc += ": " + hc.HostName
+		}
+		ui.config.Hosts[name] = Host{
+			Desc:    desc,
+			Editors: current.Editors,
+			Viewers: current.Viewers,
+		}
+		n++
+	}
+
+	if n > 0 {
+		ui.HostEntry.SetOptions(maps.Keys(ui.config.Hosts))
+		err = ui.config.Save()
+	}
+
+	return n, err
 }
 
 func (ui *Tools) editJob(e *Editor) {
@@ -345,12 +870,34 @@ func (ui *Tools) editJob(e *Editor) {
 	value3 := widget.NewEntry()
 	label4 := widget.NewLabel("Command")
 	value4 := widget.NewEntry()
+	label5 := widget.NewLabel("Validate")
+	value5 := widget.NewEntry()
+	label6 := widget.NewLabel("Backups")
+	value6 := widget.NewEntry()
+	label7 := widget.NewLabel("Rollback")
+	value7 := widget.NewCheck("restore and run again if the command fails", func(bool) {})
+	label8 := widget.NewLabel("Follow")
+	value8 := widget.NewCheck("run until stopped, like logread -f", func(bool) {})
+	label9 := widget.NewLabel("Lines")
+	value9 := widget.NewEntry()
 	okButton := widget.NewButton("OK", func() {
-		e.EditorConfig[value1.Text] = Job{
-			"Desc": value2.Text,
-			"file": value3.Text,
-			"cmd":  value4.Text,
+		// keep any settings the form does not show
+		job := Job{}
+		for k, v := range e.EditorConfig[e.Menu.Selected] {
+			job[k] = v
 		}
+		job["Desc"] = value2.Text
+		job["file"] = value3.Text
+		job["cmd"] = value4.Text
+		if e.writeable {
+			job["validate"] = value5.Text
+			job["backups"] = value6.Text
+			job["rollback"] = strconv.FormatBool(value7.Checked)
+		} else {
+			job["follow"] = strconv.FormatBool(value8.Checked)
+			job["lines"] = value9.Text
+		}
+		e.EditorConfig[value1.Text] = job
 		// Editors: ui.EditorConfig.Hosts[ui.HostEntry.Text].Editors,
 		// Viewers: ui.EditorConfig.Hosts[ui.HostEntry.Text].Viewers,
 		// }
@@ -367,6 +914,14 @@ func (ui *Tools) editJob(e *Editor) {
 	value2.SetText(e.EditorConfig[e.Menu.Selected]["Desc"])
 	value3.SetText(e.EditorConfig[e.Menu.Selected]["file"])
 	value4.SetText(e.EditorConfig[e.Menu.Selected]["cmd"])
+	value5.SetText(e.EditorConfig[e.Menu.Selected]["validate"])
+	value5.PlaceHolder = "eg nft -c -f \"$FILE\""
+	value6.SetText(e.EditorConfig[e.Menu.Selected]["backups"])
+	value6.PlaceHolder = strconv.Itoa(defaultBackups)
+	value7.SetChecked(job_rollback(e.EditorConfig[e.Menu.Selected]))
+	value8.SetChecked(job_follow(e.EditorConfig[e.Menu.Selected]))
+	value9.SetText(e.EditorConfig[e.Menu.Selected]["lines"])
+	value9.PlaceHolder = strconv.Itoa(defaultLines)
 	value2.MultiLine = true
 	value2.Wrapping = fyne.TextWrapBreak
 	value4.MultiLine = true
@@ -376,10 +931,11 @@ func (ui *Tools) editJob(e *Editor) {
 
 	if e.writeable {
 		form1 = container.New(layout.NewFormLayout(),
-			label1, value1, label2, value2, label3, value3)
+			label1, value1, label2, value2, label3, value3,
+			label5, value5, label6, value6, label7, value7)
 	} else {
 		form1 = container.New(layout.NewFormLayout(),
-			label1, value1, label2, value2)
+			label1, value1, label2, value2, label8, value8, label9, value9)
 	}
 
 	form2 := container.NewBorder(label4, nil, nil, nil,
@@ -389,16 +945,25 @@ func (ui *Tools) editJob(e *Editor) {
 	cont := container.NewBorder(form1, buttons, nil, nil, form2)
 
 	e.editConfigPopup = widget.NewModalPopUp(cont, ui.Window.Canvas())
-	e.editConfigPopup.Resize(fyne.NewSize(400, 300))
+	e.editConfigPopup.Resize(fyne.NewSize(400, 400))
 	e.editConfigPopup.Show()
 
 }
 
+// runJob loads the job's file or runs its command as a job, the Cancel
+// button stopping it.
 func (ui *Tools) runJob(e *Editor, s string) {
+	ui.startJob("loading "+s, func(ctx context.Context) {
+		ui.loadJob(ctx, e, s)
+	})
+}
 
-	if e.hasFile(s) {
+func (ui *Tools) loadJob(ctx context.Context, e *Editor, s string) {
 
-		var err error
+	e.Keys.Disable()
+	e.showResult(nil)
+
+	if e.hasFile(s) {
 
 		e.showProgress("Attempting to load remote file...")
 
@@ -410,26 +975,40 @@ func (ui *Tools) runJob(e *Editor, s string) {
 			return
 		}
 
-		e.text, err = ui.conn.get_content(e.EditorConfig[s]["file"])
+		text, err := ui.conn.get_content_ctx(ctx, e.EditorConfig[s]["file"])
+		if e.jobCancelled(ctx, "loading "+e.EditorConfig[s]["file"]) {
+			return
+		}
 		if err != nil {
 			error_text := fmt.Sprintf(
-				"fail: scp %s : %s", e.EditorConfig[s]["file"], err.Error())
+				"fail: %s %s : %s", ui.conn.transport_name(), e.EditorConfig[s]["file"], err.Error())
 			e.showError(error_text)
 			e.Progress.Hide()
 			return
 		}
+		e.text = text
 
 		e.View.SetText(e.text)
 		// e.Desc.SetText(e.EditorConfig[s]["Desc"])
 		e.View.Enable()
 		e.EnableMenuControls()
 		e.Save.Disable()
+		if e.writeable && is_authorized_keys(e.EditorConfig[s]["file"]) {
+			e.Keys.Enable()
+		}
 
-		e.hideProgress(fmt.Sprintf("success: scp %s", e.EditorConfig[s]["file"]))
+		e.hideProgress(fmt.Sprintf("success: %s %s", ui.conn.transport_name(), e.EditorConfig[s]["file"]))
 
 	} else {
 
-		e.showProgress("Attempting to run remote commands...")
+		job := e.EditorConfig[s]
+		cmd := job["cmd"]
+
+		msg := "Attempting to run remote commands..."
+		if job_follow(job) {
+			msg = fmt.Sprintf("following \"%s\", Cancel stops it", cmd)
+		}
+		e.showProgress(msg)
 
 		// No host we probably have no client remember to set this
 		if e.conn.host == "" {
@@ -437,21 +1016,32 @@ func (ui *Tools) runJob(e *Editor, s string) {
 			return
 		}
 
-		result, err := ui.conn.output(e.EditorConfig[s]["cmd"])
-		if err != nil {
-			e.err = err
-			err_text := fmt.Sprintf("failed: \"%s\"", e.EditorConfig[s]["cmd"])
+		// the output stays in the view however the command ends
+		e.View.SetText("")
+		e.View.Enable()
+		var res *JobResult
+		e.showStream(job_lines(job), func(line func(string)) {
+			res = ui.conn.run_job(ctx, cmd, line)
+		})
+		e.showResult(res)
+		e.EnableMenuControls()
+
+		if ctx.Err() != nil && job_follow(job) {
+			e.hideProgress(fmt.Sprintf("stopped following \"%s\"", cmd))
+			return
+		}
+		if e.jobCancelled(ctx, fmt.Sprintf("\"%s\"", cmd)) {
+			return
+		}
+		if res.Err != nil {
+			e.err = res.Err
+			err_text := fmt.Sprintf("failed: \"%s\", %s", cmd, res.summary())
 			e.showError(err_text)
 			e.hideProgress(err_text)
-			e.View.SetText("")
-			e.View.Disable()
 			return
 		}
 
-		e.View.SetText(result)
-		e.View.Enable()
-		e.EnableMenuControls()
-		e.hideProgress("command ran successfully")
+		e.hideProgress(fmt.Sprintf("success: \"%s\", %s", cmd, res.summary()))
 
 	}
 
@@ -475,43 +1065,395 @@ func (ui *Tools) saveJob(e *Editor) {
 		return
 	}
 
-	err := e.conn.set_content(e.View.Text, e.EditorConfig[e.Menu.Selected]["file"])
+	// someone else may have saved the file since we loaded it
+	remote, err := ui.conn.get_content(e.EditorConfig[e.Menu.Selected]["file"])
 	if err != nil {
-		error_text := "failed: set_content: " + err.Error()
+		error_text := "failed: checking for remote changes: " + err.Error()
 		e.showError(error_text)
 		e.hideProgress(error_text)
 		return
 	}
+	if remote != e.text {
+		e.hideProgress(fmt.Sprintf(
+			"\"%s\" was changed on the remote since it was loaded",
+			e.EditorConfig[e.Menu.Selected]["file"]))
+		ui.mergeJob(e, remote)
+		return
+	}
 
-	e.text = e.View.Text
-
-	e.showMessage(fmt.Sprintf("successfully saved \"%s\"", e.EditorConfig[e.Menu.Selected]["file"]))
+	job := e.EditorConfig[e.Menu.Selected]
+	file := job["file"]
+	previous := e.text
+
+	res, err := ui.conn.save_job(job, e.View.Text, previous)
+	e.showResult(res)
+	var failed *commandError
+	if errors.As(err, &failed) {
+		e.text = e.View.Text
+		if failed.rolledBack {
+			// the edits stay in the view so they can be fixed and saved again
+			e.text = previous
+			e.View.OnChanged(e.View.Text)
+		}
+		error_text := fmt.Sprintf("%s, %s", err, res.summary())
+		e.showError(error_text)
+		e.hideProgress(error_text)
+		return
+	}
+	if err != nil {
+		error_text := "failed: save_content: " + err.Error()
+		var invalid *validationError
+		if errors.As(err, &invalid) {
+			error_text = fmt.Sprintf("failed: \"%s\" not saved, %s", file, err)
+		}
+		e.showError(error_text)
+		e.hideProgress(error_text)
+		return
+	}
 
-	if val, ok := e.EditorConfig[e.Menu.Selected]["cmd"]; ok {
+	e.text = e.View.Text
 
-		// run command associated with saving file
-		err = e.conn.run(val)
-		if err != nil {
-			error_text := fmt.Sprintf(
-				"failed running \"%s\"", val)
-			e.showError(error_text)
-			e.hideProgress(error_text)
-		}
+	if val, ok := job["cmd"]; ok && val != "" {
 		e.hideProgress(fmt.Sprintf(
-			"success: saved \"%s\" and ran \"%s\"",
-			e.EditorConfig[e.Menu.Selected]["file"],
+			"success: saved \"%s\" and ran \"%s\", %s",
+			file,
 			val,
+			res.summary(),
 		))
-
+		return
 	}
 
 	e.hideProgress(fmt.Sprintf(
 		"success: saved \"%s\"",
-		e.EditorConfig[e.Menu.Selected]["file"],
+		file,
 	))
 
 }
 
+// confirmSave shows what saving the editor will change on the remote and
+// which command will run afterwards, and saves if the user agrees.
+func (ui *Tools) confirmSave(e *Editor) {
+
+	if !(e.writeable && e.hasFile(e.Menu.Selected)) {
+		return
+	}
+
+	file := e.EditorConfig[e.Menu.Selected]["file"]
+
+	diff := widget.NewRichText()
+	for _, l := range unified_diff(e.text, e.View.Text, 3) {
+		style := widget.RichTextStyleCodeBlock
+		switch {
+		case strings.HasPrefix(l, "+"):
+			style.ColorName = theme.ColorNameSuccess
+		case strings.HasPrefix(l, "-"):
+			style.ColorName = theme.ColorNameError
+		case strings.HasPrefix(l, "@@"):
+			style.ColorName = theme.ColorNamePrimary
+		}
+		diff.Segments = append(diff.Segments, &widget.TextSegment{Style: style, Text: l})
+	}
+	if len(diff.Segments) == 0 {
+		diff.Segments = append(diff.Segments, &widget.TextSegment{
+			Style: widget.RichTextStyleInline, Text: "no changes"})
+	}
+	diff.Refresh()
+
+	msg := fmt.Sprintf("Save \"%s\"", file)
+	if cmd := e.EditorConfig[e.Menu.Selected]["cmd"]; cmd != "" {
+		msg += fmt.Sprintf(" and run \"%s\"", cmd)
+	}
+
+	content := container.NewBorder(widget.NewLabel(msg+"?"), nil, nil, nil,
+		container.NewScroll(diff))
+
+	d := dialog.NewCustomConfirm("Review changes", "Save", "Cancel", content,
+		func(ok bool) {
+			if ok {
+				// a save is not cancelled part way, see save_job
+				ui.startJob("saving "+file, func(context.Context) { ui.saveJob(e) })
+			}
+		}, ui.Window)
+	d.Resize(fyne.NewSize(600, 500))
+	d.Show()
+
+}
+
+// mergeJob shows the version the edits started from, the edits and the
+// remote version that changed in the meantime, along with a merge of the
+// two to save instead.
+func (ui *Tools) mergeJob(e *Editor, remote string) {
+
+	var popup *widget.PopUp
+
+	merged, clean := merge3(e.text, e.View.Text, remote)
+
+	view := func(text string) *widget.Entry {
+		w := widget.NewMultiLineEntry()
+		w.TextStyle = fyne.TextStyle{Monospace: true, TabWidth: 4}
+		w.SetText(text)
+		w.Disable()
+		return w
+	}
+
+	mergedView := widget.NewMultiLineEntry()
+	mergedView.TextStyle = fyne.TextStyle{Monospace: true, TabWidth: 4}
+	mergedView.SetText(merged)
+
+	status := widget.NewLabel("")
+	saveButton := widget.NewButton("Save merged", func() {
+		popup.Hide()
+		e.text = remote
+		e.View.SetText(mergedView.Text)
+		ui.confirmSave(e)
+	})
+	mergedView.OnChanged = func(s string) {
+		if has_conflict_markers(s) {
+			status.SetText("resolve the conflicts marked in the merge to save it")
+			saveButton.Disable()
+		} else {
+			status.SetText("no conflicts, review the merge and save it")
+			saveButton.Enable()
+		}
+	}
+	mergedView.OnChanged(merged)
+	if !clean {
+		status.SetText("both sides changed the same lines, resolve the marked conflicts")
+	}
+
+	remoteButton := widget.NewButton("Use remote", func() {
+		popup.Hide()
+		e.text = remote
+		e.View.SetText(remote)
+		e.hideProgress("loaded the remote version, your edits were discarded")
+	})
+	cancelButton := widget.NewButton("Cancel", func() {
+		popup.Hide()
+	})
+
+	tabs := container.NewAppTabs(
+		container.NewTabItem("Merged", mergedView),
+		container.NewTabItem("Mine", view(e.View.Text)),
+		container.NewTabItem("Remote", view(remote)),
+		container.NewTabItem("Base", view(e.text)),
+	)
+
+	buttons := container.NewGridWithColumns(3, cancelButton, remoteButton, saveButton)
+	cont := container.NewBorder(status, buttons, nil, nil, tabs)
+
+	popup = widget.NewModalPopUp(cont, ui.Window.Canvas())
+	popup.Resize(fyne.NewSize(600, 500))
+	popup.Show()
+
+}
+
+// keysJob shows the editor's authorized_keys file a key per line, with its
+// options, type, fingerprint and comment, for adding, editing and removing
+// keys. Saving goes through confirmSave like the editor's own Save.
+func (ui *Tools) keysJob(e *Editor) {
+
+	var popup *widget.PopUp
+
+	keys := parse_authorized_keys(e.View.Text)
+	selected := -1
+
+	status := widget.NewLabel("")
+	list := widget.NewList(
+		func() int { return len(keys) },
+		func() fyne.CanvasObject {
+			l := widget.NewLabel("")
+			l.TextStyle = fyne.TextStyle{Monospace: true}
+			return l
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			o.(*widget.Label).SetText(keys[id].describe())
+		},
+	)
+
+	saveButton := widget.NewButton("Save", func() {
+		popup.Hide()
+		e.View.SetText(authorized_keys_text(keys))
+		ui.confirmSave(e)
+	})
+	saveButton.Disable()
+
+	update := func() {
+		mark_duplicates(keys)
+		list.Refresh()
+		var n, dups, bad int
+		for _, k := range keys {
+			switch {
+			case k.err != nil:
+				bad++
+			case k.key != nil && k.duplicate >= 0:
+				dups++
+				n++
+			case k.key != nil:
+				n++
+			}
+		}
+		status.SetText(fmt.Sprintf(
+			"%d keys, %d duplicates, %d lines that do not parse", n, dups, bad))
+	}
+	update()
+
+	// edit shows a form for the key at i, or a new key when i is -1
+	edit := func(i int) {
+		options := widget.NewEntry()
+		options.PlaceHolder = "restrict,from=\"10.0.0.0/8\""
+		key := widget.NewEntry()
+		key.PlaceHolder = "ssh-ed25519 AAAA... or a whole .pub line"
+		comment := widget.NewEntry()
+		comment.PlaceHolder = "user@host"
+		if i >= 0 {
+			k := keys[i]
+			options.SetText(strings.Join(k.options, ","))
+			comment.SetText(k.comment)
+			key.SetText(k.key_text())
+			if k.key == nil {
+				key.SetText(k.line)
+			}
+		}
+		check := func(string) error {
+			_, err := new_authorized_key(options.Text, key.Text, comment.Text)
+			return err
+		}
+		options.Validator = check
+		key.Validator = check
+
+		title := "Add key"
+		if i >= 0 {
+			title = "Edit key"
+		}
+		dialog.ShowForm(title, "OK", "Cancel",
+			[]*widget.FormItem{
+				widget.NewFormItem("Options", options),
+				widget.NewFormItem("Key", key),
+				widget.NewFormItem("Comment", comment),
+			},
+			func(ok bool) {
+				if !ok {
+					return
+				}
+				k, err := new_authorized_key(options.Text, key.Text, comment.Text)
+				if err != nil {
+					dialog.ShowError(err, ui.Window)
+					return
+				}
+				if i >= 0 {
+					keys[i] = k
+				} else {
+					keys = append(keys, k)
+				}
+				saveButton.Enable()
+				update()
+			}, ui.Window)
+	}
+
+	editButton := widget.NewButton("Edit", func() {
+		if selected >= 0 {
+			edit(selected)
+		}
+	})
+	removeButton := widget.NewButton("Remove", func() {
+		if selected < 0 {
+			return
+		}
+		keys = append(keys[:selected], keys[selected+1:]...)
+		list.UnselectAll()
+		saveButton.Enable()
+		update()
+	})
+	editButton.Disable()
+	removeButton.Disable()
+
+	list.OnSelected = func(id widget.ListItemID) {
+		selected = id
+		editButton.Enable()
+		removeButton.Enable()
+	}
+	list.OnUnselected = func(widget.ListItemID) {
+		selected = -1
+		editButton.Disable()
+		removeButton.Disable()
+	}
+
+	addButton := widget.NewButton("Add", func() { edit(-1) })
+	cancelButton := widget.NewButton("Cancel", func() {
+		popup.Hide()
+	})
+
+	buttons := container.NewGridWithColumns(5,
+		addButton, editButton, removeButton, cancelButton, saveButton)
+	cont := container.NewBorder(status, buttons, nil, nil, list)
+
+	popup = widget.NewModalPopUp(cont, ui.Window.Canvas())
+	popup.Resize(fyne.NewSize(600, 500))
+	popup.Show()
+
+}
+
+// restoreJob puts back the previous version of the editor's file, kept by
+// saveJob, reloads it and runs the job's command.
+func (ui *Tools) restoreJob(e *Editor) {
+
+	if !(e.writeable && e.hasFile(e.Menu.Selected)) {
+		return
+	}
+
+	file := e.EditorConfig[e.Menu.Selected]["file"]
+
+	msg := fmt.Sprintf("Replace \"%s\" with its previous version?", file)
+	if cmd := e.EditorConfig[e.Menu.Selected]["cmd"]; cmd != "" {
+		msg += fmt.Sprintf("\n\"%s\" will be run afterwards.", cmd)
+	}
+
+	dialog.ShowConfirm("Restore previous version", msg, func(ok bool) {
+
+		if !ok {
+			return
+		}
+
+		ui.startJob("restoring "+file, func(ctx context.Context) {
+
+			e.showProgress("Attempting to restore remote file...")
+
+			backup, err := ui.conn.restore_backup(file)
+			if err != nil {
+				error_text := "failed: restore: " + err.Error()
+				e.showError(error_text)
+				e.hideProgress(error_text)
+				return
+			}
+
+			ui.loadJob(ctx, e, e.Menu.Selected)
+
+			val := e.EditorConfig[e.Menu.Selected]["cmd"]
+			if val != "" {
+				res := ui.conn.run_job(ctx, val, nil)
+				e.showResult(res)
+				if e.jobCancelled(ctx, fmt.Sprintf("running \"%s\"", val)) {
+					return
+				}
+				if res.Err != nil {
+					error_text := fmt.Sprintf(
+						"restored \"%s\" but failed running \"%s\", %s", backup, val, res.summary())
+					e.showError(error_text)
+					e.hideProgress(error_text)
+					return
+				}
+				e.hideProgress(fmt.Sprintf(
+					"success: restored \"%s\" and ran \"%s\", %s", backup, val, res.summary()))
+				return
+			}
+
+			e.hideProgress(fmt.Sprintf("success: restored \"%s\"", backup))
+		})
+
+	}, ui.Window)
+
+}
+
 func NewTools() Tools {
 
 	ui := Tools{
@@ -521,6 +1463,7 @@ func NewTools() Tools {
 		HostDescLabel: widget.NewLabel(""),
 		Password:      widget.NewPasswordEntry(),
 		ConnectBtn:    widget.NewButton("Connect", func() {}),
+		ConnState:     widget.NewLabel("not connected"),
 		PrivateKey:    widget.NewEntry(),
 		HelpView:      widget.NewRichTextFromMarkdown("* Text"),
 		HelpStatus:    widget.NewLabel("Status..."),
@@ -530,13 +1473,17 @@ func NewTools() Tools {
 		config:        NewConfigAcl(),
 		delHost:       widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {}),
 		MenuOpen:      fyne.NewMenuItem("Open", nil),
-		editHost:      widget.NewButtonWithIcon("", theme.DocumentCreateIcon(), func() {}),
+		MenuImport:    fyne.NewMenuItem("Import ~/.ssh/config", nil),
+		MenuRotate:    fyne.NewMenuItem("Rotate key", nil),
+		EditHost:      widget.NewButtonWithIcon("", theme.DocumentCreateIcon(), func() {}),
 	}
 
 	// ui.App = app.New()
 	ui.Window = ui.App.NewWindow("ssh tools")
 	ui.Editor = NewEditor()
 	ui.Viewer = NewEditor()
+	ui.Terminal = NewTerminal()
+	ui.Fanout = NewFanout()
 
 	ui.Editor.writeable = true
 
@@ -608,11 +1555,9 @@ func NewTools() Tools {
 	}
 
 	ui.HostDesc.OnChanged = func(s string) {
-		ui.config.Hosts[ui.config.Host] = Host{
-			Desc:    s,
-			Editors: ui.config.Hosts[ui.config.Host].Editors,
-			Viewers: ui.config.Hosts[ui.config.Host].Viewers,
-		}
+		h := ui.config.Hosts[ui.config.Host]
+		h.Desc = s
+		ui.config.Hosts[ui.config.Host] = h
 	}
 
 	ui.MenuOpen.Action = func() {
@@ -644,18 +1589,51 @@ func NewTools() Tools {
 		dialog.ShowFileOpen(onChosen, ui.Window)
 	}
 
-	ui.editHost.OnTapped = func() {
+	ui.MenuImport.Action = func() {
+		n, err := ui.ImportSshConfig()
+		if err != nil {
+			ui.showError("fail: importing ~/.ssh/config: " + err.Error())
+			return
+		}
+		ui.showMessage(fmt.Sprintf("imported %d hosts from ~/.ssh/config", n))
+	}
+
+	ui.MenuRotate.Action = ui.rotateKey
+
+	ui.EditHost.OnTapped = func() {
 
 		label1 := widget.NewLabel("Host Specification")
 		value1 := widget.NewLabel(ui.HostEntry.Text)
 		label2 := widget.NewLabel("Description")
 		value2 := widget.NewEntry()
+		label3 := widget.NewLabel("Agent forwarding")
+		value3 := widget.NewCheck("", func(bool) {})
+		label4 := widget.NewLabel("Jump hosts")
+		value4 := widget.NewEntry()
+		label5 := widget.NewLabel("Transport")
+		value5 := widget.NewSelect(transport_names(), func(string) {})
+		label6 := widget.NewLabel("Install key")
+		value6 := widget.NewSelect(install_policies(), func(string) {})
+		label7 := widget.NewLabel("Authorized keys")
+		value7 := widget.NewEntry()
+		uninstallButton := widget.NewButton("Uninstall my key", func() {
+			ui.editHostPopup.Hide()
+			ui.uninstallKey()
+		})
 		okButton := widget.NewButton("OK", func() {
-			ui.config.Hosts[ui.HostEntry.Text] = Host{
-				Desc:    value2.Text,
-				Editors: ui.config.Hosts[ui.HostEntry.Text].Editors,
-				Viewers: ui.config.Hosts[ui.HostEntry.Text].Viewers,
+			h := ui.config.Hosts[ui.HostEntry.Text]
+			h.Desc = value2.Text
+			h.ForwardAgent = value3.Checked
+			h.Jump = value4.Text
+			h.Transport = value5.Selected
+			h.InstallKey = value6.Selected
+			h.AuthorizedKeys = nil
+			for _, f := range strings.Split(value7.Text, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					h.AuthorizedKeys = append(h.AuthorizedKeys, f)
+				}
 			}
+			ui.config.Hosts[ui.HostEntry.Text] = h
 			ui.editHostPopup.Hide()
 		})
 		cancelButton := widget.NewButton("Cancel", func() {
@@ -663,11 +1641,25 @@ func NewTools() Tools {
 		})
 
 		value2.SetText(ui.config.Hosts[ui.HostEntry.Text].Desc)
-		grid := container.New(layout.NewFormLayout(), label1, value1, label2, value2)
+		value3.SetChecked(ui.config.Hosts[ui.HostEntry.Text].ForwardAgent)
+		value4.SetText(ui.config.Hosts[ui.HostEntry.Text].Jump)
+		value4.PlaceHolder = "user@bastion:22,user@inner:2222"
+		value5.PlaceHolder = "automatic"
+		value5.SetSelected(ui.config.Hosts[ui.HostEntry.Text].Transport)
+		value6.PlaceHolder = installNever
+		value6.SetSelected(ui.config.Hosts[ui.HostEntry.Text].InstallKey)
+		value7.SetText(strings.Join(ui.config.Hosts[ui.HostEntry.Text].AuthorizedKeys, ", "))
+		value7.PlaceHolder = "~/.ssh/authorized_keys"
+		if !ui.conn.isConnected() {
+			uninstallButton.Disable()
+		}
+		grid := container.New(layout.NewFormLayout(),
+			label1, value1, label2, value2, label3, value3, label4, value4,
+			label5, value5, label6, value6, label7, value7)
 		cont := container.NewVBox(
 			grid,
 			container.NewGridWithColumns(2,
-				layout.NewSpacer(),
+				uninstallButton,
 				container.NewGridWithColumns(2,
 					cancelButton,
 					okButton,
@@ -680,44 +1672,35 @@ func NewTools() Tools {
 
 	}
 
-	ui.ConnectBtn.OnTapped = func() {
-
-		_ = ui.Connect()
-		user, host := ParseHostSpecToUserHost(ui.HostEntry.Text)
-
-		// fmt.Println()
-		ui.config.Hosts[ui.HostEntry.Text] = ui.config.Hosts[ui.config.Host]
-
-		ui.SetHostConfig(ui.HostEntry.Text)
-		ui.SetHostConn(ui.HostEntry.Text)
-
-		ui.HostEntry.SetOptions(maps.Keys(ui.config.Hosts))
-
-		// fmt.Println((ui.config))
+	ui.jobs = &executor{on_busy: ui.setBusy}
+	ui.Editor.Cancel.OnTapped = ui.jobs.cancel_job
+	ui.Viewer.Cancel.OnTapped = ui.jobs.cancel_job
 
-		ui.Editor.Menu.ClearSelected()
-		ui.Viewer.Menu.ClearSelected()
+	// jobs are off the ui goroutine, so any login can prompt
+	ui.conn.ask_challenge = ui.askChallenge
+	ui.conn.ask_new_passphrase = ui.askNewPassphrase
 
-		ui.Editor.View.SetText("")
-		ui.Viewer.View.SetText("")
+	ui.Terminal.Open.OnTapped = ui.openShell
+	ui.Fanout.Run.OnTapped = ui.runFanout
+	ui.Fanout.Export.OnTapped = ui.exportFanout
 
-		// ui.Editor.Menu.Disable()
-		ui.Editor.addConfig.Disable()
-		ui.Editor.DelConfig.Disable()
-		ui.Editor.EditConfig.Disable()
-		// ui.Viewer.Menu.Disable()
-		ui.Viewer.addConfig.Disable()
-		ui.Viewer.DelConfig.Disable()
-		ui.Viewer.EditConfig.Disable()
-
-		ui.config.Save()
-
-		ui.SetConnected(ui.HostEntry.Text)
-		ui.showMessage(fmt.Sprintf(
-			"successfully connected as %s to %s", user, host))
+	ui.ConnectBtn.OnTapped = func() {
+		ui.startJob("connecting", func(context.Context) { ui.connectHost() })
+	}
 
-		ui.hideProgress(fmt.Sprintf(
-			"success: connected to %s as %s", host, user))
+	// jobs connect again by themselves after the connection is lost,
+	// the button is there to do it now
+	ui.conn.on_state = func(state string, err error) {
+		switch state {
+		case stateConnected:
+			ui.ConnState.SetText("connected to " + ui.conn.host + ui.conn.route())
+			ui.SetUiConnected()
+		case stateLost:
+			ui.ConnState.SetText(fmt.Sprintf(
+				"connection to %s lost: %s, reconnecting on the next job", ui.conn.host, err))
+			ui.ConnectBtn.SetText("Reconnect")
+			ui.ConnectBtn.Enable()
+		}
 	}
 
 	ui.HelpMenu = widget.NewSelect(
@@ -809,7 +1792,9 @@ func NewTools() Tools {
 		ui.runJob(ui.Viewer, s)
 	}
 
-	ui.Editor.Save.OnTapped = func() { ui.saveJob(ui.Editor) }
+	ui.Editor.Save.OnTapped = func() { ui.confirmSave(ui.Editor) }
+	ui.Editor.Restore.OnTapped = func() { ui.restoreJob(ui.Editor) }
+	ui.Editor.Keys.OnTapped = func() { ui.keysJob(ui.Editor) }
 
 	return ui
 }
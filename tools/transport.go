@@ -0,0 +1,207 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// transport moves file content to and from the remote host.
+type transport struct {
+	get func(c *conn, ctx context.Context, remotePath string) (string, error)
+	set func(c *conn, ctx context.Context, text, remotePath string) error
+	// set_like writes the copy that is to replace like, see set_temp_content,
+	// nil when the transport leaves the mode, owner and flushing to others
+	set_like func(c *conn, ctx context.Context, text, remotePath, like string) error
+}
+
+var transports = map[string]transport{
+	"sftp": {(*conn).get_content_sftp, (*conn).set_content_sftp, (*conn).set_content_like_sftp},
+	"scp":  {(*conn).get_content_scp, (*conn).set_content_scp, nil},
+	"cat":  {(*conn).get_content_ssh, (*conn).set_content_ssh, nil},
+}
+
+// the order transports are tried in when the host does not pin one,
+// dropbear routers for instance often come without sftp-server
+var transportOrder = []string{"sftp", "scp", "cat"}
+
+// transport_names lists the transports in the order they are tried, with
+// the empty string for automatic selection first.
+func transport_names() []string {
+	return append([]string{""}, transportOrder...)
+}
+
+// transfer runs f with the transport pinned for the host, or the one that
+// worked last time, or else tries them in order. sftp is passed over when
+// the host has no sftp subsystem and scp when its transfer fails, cat is
+// the last resort and its error is the one returned. A cancelled transfer
+// is not tried again with the next transport.
+func (c *conn) transfer(f func(t transport) error) error {
+
+	if c.transport != "" {
+		t, ok := transports[c.transport]
+		if !ok {
+			return fmt.Errorf("unknown transport %q", c.transport)
+		}
+		return f(t)
+	}
+
+	if c.transport_used != "" {
+		return f(transports[c.transport_used])
+	}
+
+	var errs []string
+	for i, name := range transportOrder {
+		err := f(transports[name])
+		if err == nil {
+			c.transport_used = name
+			return nil
+		}
+		if is_cancelled(err) {
+			return err
+		}
+		last := i == len(transportOrder)-1
+		if (name == "sftp" && !errors.Is(err, errTransportUnavailable)) || last {
+			if len(errs) > 0 {
+				return fmt.Errorf("%w (%s)", err, strings.Join(errs, ", "))
+			}
+			return err
+		}
+		errs = append(errs, name+": "+err.Error())
+	}
+
+	return nil
+}
+
+// transport_name is the transport in use for status messages.
+func (c *conn) transport_name() string {
+	if c.transport != "" {
+		return c.transport
+	}
+	if c.transport_used != "" {
+		return c.transport_used
+	}
+	return "transfer"
+}
+
+func (c *conn) get_content(remotePath string) (string, error) {
+	return c.get_content_ctx(context.Background(), remotePath)
+}
+
+// get_content_ctx reads the file like get_content, giving up when ctx is
+// done.
+func (c *conn) get_content_ctx(ctx context.Context, remotePath string) (string, error) {
+	var result string
+	err := c.transfer(func(t transport) error {
+		var err error
+		result, err = t.get(c, ctx, remotePath)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+func (c *conn) set_content(text, remotePath string) error {
+	return c.set_content_ctx(context.Background(), text, remotePath)
+}
+
+// set_content_ctx writes the file like set_content, giving up when ctx is
+// done.
+func (c *conn) set_content_ctx(ctx context.Context, text, remotePath string) error {
+	return c.transfer(func(t transport) error {
+		return t.set(c, ctx, text, remotePath)
+	})
+}
+
+// set_temp_content writes text to remotePath, a copy that is to replace
+// like. It reports whether the transport gave the copy the mode and owner
+// of like and flushed it to disk, leaving the rest to the caller.
+func (c *conn) set_temp_content(text, remotePath, like string) (bool, error) {
+	kept := false
+	err := c.transfer(func(t transport) error {
+		kept = t.set_like != nil
+		if kept {
+			return t.set_like(c, context.Background(), text, remotePath, like)
+		}
+		return t.set(c, context.Background(), text, remotePath)
+	})
+	return kept, err
+}
+
+// sftp starts an sftp session, closed when ctx is done.
+func (c *conn) sftp(ctx context.Context) (*sftpClient, error) {
+
+	if !c.isConnected() {
+		err := c.Connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sess, err := c.new_session()
+	if err != nil {
+		return nil, err
+	}
+
+	stop := cancel_on_done(ctx, sess)
+	s, err := new_sftp_client(sess)
+	if err != nil {
+		stop()
+		sess.Close()
+		return nil, cancelled(ctx, err)
+	}
+	s.stop = stop
+
+	return s, nil
+}
+
+func (c *conn) get_content_sftp(ctx context.Context, remotePath string) (string, error) {
+
+	// takes a remote file path
+	// returns the contents as a string
+	// using the sftp subsystem
+
+	s, err := c.sftp(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+
+	b, err := s.read_file(remotePath)
+	if err != nil {
+		return "", cancelled(ctx, err)
+	}
+
+	return string(b), nil
+}
+
+func (c *conn) set_content_sftp(ctx context.Context, text, remotePath string) error {
+
+	// takes some text and saves it to a remote file
+	// replacing the existing content
+	// using the sftp subsystem
+
+	s, err := c.sftp(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return cancelled(ctx, s.write_file(remotePath, []byte(text)))
+}
+
+// set_content_like_sftp saves text like set_content_sftp, with the mode and
+// owner of like, see write_file_like.
+func (c *conn) set_content_like_sftp(ctx context.Context, text, remotePath, like string) error {
+
+	s, err := c.sftp(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return cancelled(ctx, s.write_file_like(remotePath, like, []byte(text)))
+}
@@ -0,0 +1,181 @@
+package tools
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// run_sessions serves session channels, running exec requests with sh
+// here and handing subsystem requests to subsystem, which refuses them
+// when nil. A command is killed when its channel is closed.
+func run_sessions(subsystem func(name string, ch ssh.Channel)) func(sc *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+	return func(sc *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+		for nc := range chans {
+			if nc.ChannelType() != "session" {
+				nc.Reject(ssh.UnknownChannelType, "sessions only")
+				continue
+			}
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go run_session(ch, reqs, subsystem)
+		}
+	}
+}
+
+func run_session(ch ssh.Channel, reqs <-chan *ssh.Request, subsystem func(name string, ch ssh.Channel)) {
+
+	for req := range reqs {
+		switch req.Type {
+
+		case "exec":
+			var p struct{ Cmd string }
+			ssh.Unmarshal(req.Payload, &p)
+			req.Reply(true, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				// signals and the like, the channel closing ends them
+				for req := range reqs {
+					req.Reply(false, nil)
+				}
+				cancel()
+			}()
+
+			cmd := exec.CommandContext(ctx, "sh", "-c", p.Cmd)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+			err := cmd.Run()
+			status := make([]byte, 4)
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				binary.BigEndian.PutUint32(status, uint32(exit.ExitCode()))
+			}
+			ch.SendRequest("exit-status", false, status)
+			ch.Close()
+			return
+
+		case "subsystem":
+			var p struct{ Name string }
+			ssh.Unmarshal(req.Payload, &p)
+			if subsystem == nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			subsystem(p.Name, ch)
+			return
+
+		default:
+			req.Reply(req.Type == "env", nil)
+		}
+	}
+}
+
+// exec_host runs a server for run_sessions on a loopback port that takes
+// the password "pw", trusts its host key in the known_hosts file kh and
+// returns a connection to it.
+func exec_host(t *testing.T, kh string, subsystem func(name string, ch ssh.Channel)) *conn {
+	t.Helper()
+
+	config := test_server_config(t, true)
+	hostKey := test_signer(t)
+	config.AddHostKey(hostKey)
+	addr := listen_ssh(t, config, run_sessions(subsystem))
+
+	err := trust_host_key(kh, addr, hostKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &conn{host: "u@" + addr, password: "pw", known_hosts: []string{kh}}
+}
+
+func TestTransferFallback(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	tests := []struct {
+		name      string
+		subsystem func(name string, ch ssh.Channel)
+	}{
+		{"refused", nil},
+		// dropbear and OpenSSH without sftp-server
+		{"accepted, then closed", func(_ string, ch ssh.Channel) { ch.Close() }},
+		{"accepted, then not sftp", func(_ string, ch ssh.Channel) {
+			ch.Write([]byte("sh: sftp-server: not found\n"))
+			ch.Close()
+		}},
+	}
+
+	for _, tt := range tests {
+
+		c := exec_host(t, filepath.Join(t.TempDir(), "known_hosts"), tt.subsystem)
+		err := c.Connect()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		f := filepath.Join(t.TempDir(), "f")
+		text := "line one\n'quoted' $HOME\n"
+		err = c.set_content(text, f)
+		if b, _ := os.ReadFile(f); err != nil || string(b) != text {
+			t.Errorf("%s: wrote %q, %v", tt.name, b, err)
+		}
+		if c.transport_used == "" || c.transport_used == "sftp" {
+			t.Errorf("%s: transport used %q", tt.name, c.transport_used)
+		}
+
+		// what worked is used again
+		used := c.transport_used
+		got, err := c.get_content(f)
+		if err != nil || got != text || c.transport_used != used {
+			t.Errorf("%s: read %q with %s, %v", tt.name, got, c.transport_used, err)
+		}
+
+		// pinned, sftp is not passed over
+		c.transport, c.transport_used = "sftp", ""
+		_, err = c.get_content(f)
+		if !errors.Is(err, errTransportUnavailable) {
+			t.Errorf("%s: pinned sftp: %v", tt.name, err)
+		}
+
+		c.close()
+	}
+}
+
+func TestTransferOtherErrors(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	c := exec_host(t, filepath.Join(t.TempDir(), "known_hosts"), nil)
+	err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	// every transport is tried and the last one's error returned, naming
+	// those before it
+	_, err = c.get_content(filepath.Join(t.TempDir(), "missing"))
+	if err == nil || !strings.Contains(err.Error(), "sftp: ") || c.transport_used != "" {
+		t.Errorf("missing file: %v, used %q", err, c.transport_used)
+	}
+
+	c.transport = "nope"
+	if _, err = c.get_content("/etc/hostname"); err == nil || !strings.Contains(err.Error(), `unknown transport "nope"`) {
+		t.Error(err)
+	}
+}
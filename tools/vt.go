@@ -0,0 +1,601 @@
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// The Terminal tab draws a shell's output with vtScreen, which knows
+// enough of vt100 and the xterm additions for shells, less, top and vi:
+// cursor movement, erasing, scroll regions, the alternate screen and the
+// 16 colours. Other sequences are read and ignored.
+
+// vtCell is a character on the screen, its colours 0 to 15 or -1 for the
+// default.
+type vtCell struct {
+	r       rune
+	fg, bg  int
+	bold    bool
+	reverse bool
+}
+
+var vtBlank = vtCell{r: ' ', fg: -1, bg: -1}
+
+// vtMaxParam is the largest parameter of an escape sequence we keep
+const vtMaxParam = 9999
+
+// parser states
+const (
+	vtNormal = iota
+	vtEsc
+	vtCSI
+	vtOSC
+	vtOSCEsc
+	vtCharset
+)
+
+type vtScreen struct {
+	mu           sync.Mutex
+	rows, cols   int
+	cells        [][]vtCell
+	main         [][]vtCell // the main screen while the alternate one is up
+	x, y         int
+	saveX, saveY int
+	top, bottom  int    // the scroll region, rows inclusive
+	pen          vtCell // colours for what is written next
+	wrap         bool   // at the last column, the next character goes on a new line
+	hideCursor   bool
+	appCursor    bool // arrow keys send ESC O rather than ESC [
+
+	state int
+	seq   []byte // parameters of the escape sequence being read
+	part  []byte // a character split between writes
+
+	// reply answers status requests, such as where the cursor is
+	reply func([]byte)
+}
+
+func new_vt_screen(rows, cols int) *vtScreen {
+	s := &vtScreen{}
+	s.rows, s.cols = rows, cols
+	s.reset()
+	return s
+}
+
+func vt_cells(rows, cols int) [][]vtCell {
+	cells := make([][]vtCell, rows)
+	for i := range cells {
+		cells[i] = vt_row(cols)
+	}
+	return cells
+}
+
+func vt_row(cols int) []vtCell {
+	row := make([]vtCell, cols)
+	for i := range row {
+		row[i] = vtBlank
+	}
+	return row
+}
+
+func min_int(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (s *vtScreen) reset() {
+	s.cells = vt_cells(s.rows, s.cols)
+	s.main = nil
+	s.x, s.y, s.saveX, s.saveY = 0, 0, 0, 0
+	s.top, s.bottom = 0, s.rows-1
+	s.pen = vtBlank
+	s.wrap, s.hideCursor, s.appCursor = false, false, false
+	s.state = vtNormal
+}
+
+// resize changes the size of the screen, keeping the lines around the
+// cursor, and reports whether it changed.
+func (s *vtScreen) resize(rows, cols int) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rows == s.rows && cols == s.cols {
+		return false
+	}
+
+	// lines scroll off the top when the cursor would be below the screen
+	shift := 0
+	if s.y >= rows {
+		shift = s.y - rows + 1
+	}
+	s.cells = vt_resize(s.cells, rows, cols, shift)
+	if s.main != nil {
+		s.main = vt_resize(s.main, rows, cols, shift)
+	}
+
+	s.rows, s.cols = rows, cols
+	s.y -= shift
+	s.top, s.bottom = 0, rows-1
+	s.wrap = false
+	s.clamp()
+
+	// and the saved cursor, restored later on the smaller screen
+	s.saveX, s.saveY = min_int(s.saveX, cols-1), min_int(s.saveY-shift, rows-1)
+	if s.saveY < 0 {
+		s.saveY = 0
+	}
+
+	return true
+}
+
+func vt_resize(cells [][]vtCell, rows, cols, shift int) [][]vtCell {
+	n := vt_cells(rows, cols)
+	for y := range n {
+		if y+shift < len(cells) {
+			copy(n[y], cells[y+shift])
+		}
+	}
+	return n
+}
+
+// size is the screen's size in characters.
+func (s *vtScreen) size() (rows, cols int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rows, s.cols
+}
+
+// app_cursor reports whether the cursor keys are in application mode.
+func (s *vtScreen) app_cursor() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appCursor
+}
+
+// snapshot copies the screen for drawing, with the cursor position and
+// whether it is shown.
+func (s *vtScreen) snapshot() (cells [][]vtCell, x, y int, cursor bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cells = make([][]vtCell, len(s.cells))
+	for i, row := range s.cells {
+		cells[i] = append([]vtCell(nil), row...)
+	}
+	return cells, s.x, s.y, !s.hideCursor
+}
+
+// text is the screen's characters, a line per row without trailing blanks.
+func (s *vtScreen) text() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lines := make([]string, len(s.cells))
+	for i, row := range s.cells {
+		var sb strings.Builder
+		for _, c := range row {
+			sb.WriteRune(c.r)
+		}
+		lines[i] = strings.TrimRight(sb.String(), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s *vtScreen) Write(p []byte) (int, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := p
+	if len(s.part) > 0 {
+		b = append(s.part, p...)
+		s.part = nil
+	}
+
+	for i := 0; i < len(b); {
+		c := b[i]
+		if s.state == vtNormal && c >= utf8.RuneSelf {
+			if !utf8.FullRune(b[i:]) {
+				s.part = append([]byte(nil), b[i:]...)
+				break
+			}
+			r, n := utf8.DecodeRune(b[i:])
+			s.put(r)
+			i += n
+			continue
+		}
+		s.feed(c)
+		i++
+	}
+
+	return len(p), nil
+}
+
+func (s *vtScreen) feed(c byte) {
+
+	switch s.state {
+
+	case vtNormal:
+		switch c {
+		case 0x1b:
+			s.state = vtEsc
+		case '\r':
+			s.x, s.wrap = 0, false
+		case '\n', '\v', '\f':
+			s.line_feed()
+		case '\b':
+			if s.x > 0 {
+				s.x--
+			}
+			s.wrap = false
+		case '\t':
+			s.x = (s.x/8 + 1) * 8
+			if s.x >= s.cols {
+				s.x = s.cols - 1
+			}
+		default:
+			if c >= 0x20 && c != 0x7f {
+				s.put(rune(c))
+			}
+		}
+
+	case vtEsc:
+		s.state = vtNormal
+		switch c {
+		case '[':
+			s.state = vtCSI
+			s.seq = s.seq[:0]
+		case ']':
+			s.state = vtOSC
+		case '(', ')', '*', '+':
+			s.state = vtCharset
+		case '7':
+			s.saveX, s.saveY = s.x, s.y
+		case '8':
+			s.x, s.y, s.wrap = s.saveX, s.saveY, false
+			s.clamp()
+		case 'D':
+			s.line_feed()
+		case 'E':
+			s.x = 0
+			s.line_feed()
+		case 'M':
+			s.reverse_index()
+		case 'c':
+			s.reset()
+		}
+
+	case vtCSI:
+		if c >= 0x40 && c <= 0x7e {
+			s.csi(c, string(s.seq))
+			s.state = vtNormal
+		} else if len(s.seq) < 64 {
+			s.seq = append(s.seq, c)
+		}
+
+	case vtOSC:
+		// window titles and the like, ended by BEL or ESC \
+		if c == 0x07 {
+			s.state = vtNormal
+		} else if c == 0x1b {
+			s.state = vtOSCEsc
+		}
+
+	case vtOSCEsc, vtCharset:
+		s.state = vtNormal
+	}
+}
+
+// put writes r at the cursor and moves it on.
+func (s *vtScreen) put(r rune) {
+	if s.wrap {
+		s.x = 0
+		s.line_feed()
+	}
+	c := s.pen
+	c.r = r
+	s.cells[s.y][s.x] = c
+	if s.x == s.cols-1 {
+		s.wrap = true
+	} else {
+		s.x++
+	}
+}
+
+func (s *vtScreen) line_feed() {
+	s.wrap = false
+	if s.y == s.bottom {
+		s.scroll_up(s.top, 1)
+	} else if s.y < s.rows-1 {
+		s.y++
+	}
+}
+
+func (s *vtScreen) reverse_index() {
+	s.wrap = false
+	if s.y == s.top {
+		s.scroll_down(s.top, 1)
+	} else if s.y > 0 {
+		s.y--
+	}
+}
+
+// scroll_up moves the lines from row to the bottom of the scroll region up
+// by n, blank lines coming in at the bottom.
+func (s *vtScreen) scroll_up(row, n int) {
+	if row < s.top || row > s.bottom {
+		return
+	}
+	n = min_int(n, s.bottom-row+1)
+	for i := row; i <= s.bottom; i++ {
+		if n <= s.bottom-i {
+			s.cells[i] = s.cells[i+n]
+		} else {
+			s.cells[i] = vt_row(s.cols)
+		}
+	}
+}
+
+// scroll_down moves the lines from row to the bottom of the scroll region
+// down by n, blank lines coming in at row.
+func (s *vtScreen) scroll_down(row, n int) {
+	if row < s.top || row > s.bottom {
+		return
+	}
+	n = min_int(n, s.bottom-row+1)
+	for i := s.bottom; i >= row; i-- {
+		if n <= i-row {
+			s.cells[i] = s.cells[i-n]
+		} else {
+			s.cells[i] = vt_row(s.cols)
+		}
+	}
+}
+
+func (s *vtScreen) clamp() {
+	if s.x < 0 {
+		s.x = 0
+	}
+	if s.x >= s.cols {
+		s.x = s.cols - 1
+	}
+	if s.y < 0 {
+		s.y = 0
+	}
+	if s.y >= s.rows {
+		s.y = s.rows - 1
+	}
+}
+
+func (s *vtScreen) erase(y, from, to int) {
+	for x := from; x < to && x < s.cols; x++ {
+		s.cells[y][x] = vtBlank
+	}
+}
+
+func (s *vtScreen) csi(final byte, seq string) {
+
+	private := strings.HasPrefix(seq, "?") || strings.HasPrefix(seq, ">") || strings.HasPrefix(seq, "=")
+	if private {
+		seq = seq[1:]
+	}
+	// sequences with intermediate bytes, such as setting the cursor shape,
+	// are not for us
+	if strings.ContainsAny(seq, " !\"#$%&'()*+,-./") {
+		return
+	}
+
+	var p []int
+	if seq != "" {
+		for _, f := range strings.Split(seq, ";") {
+			// counts past any screen are as good as the screen, and do not
+			// overflow when added to
+			n, _ := strconv.Atoi(f)
+			p = append(p, min_int(n, vtMaxParam))
+		}
+	}
+	arg := func(i, def int) int {
+		if i < len(p) && p[i] > 0 {
+			return p[i]
+		}
+		return def
+	}
+	n := arg(0, 1)
+
+	// of the private sequences only the modes are for us
+	if private && final != 'h' && final != 'l' {
+		return
+	}
+
+	switch final {
+	case 'h', 'l':
+		// the ansi modes, such as insert, are not kept
+		if private {
+			s.set_modes(p, final == 'h')
+		}
+	case 'A':
+		s.y -= n
+	case 'B', 'e':
+		s.y += n
+	case 'C', 'a':
+		s.x += n
+	case 'D':
+		s.x -= n
+	case 'E':
+		s.x, s.y = 0, s.y+n
+	case 'F':
+		s.x, s.y = 0, s.y-n
+	case 'G', '`':
+		s.x = n - 1
+	case 'd':
+		s.y = n - 1
+	case 'H', 'f':
+		s.y, s.x = arg(0, 1)-1, arg(1, 1)-1
+	case 'J':
+		switch arg(0, 0) {
+		case 0:
+			s.erase(s.y, s.x, s.cols)
+			for y := s.y + 1; y < s.rows; y++ {
+				s.erase(y, 0, s.cols)
+			}
+		case 1:
+			s.erase(s.y, 0, s.x+1)
+			for y := 0; y < s.y; y++ {
+				s.erase(y, 0, s.cols)
+			}
+		default:
+			for y := 0; y < s.rows; y++ {
+				s.erase(y, 0, s.cols)
+			}
+		}
+	case 'K':
+		switch arg(0, 0) {
+		case 0:
+			s.erase(s.y, s.x, s.cols)
+		case 1:
+			s.erase(s.y, 0, s.x+1)
+		default:
+			s.erase(s.y, 0, s.cols)
+		}
+	case 'L':
+		s.scroll_down(s.y, n)
+	case 'M':
+		s.scroll_up(s.y, n)
+	case 'S':
+		s.scroll_up(s.top, n)
+	case 'T':
+		s.scroll_down(s.top, n)
+	case 'P':
+		row := s.cells[s.y]
+		for x := s.x; x < s.cols; x++ {
+			if n < s.cols-x {
+				row[x] = row[x+n]
+			} else {
+				row[x] = vtBlank
+			}
+		}
+	case '@':
+		row := s.cells[s.y]
+		for x := s.cols - 1; x >= s.x; x-- {
+			if n <= x-s.x {
+				row[x] = row[x-n]
+			} else {
+				row[x] = vtBlank
+			}
+		}
+	case 'X':
+		s.erase(s.y, s.x, s.x+min_int(n, s.cols))
+	case 'r':
+		top, bottom := arg(0, 1)-1, arg(1, s.rows)-1
+		if top < bottom && bottom < s.rows {
+			s.top, s.bottom = top, bottom
+		} else {
+			s.top, s.bottom = 0, s.rows-1
+		}
+		s.x, s.y = 0, 0
+	case 's':
+		s.saveX, s.saveY = s.x, s.y
+	case 'u':
+		s.x, s.y = s.saveX, s.saveY
+	case 'm':
+		s.sgr(p)
+	case 'n':
+		switch arg(0, 0) {
+		case 5:
+			s.answer("\x1b[0n")
+		case 6:
+			s.answer(fmt.Sprintf("\x1b[%d;%dR", s.y+1, s.x+1))
+		}
+	case 'c':
+		s.answer("\x1b[?1;2c")
+	}
+
+	s.wrap = false
+	s.clamp()
+}
+
+func (s *vtScreen) answer(a string) {
+	if s.reply != nil {
+		s.reply([]byte(a))
+	}
+}
+
+// set_modes handles the private modes we know of: the cursor keys, showing
+// the cursor and the alternate screen.
+func (s *vtScreen) set_modes(modes []int, on bool) {
+	for _, m := range modes {
+		switch m {
+		case 1:
+			s.appCursor = on
+		case 25:
+			s.hideCursor = !on
+		case 47, 1047, 1049:
+			if on && s.main == nil {
+				if m == 1049 {
+					s.saveX, s.saveY = s.x, s.y
+				}
+				s.main = s.cells
+				s.cells = vt_cells(s.rows, s.cols)
+			} else if !on && s.main != nil {
+				s.cells = s.main
+				s.main = nil
+				if m == 1049 {
+					s.x, s.y = s.saveX, s.saveY
+				}
+			}
+		}
+	}
+}
+
+// sgr sets the colours of the pen.
+func (s *vtScreen) sgr(p []int) {
+	if len(p) == 0 {
+		p = []int{0}
+	}
+	for i := 0; i < len(p); i++ {
+		switch n := p[i]; {
+		case n == 0:
+			s.pen = vtBlank
+		case n == 1:
+			s.pen.bold = true
+		case n == 22:
+			s.pen.bold = false
+		case n == 7:
+			s.pen.reverse = true
+		case n == 27:
+			s.pen.reverse = false
+		case n >= 30 && n <= 37:
+			s.pen.fg = n - 30
+		case n == 39:
+			s.pen.fg = -1
+		case n >= 40 && n <= 47:
+			s.pen.bg = n - 40
+		case n == 49:
+			s.pen.bg = -1
+		case n >= 90 && n <= 97:
+			s.pen.fg = n - 90 + 8
+		case n >= 100 && n <= 107:
+			s.pen.bg = n - 100 + 8
+		case n == 38 || n == 48:
+			// 256 and rgb colours, the first 16 of 256 are ours
+			c := -1
+			if i+2 < len(p) && p[i+1] == 5 {
+				if p[i+2] < 16 {
+					c = p[i+2]
+				}
+				i += 2
+			} else if i+1 < len(p) && p[i+1] == 2 {
+				i += 4
+			}
+			if n == 38 {
+				s.pen.fg = c
+			} else {
+				s.pen.bg = c
+			}
+		}
+	}
+}
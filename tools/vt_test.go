@@ -0,0 +1,150 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVTScreen(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		rows, cols int
+		in         string
+		text       string // rows joined by |
+		x, y       int
+	}{
+		{"lines", 3, 5, "ab\r\ncd", "ab|cd|", 2, 1},
+		{"wrap", 3, 3, "abcdef", "abc|def|", 2, 1},
+		{"wrap pending", 2, 3, "abc", "abc|", 2, 0},
+		{"scroll", 2, 3, "a\r\nb\r\nc", "b|c", 1, 1},
+		{"utf8", 1, 5, "é€", "é€", 2, 0},
+		{"tab", 1, 20, "a\tb", "a       b", 9, 0},
+		{"backspace", 1, 5, "ab\bc", "ac", 2, 0},
+
+		{"cursor home", 3, 5, "abc\x1b[Hx", "xbc||", 1, 0},
+		{"cursor to", 3, 5, "\x1b[2;3Hx", "|  x|", 3, 1},
+		{"cursor moves", 5, 10, "\x1b[3;3H\x1b[A\x1b[2C\x1b[B\x1b[3Dx", "|| x||", 2, 2},
+		{"cursor moves stop at the edge", 3, 5, "\x1b[9A\x1b[9Dx\x1b[9B\x1b[9Cy", "x||    y", 4, 2},
+		{"column and row", 3, 5, "\x1b[3d\x1b[4Gx", "||   x", 4, 2},
+		{"next and previous line", 4, 5, "ab\x1b[2Ex\x1b[Fy", "ab|y|x|", 1, 1},
+		{"save and restore", 3, 5, "a\x1b7\x1b[3;3Hb\x1b8c", "ac||  b", 2, 0},
+
+		{"erase to the end", 2, 5, "abcde\x1b[1;3H\x1b[K", "ab|", 2, 0},
+		{"erase from the start", 2, 5, "abcde\x1b[1;3H\x1b[1K", "   de|", 2, 0},
+		{"erase the line", 2, 5, "abcde\x1b[1;3H\x1b[2K", "|", 2, 0},
+		{"erase below", 3, 5, "aaa\r\nbbb\r\nccc\x1b[2;2H\x1b[J", "aaa|b|", 1, 1},
+		{"erase above", 3, 5, "aaa\r\nbbb\r\nccc\x1b[2;2H\x1b[1J", "|  b|ccc", 1, 1},
+		{"clear", 3, 5, "abc\r\ndef\x1b[2J", "||", 3, 1},
+		{"erase characters", 1, 6, "abcdef\x1b[2G\x1b[3X", "a   ef", 1, 0},
+
+		{"insert characters", 1, 6, "abcdef\x1b[2G\x1b[2@", "a  bcd", 1, 0},
+		{"delete characters", 1, 6, "abcdef\x1b[2G\x1b[2P", "adef", 1, 0},
+		{"insert lines", 3, 3, "a\r\nb\r\nc\x1b[2H\x1b[L", "a||b", 0, 1},
+		{"delete lines", 3, 3, "a\r\nb\r\nc\x1b[1H\x1b[2M", "c||", 0, 0},
+		{"scroll up and down", 3, 3, "a\r\nb\r\nc\x1b[S", "b|c|", 1, 2},
+		{"scroll down", 3, 3, "a\r\nb\r\nc\x1b[2T", "||a", 1, 2},
+
+		{"scroll region", 4, 3, "1\r\n2\r\n3\r\n4\x1b[2;3r\x1b[3;1H\n", "1|3||4", 0, 2},
+		{"reverse index in the region", 4, 3, "1\r\n2\r\n3\r\n4\x1b[2;3r\x1b[2;1H\x1bM", "1||2|4", 0, 1},
+		{"delete lines in the region", 4, 3, "1\r\n2\r\n3\r\n4\x1b[2;3r\x1b[2;1H\x1b[M", "1|3||4", 0, 1},
+		{"bad region is the screen", 3, 3, "\x1b[3;2r\x1b[3H\na", "||a", 1, 2},
+
+		{"alternate screen", 2, 5, "main\x1b[?1049h\x1b[Halt", "alt|", 3, 0},
+		{"back from the alternate screen", 2, 5, "main\x1b[?1049h\x1b[2;2Halt\x1b[?1049l", "main|", 4, 0},
+		{"colours and titles are not text", 2, 10, "\x1b[31;1mred\x1b[0m\x1b]0;title\x07.", "red.|", 4, 0},
+		{"cursor shape ignored", 1, 5, "a\x1b[2 qb", "ab", 2, 0},
+		{"secondary attributes ignored", 1, 5, "\x1b[>cab", "ab", 2, 0},
+
+		// remote hosts can send anything, none of it may get past the screen
+		{"huge counts", 3, 5, "ab\r\ncd\x1b[99999999999999999999C\x1b[99999999999999999999Bx", "ab|cd|    x", 4, 2},
+		{"huge scroll", 3, 3, "a\r\nb\x1b[99999999999999999999S", "||", 1, 1},
+		{"huge delete lines", 3, 3, "a\r\nb\x1b[1H\x1b[99999999999999999999M", "||", 0, 0},
+		{"huge insert lines", 3, 3, "a\r\nb\x1b[2H\x1b[99999999999999999999L", "a||", 0, 1},
+		{"huge delete characters", 1, 5, "abc\x1b[2G\x1b[99999999999999999999P", "a", 1, 0},
+		{"huge insert characters", 1, 5, "abc\x1b[2G\x1b[99999999999999999999@", "a", 1, 0},
+		{"huge erase characters", 1, 5, "abc\x1b[2G\x1b[99999999999999999999X", "a", 1, 0},
+		{"huge position", 2, 3, "\x1b[99999999999999999999;99999999999999999999Hx", "|  x", 2, 1},
+		{"many parameters", 1, 5, "\x1b[" + strings.Repeat("1;", 100) + "mab", "ab", 2, 0},
+	}
+
+	for _, tt := range tests {
+		s := new_vt_screen(tt.rows, tt.cols)
+		s.Write([]byte(tt.in))
+		text := strings.ReplaceAll(s.text(), "\n", "|")
+		_, x, y, _ := s.snapshot()
+		if text != tt.text || x != tt.x || y != tt.y {
+			t.Errorf("%s: got %q at %d,%d, want %q at %d,%d", tt.name, text, x, y, tt.text, tt.x, tt.y)
+		}
+	}
+}
+
+func TestVTScreenResize(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		rows, cols int
+		before     string
+		to         [2]int
+		after      string
+		text       string
+		x, y       int
+	}{
+		{"keeps the lines at the cursor", 4, 5, "1\r\n2\r\n3\r\n4", [2]int{2, 5}, "", "3|4", 1, 1},
+		{"grows", 2, 3, "ab\r\ncd", [2]int{3, 5}, "e", "ab|cde|", 3, 1},
+		{"narrows", 2, 5, "abcde", [2]int{2, 3}, "", "abc|", 2, 0},
+		// vi on a tall window, the window shrinks and vi quits
+		{"out of the alternate screen", 40, 10, "x\x1b[39;5H\x1b[?1049h\x1b[H", [2]int{20, 10}, "\x1b[?1049ly", "x" + strings.Repeat("|", 19) + "    y", 5, 19},
+		{"restore saved cursor", 10, 10, "\x1b[9;9H\x1b7", [2]int{3, 4}, "\x1b8z", "||   z", 3, 2},
+		{"scroll region reset", 6, 3, "\x1b[2;5r", [2]int{3, 3}, "\x1b[3H\na", "||a", 1, 2},
+	}
+
+	for _, tt := range tests {
+		s := new_vt_screen(tt.rows, tt.cols)
+		s.Write([]byte(tt.before))
+		if !s.resize(tt.to[0], tt.to[1]) {
+			t.Errorf("%s: resize did not change the size", tt.name)
+		}
+		s.Write([]byte(tt.after))
+		text := strings.ReplaceAll(s.text(), "\n", "|")
+		_, x, y, _ := s.snapshot()
+		if text != tt.text || x != tt.x || y != tt.y {
+			t.Errorf("%s: got %q at %d,%d, want %q at %d,%d", tt.name, text, x, y, tt.text, tt.x, tt.y)
+		}
+	}
+
+	s := new_vt_screen(3, 3)
+	if s.resize(3, 3) {
+		t.Error("resize to the same size changed it")
+	}
+}
+
+func TestVTScreenReply(t *testing.T) {
+
+	var reply string
+	s := new_vt_screen(5, 10)
+	s.reply = func(b []byte) { reply += string(b) }
+
+	s.Write([]byte("\x1b[3;4H\x1b[6n\x1b[5n\x1b[c"))
+	if reply != "\x1b[3;4R\x1b[0n\x1b[?1;2c" {
+		t.Errorf("%q", reply)
+	}
+
+	// sequences and characters split between writes
+	s = new_vt_screen(1, 10)
+	for _, p := range []string{"\x1b", "[3", "1m", "\xc3", "\xa9\xe2\x82", "\xac"} {
+		s.Write([]byte(p))
+	}
+	cells, _, _, _ := s.snapshot()
+	if s.text() != "é€" || cells[0][0].fg != 1 {
+		t.Errorf("%q %+v", s.text(), cells[0][0])
+	}
+
+	if s.app_cursor() {
+		t.Error("application cursor keys at the start")
+	}
+	s.Write([]byte("\x1b[?1h\x1b[?25l"))
+	if _, _, _, shown := s.snapshot(); !s.app_cursor() || shown {
+		t.Error("modes not set")
+	}
+}